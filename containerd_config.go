@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/pdtpartners/nix-snapshotter/pkg/config"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	defaultContainerdConfigPath = "/etc/containerd/config.toml"
+
+	// criPluginID is the ID of containerd's CRI plugin in a version 2 config.
+	criPluginID = "io.containerd.grpc.v1.cri"
+
+	// transferPluginID is the ID of containerd's local transfer service.
+	transferPluginID = "io.containerd.transfer.v1.local"
+)
+
+// loadContainerdConfig reads containerd's TOML config as generic tables. A
+// missing config is treated as an empty one, as containerd would.
+func loadContainerdConfig(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return make(map[string]interface{}), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	tree := make(map[string]interface{})
+	err = toml.Unmarshal(data, &tree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse containerd config %q: %w", path, err)
+	}
+	return tree, nil
+}
+
+// lookupTable returns the table nested under keys, or nil if there isn't one.
+func lookupTable(tree map[string]interface{}, keys ...string) map[string]interface{} {
+	for _, key := range keys {
+		table, ok := tree[key].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		tree = table
+	}
+	return tree
+}
+
+// lookupString returns the string value at key in table, or empty if there
+// isn't one.
+func lookupString(table map[string]interface{}, key string) string {
+	value, _ := table[key].(string)
+	return value
+}
+
+// mergeContainerdConfig merges the settings containerd needs to use
+// nix-snapshotter at address into tree, leaving unrelated settings alone.
+// Snapshotter instances are added as proxy plugins named after them, at their
+// addresses.
+func mergeContainerdConfig(tree map[string]interface{}, address string, instances map[string]config.InstanceConfig) error {
+	switch version := tree["version"].(type) {
+	case nil:
+		// Configs without a version are version 1, whose plugins are named
+		// differently, e.g. "cri" instead of "io.containerd.grpc.v1.cri".
+		if len(tree) > 0 {
+			return errors.New("unsupported containerd config version 1: migrate it to version 2 first")
+		}
+		tree["version"] = 2
+	case int64:
+		if version != 2 {
+			return fmt.Errorf("unsupported containerd config version %d", version)
+		}
+	default:
+		return fmt.Errorf("invalid containerd config version %v", version)
+	}
+
+	proxyPlugin := ensureTable(tree, "proxy_plugins", "nix")
+	proxyPlugin["type"] = "snapshot"
+	proxyPlugin["address"] = address
+	for name, ic := range instances {
+		instancePlugin := ensureTable(tree, "proxy_plugins", name)
+		instancePlugin["type"] = "snapshot"
+		instancePlugin["address"] = ic.Address
+	}
+
+	ensureTable(tree, "plugins", criPluginID, "containerd")["snapshotter"] = "nix"
+
+	// Unpack images pulled through the transfer service for this platform with
+	// the nix snapshotter, replacing any existing entry for the platform.
+	transfer := ensureTable(tree, "plugins", transferPluginID)
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	unpackConfig := []interface{}{}
+	if existing, ok := transfer["unpack_config"].([]interface{}); ok {
+		for _, entry := range existing {
+			table, ok := entry.(map[string]interface{})
+			if ok && lookupString(table, "platform") == platform {
+				continue
+			}
+			unpackConfig = append(unpackConfig, entry)
+		}
+	}
+	transfer["unpack_config"] = append(unpackConfig, map[string]interface{}{
+		"platform":    platform,
+		"snapshotter": "nix",
+	})
+	return nil
+}
+
+// ensureTable returns the table nested under keys, creating any tables that
+// don't exist yet.
+func ensureTable(tree map[string]interface{}, keys ...string) map[string]interface{} {
+	for _, key := range keys {
+		table, ok := tree[key].(map[string]interface{})
+		if !ok {
+			table = make(map[string]interface{})
+			tree[key] = table
+		}
+		tree = table
+	}
+	return tree
+}
+
+func newContainerdConfigCommand(loadConfig func(*cli.Context) (*config.Config, error)) *cli.Command {
+	return &cli.Command{
+		Name:  "containerd-config",
+		Usage: "merge the settings for nix-snapshotter into containerd's configuration",
+		Description: "Reads containerd's configuration, merges in the nix proxy plugin and " +
+			"makes CRI and the transfer service use it, then prints the result. " +
+			"Snapshotter instances are added as proxy plugins named after them. " +
+			"Unrelated settings are kept, but comments and formatting are not. " +
+			"Only version 2 configs are supported.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "containerd-config",
+				Value: defaultContainerdConfigPath,
+				Usage: "Path to containerd's configuration file",
+			},
+			&cli.BoolFlag{
+				Name:  "write",
+				Usage: "Write the result back to the configuration file instead of printing it",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			cfg, err := loadConfig(c)
+			if err != nil {
+				return err
+			}
+
+			path := c.String("containerd-config")
+			tree, err := loadContainerdConfig(path)
+			if err != nil {
+				return err
+			}
+			err = mergeContainerdConfig(tree, cfg.Address, cfg.Instances)
+			if err != nil {
+				return err
+			}
+
+			data, err := toml.Marshal(tree)
+			if err != nil {
+				return err
+			}
+
+			if cfg.ImageService.Enable {
+				fmt.Fprintf(os.Stderr, "Configure kubelet with --image-service-endpoint unix://%s to use the image service\n", cfg.Address)
+			}
+
+			if !c.Bool("write") {
+				_, err = os.Stdout.Write(data)
+				return err
+			}
+			return writeFileAtomic(path, data)
+		},
+	}
+}
+
+// writeFileAtomic replaces the file at path with data, keeping its mode if it
+// already exists.
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0o644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/pdtpartners/nix-snapshotter/pkg/config"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeContainerdConfig(t *testing.T) {
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+
+	type testCase struct {
+		name      string
+		existing  string
+		instances map[string]config.InstanceConfig
+		expected  string
+		expectErr bool
+	}
+
+	for _, tc := range []testCase{
+		{
+			name:     "empty",
+			existing: ``,
+			expected: `
+version = 2
+
+[proxy_plugins.nix]
+type = "snapshot"
+address = "/run/nix-snapshotter/nix-snapshotter.sock"
+
+[plugins."io.containerd.grpc.v1.cri".containerd]
+snapshotter = "nix"
+
+[[plugins."io.containerd.transfer.v1.local".unpack_config]]
+platform = "` + platform + `"
+snapshotter = "nix"
+`,
+		},
+		{
+			name: "unrelated tables",
+			existing: `
+version = 2
+root = "/var/lib/containerd"
+
+[grpc]
+address = "/run/containerd/containerd.sock"
+
+[plugins."io.containerd.grpc.v1.cri"]
+sandbox_image = "pause:3.9"
+
+[plugins."io.containerd.grpc.v1.cri".containerd]
+default_runtime_name = "runc"
+`,
+			expected: `
+version = 2
+root = "/var/lib/containerd"
+
+[grpc]
+address = "/run/containerd/containerd.sock"
+
+[proxy_plugins.nix]
+type = "snapshot"
+address = "/run/nix-snapshotter/nix-snapshotter.sock"
+
+[plugins."io.containerd.grpc.v1.cri"]
+sandbox_image = "pause:3.9"
+
+[plugins."io.containerd.grpc.v1.cri".containerd]
+default_runtime_name = "runc"
+snapshotter = "nix"
+
+[[plugins."io.containerd.transfer.v1.local".unpack_config]]
+platform = "` + platform + `"
+snapshotter = "nix"
+`,
+		},
+		{
+			name: "existing proxy plugins",
+			existing: `
+version = 2
+
+[proxy_plugins.stargz]
+type = "snapshot"
+address = "/run/containerd-stargz-grpc/containerd-stargz-grpc.sock"
+
+[proxy_plugins.nix]
+type = "snapshot"
+address = "/run/old/nix-snapshotter.sock"
+`,
+			instances: map[string]config.InstanceConfig{
+				"nix-fuse": {Address: "/run/nix-snapshotter/nix-fuse.sock"},
+			},
+			expected: `
+version = 2
+
+[proxy_plugins.stargz]
+type = "snapshot"
+address = "/run/containerd-stargz-grpc/containerd-stargz-grpc.sock"
+
+[proxy_plugins.nix]
+type = "snapshot"
+address = "/run/nix-snapshotter/nix-snapshotter.sock"
+
+[proxy_plugins.nix-fuse]
+type = "snapshot"
+address = "/run/nix-snapshotter/nix-fuse.sock"
+
+[plugins."io.containerd.grpc.v1.cri".containerd]
+snapshotter = "nix"
+
+[[plugins."io.containerd.transfer.v1.local".unpack_config]]
+platform = "` + platform + `"
+snapshotter = "nix"
+`,
+		},
+		{
+			name: "unpack config",
+			existing: `
+version = 2
+
+[[plugins."io.containerd.transfer.v1.local".unpack_config]]
+platform = "` + platform + `"
+snapshotter = "overlayfs"
+
+[[plugins."io.containerd.transfer.v1.local".unpack_config]]
+platform = "plan9/amd64"
+snapshotter = "overlayfs"
+`,
+			expected: `
+version = 2
+
+[proxy_plugins.nix]
+type = "snapshot"
+address = "/run/nix-snapshotter/nix-snapshotter.sock"
+
+[plugins."io.containerd.grpc.v1.cri".containerd]
+snapshotter = "nix"
+
+[[plugins."io.containerd.transfer.v1.local".unpack_config]]
+platform = "plan9/amd64"
+snapshotter = "overlayfs"
+
+[[plugins."io.containerd.transfer.v1.local".unpack_config]]
+platform = "` + platform + `"
+snapshotter = "nix"
+`,
+		},
+		{
+			name: "version 1",
+			existing: `
+[plugins.cri.containerd]
+snapshotter = "overlayfs"
+`,
+			expectErr: true,
+		},
+		{
+			name:      "version 3",
+			existing:  `version = 3`,
+			expectErr: true,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tree := make(map[string]interface{})
+			require.NoError(t, toml.Unmarshal([]byte(tc.existing), &tree))
+
+			address := "/run/nix-snapshotter/nix-snapshotter.sock"
+			err := mergeContainerdConfig(tree, address, tc.instances)
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			expected := make(map[string]interface{})
+			require.NoError(t, toml.Unmarshal([]byte(tc.expected), &expected))
+			require.Equal(t, expected, roundTripTOML(t, tree))
+
+			// Merging the result again changes nothing.
+			merged := roundTripTOML(t, tree)
+			require.NoError(t, mergeContainerdConfig(merged, address, tc.instances))
+			require.Equal(t, expected, roundTripTOML(t, merged))
+		})
+	}
+}
+
+// roundTripTOML returns tree as it is read back after being written, so that
+// it can be compared with a parsed config.
+func roundTripTOML(t *testing.T, tree map[string]interface{}) map[string]interface{} {
+	data, err := toml.Marshal(tree)
+	require.NoError(t, err)
+	roundTripped := make(map[string]interface{})
+	require.NoError(t, toml.Unmarshal(data, &roundTripped))
+	return roundTripped
+}
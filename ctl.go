@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/proxy"
+	"github.com/pdtpartners/nix-snapshotter/pkg/admin"
+	"github.com/pdtpartners/nix-snapshotter/pkg/config"
+	"github.com/pdtpartners/nix-snapshotter/pkg/nix2container"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func newCtlCommand(loadConfig func(*cli.Context) (*config.Config, error)) *cli.Command {
+	withConn := func(c *cli.Context, fn func(conn *grpc.ClientConn) error) error {
+		cfg, err := loadInstanceConfig(c, loadConfig)
+		if err != nil {
+			return err
+		}
+
+		conn, err := grpc.DialContext(c.Context, "unix://"+cfg.Address,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to dial %q: %w", cfg.Address, err)
+		}
+		defer conn.Close()
+
+		return fn(conn)
+	}
+
+	withClient := func(c *cli.Context, fn func(client admin.AdminClient) error) error {
+		return withConn(c, func(conn *grpc.ClientConn) error {
+			return fn(admin.NewAdminClient(conn))
+		})
+	}
+
+	return &cli.Command{
+		Name:  "ctl",
+		Usage: "inspect a running nix-snapshotter",
+		Flags: []cli.Flag{
+			instanceFlag,
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:    "list",
+				Aliases: []string{"ls"},
+				Usage:   "list snapshots and their nix store paths",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Print the full snapshot details as JSON",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return withClient(c, func(client admin.AdminClient) error {
+						resp, err := client.ListSnapshots(c.Context, &admin.ListSnapshotsRequest{})
+						if err != nil {
+							return err
+						}
+						if c.Bool("json") {
+							return printJSON(os.Stdout, resp.Snapshots)
+						}
+
+						tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, ' ', 0)
+						fmt.Fprintln(tw, "KEY\tKIND\tPARENT\tSTORE PATHS\tSIZE\tGCROOTS")
+						for _, sn := range resp.Snapshots {
+							parent := ""
+							if len(sn.Parents) > 0 {
+								parent = sn.Parents[0]
+							}
+							fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\n",
+								sn.Key,
+								sn.Kind,
+								parent,
+								len(sn.NixStorePaths),
+								sn.Usage.Size,
+								sn.GCRootsDir,
+							)
+						}
+						return tw.Flush()
+					})
+				},
+			},
+			{
+				Name:  "usage",
+				Usage: "show the resources used by the snapshots of each containerd namespace",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Print the usage as JSON",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return withClient(c, func(client admin.AdminClient) error {
+						resp, err := client.NamespaceUsage(c.Context, &admin.NamespaceUsageRequest{})
+						if err != nil {
+							return err
+						}
+						if c.Bool("json") {
+							return printJSON(os.Stdout, resp.Namespaces)
+						}
+
+						tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, ' ', 0)
+						fmt.Fprintln(tw, "NAMESPACE\tSNAPSHOTS\tSTORE PATHS\tSIZE\tINODES")
+						for _, usage := range resp.Namespaces {
+							namespace := usage.Namespace
+							if namespace == "" {
+								namespace = "-"
+							}
+							fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n",
+								namespace,
+								usage.Snapshots,
+								usage.NixStorePaths,
+								usage.Usage.Size,
+								usage.Usage.Inodes,
+							)
+						}
+						return tw.Flush()
+					})
+				},
+			},
+			{
+				Name:      "inspect",
+				Usage:     "print the details of a snapshot as JSON",
+				ArgsUsage: "<key>",
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return fmt.Errorf("must provide exactly 1 arg")
+					}
+					key := c.Args().Get(0)
+
+					return withClient(c, func(client admin.AdminClient) error {
+						resp, err := client.ListSnapshots(c.Context, &admin.ListSnapshotsRequest{})
+						if err != nil {
+							return err
+						}
+						for _, sn := range resp.Snapshots {
+							if sn.Key == key {
+								return printJSON(os.Stdout, sn)
+							}
+						}
+						return fmt.Errorf("snapshot %q not found", key)
+					})
+				},
+			},
+			{
+				Name:      "mounts",
+				Usage:     "print the mounts returned for a snapshot",
+				ArgsUsage: "<key>",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Print the mounts as JSON",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return fmt.Errorf("must provide exactly 1 arg")
+					}
+
+					return withClient(c, func(client admin.AdminClient) error {
+						resp, err := client.Mounts(c.Context, &admin.MountsRequest{
+							Key: c.Args().Get(0),
+						})
+						if err != nil {
+							return err
+						}
+						if c.Bool("json") {
+							return printJSON(os.Stdout, resp.Mounts)
+						}
+
+						tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, ' ', 0)
+						fmt.Fprintln(tw, "TYPE\tSOURCE\tTARGET\tOPTIONS")
+						for _, m := range resp.Mounts {
+							fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n",
+								m.Type,
+								m.Source,
+								m.Target,
+								strings.Join(m.Options, ","),
+							)
+						}
+						return tw.Flush()
+					})
+				},
+			},
+			{
+				Name:      "inject",
+				Usage:     "add nix store paths to the mounts of an active snapshot",
+				ArgsUsage: "<key> <store-path>...",
+				Description: "Realises the nix store paths with gc roots and labels the snapshot, " +
+					"so that they are returned by mounts. Running containers are not " +
+					"changed, the store paths must be mounted into them separately.",
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 2 {
+						return fmt.Errorf("must provide a key and at least 1 store path")
+					}
+					key := c.Args().First()
+					nixStorePaths := c.Args().Tail()
+
+					return withConn(c, func(conn *grpc.ClientConn) error {
+						sn := proxy.NewSnapshotter(snapshotsapi.NewSnapshotsClient(conn), "nix")
+						info, err := sn.Stat(c.Context, key)
+						if err != nil {
+							return err
+						}
+
+						// Label the new store paths after the existing ones.
+						next := 0
+						existing := make(map[string]struct{})
+						for k, v := range info.Labels {
+							suffix, ok := strings.CutPrefix(k, nix2container.NixStorePrefixAnnotation)
+							if !ok {
+								continue
+							}
+							existing[v] = struct{}{}
+							if i, err := strconv.Atoi(suffix); err == nil && i >= next {
+								next = i + 1
+							}
+						}
+
+						update := snapshots.Info{
+							Name:   key,
+							Labels: make(map[string]string),
+						}
+						var (
+							fieldpaths []string
+							injected   []string
+						)
+						for _, nixStorePath := range nixStorePaths {
+							if !filepath.IsAbs(nixStorePath) {
+								return fmt.Errorf("store path %q must be absolute", nixStorePath)
+							}
+							if _, ok := existing[nixStorePath]; ok {
+								fmt.Printf("%s is already in %s\n", nixStorePath, key)
+								continue
+							}
+							existing[nixStorePath] = struct{}{}
+
+							label := nix2container.NixStorePrefixAnnotation + strconv.Itoa(next)
+							next++
+							update.Labels[label] = nixStorePath
+							fieldpaths = append(fieldpaths, "labels."+label)
+							injected = append(injected, nixStorePath)
+						}
+						if len(fieldpaths) == 0 {
+							return nil
+						}
+
+						_, err = sn.Update(c.Context, update, fieldpaths...)
+						if err != nil {
+							return err
+						}
+						for _, nixStorePath := range injected {
+							fmt.Printf("Injected %s into %s\n", nixStorePath, key)
+						}
+						return nil
+					})
+				},
+			},
+		},
+	}
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pdtpartners/nix-snapshotter/pkg/config"
+	"github.com/pdtpartners/nix-snapshotter/pkg/nix"
+	"github.com/pdtpartners/nix-snapshotter/pkg/socket"
+)
+
+// serveDebug serves net/http/pprof at address until the returned server is
+// closed.
+func serveDebug(ctx context.Context, address string) (*http.Server, error) {
+	var (
+		l   net.Listener
+		err error
+	)
+	if filepath.IsAbs(address) {
+		l, err = socket.Listen(address, config.SocketConfig{})
+	} else {
+		l, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on debug address %q: %w", address, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Minute,
+	}
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.G(ctx).WithError(err).Warn("Error on serving debug endpoints")
+		}
+	}()
+
+	log.G(ctx).WithField("address", address).Info("Serving debug endpoints")
+	return srv, nil
+}
+
+// debugDump is the summary written by dumpDebugState.
+type debugDump struct {
+	Time     time.Time                 `json:"time"`
+	Services map[string]nix.DebugState `json:"services"`
+}
+
+// dumpDebugState writes the stacks of all goroutines and a JSON summary of the
+// in-flight operations of services to files under the root dir.
+func dumpDebugState(ctx context.Context, root string, services map[string]nix.Debugger) error {
+	dir := filepath.Join(root, "debug")
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	prefix := filepath.Join(dir, now.UTC().Format("20060102T150405.000000000Z"))
+
+	// Grow the buffer until the stacks of all goroutines fit.
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	stacksPath := prefix + "-goroutines.log"
+	err = os.WriteFile(stacksPath, buf, 0o600)
+	if err != nil {
+		return err
+	}
+
+	dump := debugDump{
+		Time:     now,
+		Services: make(map[string]nix.DebugState),
+	}
+	for name, service := range services {
+		dump.Services[name] = service.DebugState()
+	}
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return err
+	}
+	statePath := prefix + "-state.json"
+	err = os.WriteFile(statePath, data, 0o600)
+	if err != nil {
+		return err
+	}
+
+	log.G(ctx).
+		WithField("goroutines", stacksPath).
+		WithField("state", statePath).
+		Info("Dumped debug state")
+	return nil
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd"
+	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
+	"github.com/pdtpartners/nix-snapshotter/pkg/config"
+	"github.com/pdtpartners/nix-snapshotter/pkg/nix"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const doctorTimeout = 5 * time.Second
+
+// doctorCheck is a preflight check run by the doctor command. run returns a
+// message describing what passed, or an error describing what failed.
+type doctorCheck struct {
+	name string
+	hint string
+	run  func(ctx context.Context) (string, error)
+}
+
+// doctorResult is the outcome of a doctorCheck.
+type doctorResult struct {
+	Name    string `json:"name"`
+	Pass    bool   `json:"pass"`
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+// pathChecker checks the access of the daemon's user to paths, as
+// access(2) does.
+type pathChecker interface {
+	Access(path string, mode uint32) error
+}
+
+// builderChecker checks that a nix builder is available, e.g. that nix-store
+// is on PATH.
+type builderChecker interface {
+	CheckBuilder(externalBuilder string) error
+}
+
+// socketDialer connects to unix sockets. It is implemented by net.Dialer.
+type socketDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// mountBackendChecker checks which mount backends root supports.
+type mountBackendChecker interface {
+	DetectMountBackend(ctx context.Context, root string) (nix.MountBackend, error)
+	CheckMountBackend(ctx context.Context, root string, backend nix.MountBackend) error
+}
+
+// containerdProber returns the version of the containerd at address.
+type containerdProber interface {
+	ContainerdVersion(ctx context.Context, address string) (string, error)
+}
+
+// snapshotterProber checks that the snapshots service at address is serving.
+type snapshotterProber interface {
+	CheckServing(ctx context.Context, address string) error
+}
+
+// doctorEnv is the system the doctor checks inspect.
+type doctorEnv struct {
+	paths         pathChecker
+	builders      builderChecker
+	dialer        socketDialer
+	mountBackends mountBackendChecker
+	containerd    containerdProber
+	snapshotter   snapshotterProber
+}
+
+// systemDoctorEnv returns the doctorEnv of the host.
+func systemDoctorEnv() doctorEnv {
+	return doctorEnv{
+		paths:         systemDoctor{},
+		builders:      systemDoctor{},
+		dialer:        &net.Dialer{},
+		mountBackends: systemDoctor{},
+		containerd:    systemDoctor{},
+		snapshotter:   systemDoctor{},
+	}
+}
+
+// systemDoctor implements the interfaces of doctorEnv for the host.
+type systemDoctor struct{}
+
+func (systemDoctor) Access(path string, mode uint32) error {
+	return unix.Access(path, mode)
+}
+
+func (systemDoctor) CheckBuilder(externalBuilder string) error {
+	return nix.CheckBuilder(externalBuilder)
+}
+
+func (systemDoctor) DetectMountBackend(ctx context.Context, root string) (nix.MountBackend, error) {
+	return nix.DetectMountBackend(ctx, root)
+}
+
+func (systemDoctor) CheckMountBackend(ctx context.Context, root string, backend nix.MountBackend) error {
+	return nix.CheckMountBackend(ctx, root, backend)
+}
+
+func (systemDoctor) ContainerdVersion(ctx context.Context, address string) (string, error) {
+	client, err := containerd.New(address, containerd.WithTimeout(doctorTimeout))
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to containerd at %s: %w", address, err)
+	}
+	defer client.Close()
+
+	version, err := client.Version(ctx)
+	if err != nil {
+		return "", err
+	}
+	return version.Version, nil
+}
+
+func (systemDoctor) CheckServing(ctx context.Context, address string) error {
+	conn, err := grpc.DialContext(ctx, "unix://"+address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", address, err)
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{
+		Service: snapshotsapi.Snapshots_ServiceDesc.ServiceName,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return errors.New("snapshots service is not serving")
+	}
+	return nil
+}
+
+// runDoctorChecks runs checks, each bounded by doctorTimeout, and returns
+// their results and the number of checks that failed.
+func runDoctorChecks(ctx context.Context, checks []doctorCheck) ([]doctorResult, int) {
+	var (
+		results []doctorResult
+		failed  int
+	)
+	for _, check := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, doctorTimeout)
+		msg, err := check.run(checkCtx)
+		cancel()
+
+		result := doctorResult{
+			Name:    check.name,
+			Pass:    err == nil,
+			Message: msg,
+		}
+		if err != nil {
+			result.Message = err.Error()
+			result.Hint = check.hint
+			failed++
+		}
+		results = append(results, result)
+	}
+	return results, failed
+}
+
+func newDoctorCommand(loadConfig func(*cli.Context) (*config.Config, error)) *cli.Command {
+	return &cli.Command{
+		Name:  "doctor",
+		Usage: "check that nix-snapshotter and containerd are set up correctly",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "containerd-config",
+				Value: defaultContainerdConfigPath,
+				Usage: "Path to containerd's configuration file",
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "Print the results as JSON",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			cfg, err := loadConfig(c)
+			if err != nil {
+				return err
+			}
+
+			checks := doctorChecks(cfg, c.String("containerd-config"), systemDoctorEnv())
+			results, failed := runDoctorChecks(c.Context, checks)
+
+			if c.Bool("json") {
+				err = printJSON(os.Stdout, results)
+				if err != nil {
+					return err
+				}
+			} else {
+				for _, result := range results {
+					status := "PASS"
+					if !result.Pass {
+						status = "FAIL"
+					}
+					fmt.Printf("[%s] %s: %s\n", status, result.Name, result.Message)
+					if result.Hint != "" {
+						fmt.Printf("       hint: %s\n", result.Hint)
+					}
+				}
+			}
+
+			if failed > 0 {
+				return fmt.Errorf("%d of %d checks failed", failed, len(results))
+			}
+			return nil
+		},
+	}
+}
+
+func doctorChecks(cfg *config.Config, containerdConfigPath string, env doctorEnv) []doctorCheck {
+	return []doctorCheck{
+		{
+			name: "mount backend",
+			hint: "Move root to a filesystem that supports overlayfs with d_type, such as ext4 or xfs with ftype=1, or install fuse-overlayfs",
+			run: func(ctx context.Context) (string, error) {
+				if underlying := cfg.Snapshotter.Underlying; underlying != "overlay" {
+					return fmt.Sprintf("snapshots are stored by the %s snapshotter", underlying), nil
+				}
+
+				backend := nix.MountBackend(cfg.Snapshotter.MountBackend)
+				if backend == nix.MountBackendAuto {
+					detected, err := env.mountBackends.DetectMountBackend(ctx, cfg.Root)
+					if err != nil {
+						return "", err
+					}
+					return fmt.Sprintf("detected %s on %s", detected, cfg.Root), nil
+				}
+
+				err := env.mountBackends.CheckMountBackend(ctx, cfg.Root, backend)
+				if err != nil {
+					return "", fmt.Errorf("%s is not supported on %s: %w", backend, cfg.Root, err)
+				}
+				return fmt.Sprintf("%s is supported on %s", backend, cfg.Root), nil
+			},
+		},
+		{
+			name: "root",
+			hint: "Run nix-snapshotter as a user that can write to root, or change root",
+			run: func(ctx context.Context) (string, error) {
+				err := env.paths.Access(cfg.Root, unix.W_OK|unix.X_OK)
+				if err != nil {
+					return "", fmt.Errorf("%s is not writable: %w", cfg.Root, err)
+				}
+				return fmt.Sprintf("%s is writable", cfg.Root), nil
+			},
+		},
+		{
+			name: "builder",
+			hint: "Add nix-store to PATH, or set external_builder to an executable",
+			run: func(ctx context.Context) (string, error) {
+				err := env.builders.CheckBuilder(cfg.ExternalBuilder)
+				if err != nil {
+					return "", err
+				}
+				return "nix builder is available", nil
+			},
+		},
+		{
+			name: "nix store",
+			hint: "Install nix, or set snapshotter.store_dir to the nix store in use",
+			run: func(ctx context.Context) (string, error) {
+				storeDir := filepath.Join(cfg.Snapshotter.StoreRoot, nixStoreDir(cfg))
+				err := env.paths.Access(storeDir, unix.R_OK|unix.X_OK)
+				if err != nil {
+					return "", fmt.Errorf("%s is not readable: %w", storeDir, err)
+				}
+				return fmt.Sprintf("%s is readable", storeDir), nil
+			},
+		},
+		{
+			name: "gc roots",
+			hint: "Start the nix daemon, or run nix-snapshotter as a user that can write to the nix gc roots",
+			run: func(ctx context.Context) (string, error) {
+				stateDir := nixStateDir(cfg)
+				daemonSocket := os.Getenv("NIX_DAEMON_SOCKET_PATH")
+				if daemonSocket == "" {
+					daemonSocket = filepath.Join(stateDir, "daemon-socket", "socket")
+				}
+
+				// Without a nix daemon, gc roots are registered by nix-store itself.
+				if err := env.paths.Access(daemonSocket, unix.F_OK); err == nil {
+					conn, err := env.dialer.DialContext(ctx, "unix", daemonSocket)
+					if err != nil {
+						return "", fmt.Errorf("failed to connect to nix daemon: %w", err)
+					}
+					conn.Close()
+					return fmt.Sprintf("gc roots are registered through the nix daemon at %s", daemonSocket), nil
+				}
+
+				autoRoots := filepath.Join(stateDir, "gcroots", "auto")
+				err := env.paths.Access(autoRoots, unix.W_OK|unix.X_OK)
+				if err != nil {
+					return "", fmt.Errorf("no nix daemon at %s and %s is not writable: %w", daemonSocket, autoRoots, err)
+				}
+				return fmt.Sprintf("gc roots are registered in %s", autoRoots), nil
+			},
+		},
+		{
+			name: "containerd",
+			hint: "Start containerd, or set image_service.containerd_address to its address",
+			run: func(ctx context.Context) (string, error) {
+				address := cfg.ImageService.ContainerdAddress
+				version, err := env.containerd.ContainerdVersion(ctx, address)
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("containerd %s is reachable at %s", version, address), nil
+			},
+		},
+		{
+			name: "containerd proxy plugin",
+			hint: fmt.Sprintf("Add [proxy_plugins.nix] to %s with type = \"snapshot\" and address = %q", containerdConfigPath, cfg.Address),
+			run: func(ctx context.Context) (string, error) {
+				tree, err := loadContainerdConfig(containerdConfigPath)
+				if err != nil {
+					return "", err
+				}
+
+				plugin := lookupTable(tree, "proxy_plugins", "nix")
+				if plugin == nil {
+					return "", fmt.Errorf("no nix proxy plugin in %s", containerdConfigPath)
+				}
+				if typ := lookupString(plugin, "type"); typ != "snapshot" {
+					return "", fmt.Errorf("nix proxy plugin has type %q instead of \"snapshot\"", typ)
+				}
+				if address := lookupString(plugin, "address"); address != cfg.Address {
+					return "", fmt.Errorf("nix proxy plugin has address %q instead of %q", address, cfg.Address)
+				}
+				return fmt.Sprintf("nix proxy plugin is configured in %s", containerdConfigPath), nil
+			},
+		},
+		{
+			name: "containerd cri",
+			hint: fmt.Sprintf("Set snapshotter = \"nix\" under [plugins.%q.containerd] in %s to use nix-snapshotter with Kubernetes", criPluginID, containerdConfigPath),
+			run: func(ctx context.Context) (string, error) {
+				tree, err := loadContainerdConfig(containerdConfigPath)
+				if err != nil {
+					return "", err
+				}
+
+				snapshotter := lookupString(lookupTable(tree, "plugins", criPluginID, "containerd"), "snapshotter")
+				if snapshotter != "nix" {
+					return "", fmt.Errorf("CRI uses snapshotter %q instead of \"nix\"", snapshotter)
+				}
+				return "CRI uses the nix snapshotter", nil
+			},
+		},
+		{
+			name: "socket",
+			hint: "Start nix-snapshotter, or check that address matches the running daemon",
+			run: func(ctx context.Context) (string, error) {
+				err := env.snapshotter.CheckServing(ctx, cfg.Address)
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("nix-snapshotter is serving at %s", cfg.Address), nil
+			},
+		},
+	}
+}
+
+// nixStoreDir returns the nix store directory used by the nix builder.
+func nixStoreDir(cfg *config.Config) string {
+	if dir := cfg.Snapshotter.StoreDir; dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("NIX_STORE_DIR"); dir != "" {
+		return dir
+	}
+	return "/nix/store"
+}
+
+// nixStateDir returns the nix state directory used by the nix builder.
+func nixStateDir(cfg *config.Config) string {
+	if cfg.Snapshotter.StoreRoot != "" {
+		return filepath.Join(cfg.Snapshotter.StoreRoot, "nix", "var", "nix")
+	}
+	if dir := os.Getenv("NIX_STATE_DIR"); dir != "" {
+		return dir
+	}
+	return "/nix/var/nix"
+}
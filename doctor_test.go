@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pdtpartners/nix-snapshotter/pkg/config"
+	"github.com/pdtpartners/nix-snapshotter/pkg/nix"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDoctor implements the interfaces of doctorEnv, failing with the errors
+// it is given.
+type fakeDoctor struct {
+	// denied are the paths that Access fails for.
+	denied map[string]error
+
+	builderErr     error
+	dialErr        error
+	mountErr       error
+	containerdErr  error
+	snapshotterErr error
+}
+
+func (f *fakeDoctor) Access(path string, mode uint32) error {
+	return f.denied[path]
+}
+
+func (f *fakeDoctor) CheckBuilder(externalBuilder string) error {
+	return f.builderErr
+}
+
+func (f *fakeDoctor) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if f.dialErr != nil {
+		return nil, f.dialErr
+	}
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+func (f *fakeDoctor) DetectMountBackend(ctx context.Context, root string) (nix.MountBackend, error) {
+	return nix.MountBackendOverlayfs, f.mountErr
+}
+
+func (f *fakeDoctor) CheckMountBackend(ctx context.Context, root string, backend nix.MountBackend) error {
+	return f.mountErr
+}
+
+func (f *fakeDoctor) ContainerdVersion(ctx context.Context, address string) (string, error) {
+	return "v1.7.0", f.containerdErr
+}
+
+func (f *fakeDoctor) CheckServing(ctx context.Context, address string) error {
+	return f.snapshotterErr
+}
+
+func (f *fakeDoctor) env() doctorEnv {
+	return doctorEnv{
+		paths:         f,
+		builders:      f,
+		dialer:        f,
+		mountBackends: f,
+		containerd:    f,
+		snapshotter:   f,
+	}
+}
+
+func TestDoctorChecks(t *testing.T) {
+	t.Setenv("NIX_DAEMON_SOCKET_PATH", "")
+	t.Setenv("NIX_STATE_DIR", "")
+	t.Setenv("NIX_STORE_DIR", "")
+
+	errDenied := errors.New("permission denied")
+	goodConfig := `
+version = 2
+
+[proxy_plugins.nix]
+type = "snapshot"
+address = "/run/nix-snapshotter/nix-snapshotter.sock"
+
+[plugins."io.containerd.grpc.v1.cri".containerd]
+snapshotter = "nix"
+`
+
+	type testCase struct {
+		name             string
+		containerdConfig string
+		setup            func(cfg *config.Config, f *fakeDoctor)
+		failed           []string
+	}
+
+	for _, tc := range []testCase{
+		{
+			name:             "healthy",
+			containerdConfig: goodConfig,
+		},
+		{
+			name:             "nix not on path",
+			containerdConfig: goodConfig,
+			setup: func(cfg *config.Config, f *fakeDoctor) {
+				f.builderErr = errors.New(`exec: "nix-store": executable file not found in $PATH`)
+			},
+			failed: []string{"builder"},
+		},
+		{
+			name:             "root not writable",
+			containerdConfig: goodConfig,
+			setup: func(cfg *config.Config, f *fakeDoctor) {
+				f.denied[cfg.Root] = errDenied
+			},
+			failed: []string{"root"},
+		},
+		{
+			name:             "store not readable",
+			containerdConfig: goodConfig,
+			setup: func(cfg *config.Config, f *fakeDoctor) {
+				f.denied["/nix/store"] = errDenied
+			},
+			failed: []string{"nix store"},
+		},
+		{
+			name:             "gc roots not writable without a nix daemon",
+			containerdConfig: goodConfig,
+			setup: func(cfg *config.Config, f *fakeDoctor) {
+				f.denied["/nix/var/nix/daemon-socket/socket"] = os.ErrNotExist
+				f.denied["/nix/var/nix/gcroots/auto"] = errDenied
+			},
+			failed: []string{"gc roots"},
+		},
+		{
+			name:             "nix daemon not reachable",
+			containerdConfig: goodConfig,
+			setup: func(cfg *config.Config, f *fakeDoctor) {
+				f.dialErr = errors.New("connection refused")
+			},
+			failed: []string{"gc roots"},
+		},
+		{
+			name:             "mount backend unsupported",
+			containerdConfig: goodConfig,
+			setup: func(cfg *config.Config, f *fakeDoctor) {
+				cfg.Snapshotter.MountBackend = string(nix.MountBackendOverlayfs)
+				f.mountErr = errors.New("overlayfs requires d_type")
+			},
+			failed: []string{"mount backend"},
+		},
+		{
+			name:             "containerd not reachable",
+			containerdConfig: goodConfig,
+			setup: func(cfg *config.Config, f *fakeDoctor) {
+				f.containerdErr = errors.New("connection refused")
+			},
+			failed: []string{"containerd"},
+		},
+		{
+			name:             "socket not reachable",
+			containerdConfig: goodConfig,
+			setup: func(cfg *config.Config, f *fakeDoctor) {
+				f.snapshotterErr = errors.New("connection refused")
+			},
+			failed: []string{"socket"},
+		},
+		{
+			name:             "missing containerd config",
+			containerdConfig: "",
+			failed:           []string{"containerd proxy plugin", "containerd cri"},
+		},
+		{
+			name: "proxy plugin at another address",
+			containerdConfig: `
+version = 2
+
+[proxy_plugins.nix]
+type = "snapshot"
+address = "/run/other.sock"
+
+[plugins."io.containerd.grpc.v1.cri".containerd]
+snapshotter = "nix"
+`,
+			failed: []string{"containerd proxy plugin"},
+		},
+		{
+			name: "cri uses another snapshotter",
+			containerdConfig: `
+version = 2
+
+[proxy_plugins.nix]
+type = "snapshot"
+address = "/run/nix-snapshotter/nix-snapshotter.sock"
+
+[plugins."io.containerd.grpc.v1.cri".containerd]
+snapshotter = "overlayfs"
+`,
+			failed: []string{"containerd cri"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := config.New()
+			cfg.Root = t.TempDir()
+			cfg.Address = "/run/nix-snapshotter/nix-snapshotter.sock"
+
+			containerdConfigPath := filepath.Join(t.TempDir(), "config.toml")
+			if tc.containerdConfig != "" {
+				err := os.WriteFile(containerdConfigPath, []byte(tc.containerdConfig), 0o644)
+				require.NoError(t, err)
+			}
+
+			f := &fakeDoctor{denied: make(map[string]error)}
+			if tc.setup != nil {
+				tc.setup(cfg, f)
+			}
+
+			checks := doctorChecks(cfg, containerdConfigPath, f.env())
+			results, failed := runDoctorChecks(context.Background(), checks)
+			require.Len(t, results, len(checks))
+			require.Equal(t, len(tc.failed), failed)
+
+			var failedNames []string
+			for _, result := range results {
+				if !result.Pass {
+					failedNames = append(failedNames, result.Name)
+					require.NotEmpty(t, result.Hint)
+				} else {
+					require.Empty(t, result.Hint)
+				}
+				require.NotEmpty(t, result.Message)
+			}
+			require.Equal(t, tc.failed, failedNames)
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/containerd/containerd"
+	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/proxy"
+	"github.com/pdtpartners/nix-snapshotter/pkg/config"
+	"github.com/pdtpartners/nix-snapshotter/pkg/nix"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// triggerContainerdGC runs containerd's garbage collection and waits for it
+// to finish, by deleting a new lease synchronously. Containerd removes the
+// snapshots that are no longer referenced from the snapshotters, which in
+// turn remove their nix gc roots.
+func triggerContainerdGC(ctx context.Context, address, namespace string) error {
+	client, err := containerd.New(address)
+	if err != nil {
+		return fmt.Errorf("failed to connect to containerd at %s: %w", address, err)
+	}
+	defer client.Close()
+
+	ctx = namespaces.WithNamespace(ctx, namespace)
+	ls := client.LeasesService()
+	l, err := ls.Create(ctx, leases.WithRandomID(), leases.WithExpiration(time.Minute))
+	if err != nil {
+		return fmt.Errorf("failed to create lease: %w", err)
+	}
+	err = ls.Delete(ctx, l, leases.SynchronousDelete)
+	if err != nil {
+		return fmt.Errorf("failed to run containerd garbage collection: %w", err)
+	}
+	return nil
+}
+
+// cleanupSnapshotter removes the disk resources of removed snapshots of the
+// nix-snapshotter at address, including their nix gc roots.
+func cleanupSnapshotter(ctx context.Context, address string) error {
+	conn, err := grpc.DialContext(ctx, "unix://"+address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to dial %q: %w", address, err)
+	}
+	defer conn.Close()
+
+	sn := proxy.NewSnapshotter(snapshotsapi.NewSnapshotsClient(conn), "nix")
+	return sn.(snapshots.Cleaner).Cleanup(ctx)
+}
+
+// gcOptions configures a run of the gc command.
+type gcOptions struct {
+	dryRun            bool
+	skipContainerd    bool
+	containerdAddress string
+	namespace         string
+
+	// triggerContainerdGC and cleanupSnapshotter are replaced in tests.
+	triggerContainerdGC func(ctx context.Context, address, namespace string) error
+	cleanupSnapshotter  func(ctx context.Context, address string) error
+}
+
+// runGC reclaims disk space for the nix-snapshotter configured by cfg, and
+// reports what it did to w.
+func runGC(ctx context.Context, w io.Writer, cfg *config.Config, opts gcOptions) error {
+	// A dry run only reports, so it leaves containerd's snapshots, and the
+	// nix gc roots of removed snapshots, alone.
+	if !opts.skipContainerd && !opts.dryRun {
+		address := opts.containerdAddress
+		if address == "" {
+			address = cfg.ImageService.ContainerdAddress
+		}
+		err := opts.triggerContainerdGC(ctx, address, opts.namespace)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "Ran containerd garbage collection")
+	}
+
+	if !opts.dryRun {
+		err := opts.cleanupSnapshotter(ctx, cfg.Address)
+		if err != nil {
+			return fmt.Errorf("failed to clean up nix-snapshotter: %w", err)
+		}
+		fmt.Fprintln(w, "Cleaned up nix-snapshotter")
+	}
+
+	builderOpts := nix.BuilderOptsFromConfig(cfg)
+	garbage, err := nix.FindNixGarbage(ctx, cfg.Root, nixStateDir(cfg), builderOpts...)
+	if err != nil {
+		return err
+	}
+
+	sizes := make(map[string]int64)
+	var nixStorePaths []string
+	var total int64
+	for _, g := range garbage {
+		sizes[g.NixStorePath] = g.Size
+		nixStorePaths = append(nixStorePaths, g.NixStorePath)
+		total += g.Size
+	}
+
+	if opts.dryRun {
+		for _, g := range garbage {
+			fmt.Fprintf(w, "%s\t%d\n", g.NixStorePath, g.Size)
+		}
+		fmt.Fprintf(w, "Would delete %d nix store paths, freeing %d bytes\n", len(garbage), total)
+		return nil
+	}
+
+	deleted, err := nix.DeleteNixStorePaths(ctx, nixStorePaths, builderOpts...)
+	var freed int64
+	for _, nixStorePath := range deleted {
+		freed += sizes[nixStorePath]
+	}
+	fmt.Fprintf(w, "Deleted %d nix store paths, freeing %d bytes\n", len(deleted), freed)
+	if skipped := len(nixStorePaths) - len(deleted); skipped > 0 && err == nil {
+		fmt.Fprintf(w, "Skipped %d nix store paths that are alive again\n", skipped)
+	}
+	return err
+}
+
+func newGCCommand(loadConfig func(*cli.Context) (*config.Config, error)) *cli.Command {
+	return &cli.Command{
+		Name:  "gc",
+		Usage: "reclaim disk space from containerd and the nix store",
+		Description: `Runs containerd's garbage collection, which removes unreferenced snapshots,
+cleans up the nix-snapshotter, then deletes the nix store paths that were only
+kept alive by the nix gc roots of the removed snapshots. Nix store paths that
+are dead for other reasons are left for nix's own garbage collection.
+
+The nix store paths of removed gc roots are found through the stale links to
+them that nix keeps in its gcroots/auto directory. Any nix-collect-garbage run
+in between removes those links, after which the nix store paths of gc roots
+removed before it are no longer found, and are left to nix's own garbage
+collection.
+
+With --dry-run, neither containerd's garbage collection nor the clean up are
+run, and the nix store paths of gc roots that were already removed are
+reported but not deleted.`,
+		Flags: []cli.Flag{
+			instanceFlag,
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Report the nix store paths that would be deleted without changing anything",
+			},
+			&cli.BoolFlag{
+				Name:  "skip-containerd",
+				Usage: "Don't run containerd's garbage collection first",
+			},
+			&cli.StringFlag{
+				Name:  "containerd-address",
+				Usage: "Address of containerd, defaults to image_service.containerd_address",
+			},
+			&cli.StringFlag{
+				Name:  "namespace",
+				Value: namespaces.Default,
+				Usage: "Containerd namespace of the lease used to run its garbage collection",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			cfg, err := loadInstanceConfig(c, loadConfig)
+			if err != nil {
+				return err
+			}
+			return runGC(c.Context, os.Stdout, cfg, gcOptions{
+				dryRun:              c.Bool("dry-run"),
+				skipContainerd:      c.Bool("skip-containerd"),
+				containerdAddress:   c.String("containerd-address"),
+				namespace:           c.String("namespace"),
+				triggerContainerdGC: triggerContainerdGC,
+				cleanupSnapshotter:  cleanupSnapshotter,
+			})
+		},
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pdtpartners/nix-snapshotter/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunGC(t *testing.T) {
+	testDir := t.TempDir()
+	hello := "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12.1"
+
+	cfg := config.New()
+	cfg.Root = filepath.Join(testDir, "root")
+	cfg.Address = filepath.Join(testDir, "nix-snapshotter.sock")
+	cfg.Snapshotter.StoreRoot = filepath.Join(testDir, "store")
+	require.NoError(t, os.MkdirAll(filepath.Join(cfg.Snapshotter.StoreRoot, hello), 0o755))
+
+	// The gc root of hello was removed, but nix still links to it.
+	autoRootsDir := filepath.Join(nixStateDir(cfg), "gcroots", "auto")
+	require.NoError(t, os.MkdirAll(autoRootsDir, 0o755))
+	gcRoot := filepath.Join(cfg.Root, "gcroots", "1", filepath.Base(hello))
+	require.NoError(t, os.Symlink(gcRoot, filepath.Join(autoRootsDir, "a")))
+
+	deletedPath := filepath.Join(testDir, "deleted")
+	binDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(binDir, "nix-store"), []byte(`#!/bin/sh
+case "$*" in
+  *--print-dead*) echo `+hello+` ;;
+  *--delete*) echo "$@" >> `+deletedPath+` ;;
+esac
+`), 0o755)
+	require.NoError(t, err)
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	var calls []string
+	opts := gcOptions{
+		namespace: "default",
+		triggerContainerdGC: func(ctx context.Context, address, namespace string) error {
+			calls = append(calls, "containerd "+address+" "+namespace)
+			return nil
+		},
+		cleanupSnapshotter: func(ctx context.Context, address string) error {
+			calls = append(calls, "cleanup "+address)
+			return nil
+		},
+	}
+
+	// A dry run only reports.
+	opts.dryRun = true
+	var out bytes.Buffer
+	require.NoError(t, runGC(context.Background(), &out, cfg, opts))
+	require.Empty(t, calls)
+	require.NoFileExists(t, deletedPath)
+	require.Contains(t, out.String(), hello+"\t")
+	require.Contains(t, out.String(), "Would delete 1 nix store paths")
+
+	opts.dryRun = false
+	out.Reset()
+	require.NoError(t, runGC(context.Background(), &out, cfg, opts))
+	require.Equal(t, []string{
+		"containerd " + cfg.ImageService.ContainerdAddress + " default",
+		"cleanup " + cfg.Address,
+	}, calls)
+	deleted, err := os.ReadFile(deletedPath)
+	require.NoError(t, err)
+	require.Contains(t, string(deleted), hello)
+	require.Contains(t, out.String(), "Deleted 1 nix store paths")
+
+	// Without containerd, only the nix-snapshotter is cleaned up.
+	calls = nil
+	opts.skipContainerd = true
+	require.NoError(t, runGC(context.Background(), &out, cfg, opts))
+	require.Equal(t, []string{"cleanup " + cfg.Address}, calls)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pdtpartners/nix-snapshotter/pkg/config"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	// imageServiceName is the gRPC service name of the CRI image service.
+	imageServiceName = "runtime.v1.ImageService"
+
+	healthCheckInterval = 5 * time.Second
+)
+
+// healthCheck reports whether a gRPC service is ready to serve requests.
+type healthCheck struct {
+	service string
+	check   func(ctx context.Context) error
+}
+
+// monitorHealth periodically runs checks and updates the statuses of their
+// services in hs. The overall status, under the empty service name, is
+// serving only when every service is. The returned channel is closed the first
+// time the overall status becomes serving.
+func monitorHealth(ctx context.Context, hs *health.Server, checks []healthCheck) <-chan struct{} {
+	for _, hc := range checks {
+		hs.SetServingStatus(hc.service, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	ready := make(chan struct{})
+	go func() {
+		errs := make(map[string]string)
+		ticker := time.NewTicker(healthCheckInterval)
+		defer ticker.Stop()
+		for {
+			serving := true
+			for _, hc := range checks {
+				status := healthpb.HealthCheckResponse_SERVING
+				err := hc.check(ctx)
+				if err != nil {
+					status = healthpb.HealthCheckResponse_NOT_SERVING
+					serving = false
+				}
+
+				// Only log when the reason a service is unhealthy changes.
+				var errMsg string
+				if err != nil {
+					errMsg = err.Error()
+				}
+				if errs[hc.service] != errMsg {
+					if err != nil {
+						log.G(ctx).WithError(err).Warnf("Service %s is not serving", hc.service)
+					} else {
+						log.G(ctx).Infof("Service %s is serving", hc.service)
+					}
+					errs[hc.service] = errMsg
+				}
+				hs.SetServingStatus(hc.service, status)
+			}
+
+			if serving {
+				hs.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+				select {
+				case <-ready:
+				default:
+					close(ready)
+				}
+			} else {
+				hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return ready
+}
+
+func newHealthCheckCommand(loadConfig func(*cli.Context) (*config.Config, error)) *cli.Command {
+	return &cli.Command{
+		Name:  "healthcheck",
+		Usage: "check whether a running nix-snapshotter is serving",
+		Description: `Exits successfully when the nix-snapshotter at the configured address
+reports that it is serving, which makes it suitable for liveness and readiness
+probes.`,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "service",
+				Usage: "Check a single gRPC service instead of overall health",
+			},
+			instanceFlag,
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Value: 5 * time.Second,
+				Usage: "Time to wait for a response",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			cfg, err := loadInstanceConfig(c, loadConfig)
+			if err != nil {
+				return err
+			}
+
+			ctx, cancel := context.WithTimeout(c.Context, c.Duration("timeout"))
+			defer cancel()
+
+			conn, err := grpc.DialContext(ctx, "unix://"+cfg.Address,
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+			)
+			if err != nil {
+				return fmt.Errorf("failed to dial %q: %w", cfg.Address, err)
+			}
+			defer conn.Close()
+
+			resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{
+				Service: c.String("service"),
+			})
+			if err != nil {
+				return err
+			}
+
+			if resp.Status != healthpb.HealthCheckResponse_SERVING {
+				return fmt.Errorf("status is %s", resp.Status)
+			}
+			fmt.Println(resp.Status)
+			return nil
+		},
+	}
+}
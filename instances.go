@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+
+	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
+	"github.com/containerd/containerd/contrib/snapshotservice"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/pdtpartners/nix-snapshotter/pkg/admin"
+	"github.com/pdtpartners/nix-snapshotter/pkg/config"
+	"github.com/pdtpartners/nix-snapshotter/pkg/nix"
+	"github.com/pdtpartners/nix-snapshotter/pkg/socket"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// snapshotterServer serves a snapshotter, along with the admin and health
+// services, on its own socket.
+type snapshotterServer struct {
+	// name is the name of the instance, or empty for the daemon's snapshotter.
+	name string
+	cfg  *config.Config
+	sn   snapshots.Snapshotter
+	rpc  *grpc.Server
+	hs   *health.Server
+}
+
+func newSnapshotterServer(ctx context.Context, name string, cfg *config.Config, tracker *inflightTracker, opts []nix.SnapshotterOpt) (*snapshotterServer, error) {
+	if name != "" {
+		log.G(ctx).WithField("instance", name).WithField("root", cfg.Root).Info("Starting snapshotter instance")
+	}
+	sn, err := nix.NewSnapshotter(cfg.Root, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	rpc := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(tracker.unaryInterceptor),
+		grpc.ChainStreamInterceptor(tracker.streamInterceptor),
+	)
+	snapshotsapi.RegisterSnapshotsServer(rpc, snapshotservice.FromSnapshotter(sn))
+	admin.RegisterAdminServer(rpc, admin.NewServer(sn))
+
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(rpc, hs)
+
+	return &snapshotterServer{
+		name: name,
+		cfg:  cfg,
+		sn:   sn,
+		rpc:  rpc,
+		hs:   hs,
+	}, nil
+}
+
+// debugName is the name the snapshotter's debug state is dumped under.
+func (s *snapshotterServer) debugName() string {
+	if s.name == "" {
+		return snapshotsapi.Snapshots_ServiceDesc.ServiceName
+	}
+	return snapshotsapi.Snapshots_ServiceDesc.ServiceName + "/" + s.name
+}
+
+// serve listens on the snapshotter's address and serves in the background
+// until the server is stopped. Errors serving are sent to errCh.
+func (s *snapshotterServer) serve(ctx context.Context, errCh chan<- error) error {
+	address := s.cfg.Address
+
+	// When socket activated, systemd owns the socket so containerd can connect
+	// to it before nix-snapshotter is ready.
+	l, err := socket.ActivationListener(address)
+	if err != nil {
+		return err
+	}
+	if l != nil {
+		log.G(ctx).WithField("address", address).Info("Using socket activation listener")
+	} else {
+		l, err = socket.Listen(address, s.cfg.Socket)
+		if err != nil {
+			return err
+		}
+	}
+
+	go func(l net.Listener) {
+		if err := s.rpc.Serve(l); err != nil {
+			errCh <- fmt.Errorf("error on serving via socket %q: %w", address, err)
+		}
+	}(l)
+
+	log.G(ctx).WithField("address", address).Info("Serving...")
+	return nil
+}
+
+// close closes the snapshotter. It closes the metadata store, so it must only
+// happen once in-flight calls have returned.
+func (s *snapshotterServer) close(ctx context.Context) {
+	if err := s.sn.Close(); err != nil {
+		log.G(ctx).WithError(err).WithField("instance", s.name).Warn("Failed to close snapshotter")
+	}
+}
+
+// instanceNames returns the names of the snapshotter instances of cfg in a
+// stable order.
+func instanceNames(cfg *config.Config) []string {
+	var names []string
+	for name := range cfg.Instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// instanceFlag selects the snapshotter instance commands connect to.
+var instanceFlag = &cli.StringFlag{
+	Name:  "instance",
+	Usage: "Connect to the named snapshotter instance instead of the daemon's snapshotter",
+}
+
+// loadInstanceConfig loads the config with loadConfig, and returns the config
+// of the instance selected by instanceFlag if any.
+func loadInstanceConfig(c *cli.Context, loadConfig func(*cli.Context) (*config.Config, error)) (*config.Config, error) {
+	cfg, err := loadConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	if name := c.String(instanceFlag.Name); name != "" {
+		return cfg.Instance(name)
+	}
+	return cfg, nil
+}
+
+// allReady returns a channel that is closed once every channel in ready is,
+// unless ctx is done first.
+func allReady(ctx context.Context, ready []<-chan struct{}) <-chan struct{} {
+	all := make(chan struct{})
+	go func() {
+		for _, ch := range ready {
+			select {
+			case <-ch:
+			case <-ctx.Done():
+				return
+			}
+		}
+		close(all)
+	}()
+	return all
+}
@@ -3,13 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
-	"net"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"time"
 
 	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
-	"github.com/containerd/containerd/contrib/snapshotservice"
 	"github.com/containerd/containerd/log"
 	"github.com/coreos/go-systemd/v22/daemon"
 	"github.com/pdtpartners/nix-snapshotter/pkg/config"
@@ -52,10 +50,11 @@ overlayfs root along with bind mounts for every nix store path required.`
 	flagCfg := &config.Config{}
 	app.Flags = []cli.Flag{
 		&cli.StringFlag{
-			Name:    "log-level",
-			Aliases: []string{"l"},
-			Value:   defaultLogLevel.String(),
-			Usage:   "Set the logging level [trace, debug, info, warn, error, fatal, panic]",
+			Name:        "log-level",
+			Aliases:     []string{"l"},
+			DefaultText: defaultLogLevel.String(),
+			Usage:       "Set the logging level [trace, debug, info, warn, error, fatal, panic]",
+			Destination: &flagCfg.LogLevel,
 		},
 		&cli.StringFlag{
 			Name:    "config",
@@ -76,110 +75,244 @@ overlayfs root along with bind mounts for every nix store path required.`
 		},
 	}
 
-	app.Action = func(c *cli.Context) error {
-		lvl, err := logrus.ParseLevel(c.String("log-level"))
-		if err != nil {
-			return err
+	app.Before = func(c *cli.Context) error {
+		// The daemon applies the log level from its config once loaded.
+		lvl := defaultLogLevel
+		if flagCfg.LogLevel != "" {
+			var err error
+			lvl, err = logrus.ParseLevel(flagCfg.LogLevel)
+			if err != nil {
+				return err
+			}
 		}
 		logrus.SetLevel(lvl)
 		logrus.SetFormatter(&logrus.TextFormatter{
 			FullTimestamp:   true,
 			TimestampFormat: log.RFC3339NanoFixed,
 		})
-		ctx := log.WithLogger(context.Background(), log.L)
+		c.Context = log.WithLogger(context.Background(), log.L)
+		return nil
+	}
 
+	loadConfig := func(c *cli.Context) (*config.Config, error) {
 		// Override defaults with configuration file settings.
 		cfg := config.New()
-		err = cfg.Load(ctx, c.String("config"))
+		err := cfg.Load(c.Context, c.String("config"))
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// Override config with flag settings.
 		err = cfg.Merge(flagCfg)
+		if err != nil {
+			return nil, err
+		}
+		return cfg, cfg.Validate()
+	}
+
+	app.Action = func(c *cli.Context) error {
+		cfg, err := loadConfig(c)
 		if err != nil {
 			return err
 		}
+		return serve(c.Context, cfg, func() (*config.Config, error) {
+			return loadConfig(c)
+		})
+	}
 
-		return serve(ctx, cfg)
+	app.Commands = []*cli.Command{
+		newCtlCommand(loadConfig),
+		newHealthCheckCommand(loadConfig),
+		newDoctorCommand(loadConfig),
+		newContainerdConfigCommand(loadConfig),
+		newGCCommand(loadConfig),
 	}
 
 	return app
 }
 
-func serve(ctx context.Context, cfg *config.Config) error {
+func serve(ctx context.Context, cfg *config.Config, loadConfig func() (*config.Config, error)) error {
+	lvl, err := logrus.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(lvl)
 	log.G(ctx).WithField("root", cfg.Root).Info("Starting the nix-snapshotter")
-
-	// Prepare the directory for the socket
-	err := os.MkdirAll(filepath.Dir(cfg.Address), 0700)
+	live, err := newLiveConfig(cfg)
 	if err != nil {
-		return fmt.Errorf("failed to create directory %q: %w", filepath.Dir(cfg.Address), err)
+		return err
 	}
 
-	// Try to remove the socket file to avoid EADDRINUSE
-	err = os.RemoveAll(cfg.Address)
+	var imageServiceOpts []nix.ImageServiceOpt
+	var sharedOpts []nix.SnapshotterOpt
+	if cfg.Events.Enable {
+		// The publisher is closed after the snapshotters, which may publish
+		// events while closing.
+		publisherCtx, cancelPublisher := context.WithCancel(ctx)
+		defer cancelPublisher()
+		opt := nix.WithEventPublisher(nix.NewContainerdPublisher(publisherCtx, cfg.Events.ContainerdAddress))
+		imageServiceOpts = append(imageServiceOpts, opt)
+		sharedOpts = append(sharedOpts, opt)
+	}
+	// Every snapshotter delegates to its live builders, so that builder
+	// settings are reloaded, and builds of a nix store path are serialized
+	// across the snapshotters sharing a nix store.
+	serializers := make(map[[2]string]*nix.BuildSerializer)
+	nixBuilder := func(name string, cfg *config.Config) nix.NixBuilder {
+		store := [2]string{cfg.Snapshotter.StoreRoot, cfg.Snapshotter.StoreDir}
+		serializer, ok := serializers[store]
+		if !ok {
+			serializer = &nix.BuildSerializer{}
+			serializers[store] = serializer
+		}
+		return serializer.Serialize(live.nixBuilder(name))
+	}
+	snapshotterOpts := func(name string, cfg *config.Config) []nix.SnapshotterOpt {
+		opts := append(nix.SnapshotterOptsFromConfig(cfg),
+			nix.WithNixBuilder(nixBuilder(name, cfg)),
+			nix.WithNixDatabaseBuilder(live.nixDatabaseBuilder(name)),
+			nix.WithNixVerifier(live.nixVerifier(name)),
+		)
+		return append(opts, sharedOpts...)
+	}
+
+	tracker := &inflightTracker{}
+	primary, err := newSnapshotterServer(ctx, "", cfg, tracker, snapshotterOpts("", cfg))
 	if err != nil {
-		return fmt.Errorf("failed to remove %q: %w", cfg.Address, err)
+		return err
 	}
+	defer primary.close(ctx)
 
-	rpc := grpc.NewServer()
-	if cfg.ImageService.Enable {
-		imageService, err := nix.NewImageService(ctx, cfg.ImageService.ContainerdAddress)
+	servers := []*snapshotterServer{primary}
+	for _, name := range instanceNames(cfg) {
+		instanceCfg, err := cfg.Instance(name)
 		if err != nil {
 			return err
 		}
-		runtime.RegisterImageServiceServer(rpc, imageService)
+		srv, err := newSnapshotterServer(ctx, name, instanceCfg, tracker, snapshotterOpts(name, instanceCfg))
+		if err != nil {
+			return fmt.Errorf("failed to start instance %q: %w", name, err)
+		}
+		defer srv.close(ctx)
+		servers = append(servers, srv)
 	}
 
-	var snapshotterOpts []nix.SnapshotterOpt
-	if cfg.ExternalBuilder != "" {
-		snapshotterOpts = append(snapshotterOpts, nix.WithNixBuilder(nix.NewExternalBuilder(cfg.ExternalBuilder)))
+	builderCheck := healthCheck{
+		service: snapshotsapi.Snapshots_ServiceDesc.ServiceName,
+		check: func(ctx context.Context) error {
+			return nix.CheckBuilder(live.config().ExternalBuilder)
+		},
 	}
-
-	sn, err := nix.NewSnapshotter(cfg.Root, snapshotterOpts...)
-	if err != nil {
-		return err
+	checks := map[*snapshotterServer][]healthCheck{}
+	debuggers := make(map[string]nix.Debugger)
+	for _, srv := range servers {
+		checks[srv] = []healthCheck{builderCheck}
+		if reloader, ok := srv.sn.(nix.PolicyReloader); ok {
+			live.addPolicyReloader(srv.name, reloader)
+		}
+		if debugger, ok := srv.sn.(nix.Debugger); ok {
+			debuggers[srv.debugName()] = debugger
+		}
 	}
 
-	service := snapshotservice.FromSnapshotter(sn)
-	snapshotsapi.RegisterSnapshotsServer(rpc, service)
+	if cfg.ImageService.Enable {
+		// Images are pulled into the nix store of the daemon's own snapshotter.
+		imageServiceOpts = append(imageServiceOpts, nix.ImageServiceOptsFromConfig(cfg)...)
+		imageServiceOpts = append(imageServiceOpts, nix.WithNixBuilder(nixBuilder("", cfg)))
+		imageService, err := nix.NewImageService(ctx, cfg.ImageService.ContainerdAddress, imageServiceOpts...)
+		if err != nil {
+			return err
+		}
+		runtime.RegisterImageServiceServer(primary.rpc, imageService)
+		if debugger, ok := imageService.(nix.Debugger); ok {
+			debuggers[imageServiceName] = debugger
+		}
+		if checker, ok := imageService.(nix.Checker); ok {
+			checks[primary] = append(checks[primary], healthCheck{
+				service: imageServiceName,
+				check:   checker.Check,
+			})
+		}
+	}
 
-	l, err := net.Listen("unix", cfg.Address)
-	if err != nil {
-		return err
+	if cfg.Debug.Address != "" {
+		debugServer, err := serveDebug(ctx, cfg.Debug.Address)
+		if err != nil {
+			return err
+		}
+		defer debugServer.Close()
 	}
 
-	errCh := make(chan error, 1)
-	go func() {
-		if err := rpc.Serve(l); err != nil {
-			errCh <- fmt.Errorf("error on serving via socket %q: %w", cfg.Address, err)
+	errCh := make(chan error, len(servers))
+	for _, srv := range servers {
+		err = srv.serve(ctx, errCh)
+		if err != nil {
+			return err
 		}
-	}()
+	}
 
-	log.G(ctx).WithField("address", cfg.Address).Info("Serving...")
+	monitorCtx, cancelMonitor := context.WithCancel(ctx)
+	defer cancelMonitor()
+	var readies []<-chan struct{}
+	for _, srv := range servers {
+		readies = append(readies, monitorHealth(monitorCtx, srv.hs, checks[srv]))
+	}
+	ready := allReady(monitorCtx, readies)
 
 	// If NOTIFY_SOCKET is set, nix-snapshotter is run as a systemd service.
-	// Notify systemd that the service is ready.
-	if os.Getenv("NOTIFY_SOCKET") != "" {
-		notified, notifyErr := daemon.SdNotify(false, daemon.SdNotifyReady)
-		log.G(ctx).Debugf("SdNotifyReady notified=%v, err=%v", notified, notifyErr)
-		defer func() {
+	// Systemd is notified once every service is healthy.
+	notify := os.Getenv("NOTIFY_SOCKET") != ""
+	notifyStopping := func() {
+		if notify {
 			notified, notifyErr := daemon.SdNotify(false, daemon.SdNotifyStopping)
 			log.G(ctx).Debugf("SdNotifyStopping notified=%v, err=%v", notified, notifyErr)
-		}()
+		}
 	}
 
 	var s os.Signal
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, unix.SIGINT, unix.SIGTERM)
-	select {
-	case s = <-sigCh:
-		log.G(ctx).Infof("Got %v", s)
-	case err := <-errCh:
-		return err
+	signal.Notify(sigCh, unix.SIGINT, unix.SIGTERM, unix.SIGHUP, unix.SIGUSR1)
+	for {
+		select {
+		case <-ready:
+			// Stop selecting on ready, as a closed channel is always ready.
+			ready = nil
+			log.G(ctx).Info("Ready")
+			if notify {
+				notified, notifyErr := daemon.SdNotify(false, daemon.SdNotifyReady)
+				log.G(ctx).Debugf("SdNotifyReady notified=%v, err=%v", notified, notifyErr)
+			}
+		case s = <-sigCh:
+			log.G(ctx).Infof("Got %v", s)
+			if s == unix.SIGHUP {
+				reloaded, err := loadConfig()
+				if err == nil {
+					err = live.reload(ctx, reloaded)
+				}
+				if err != nil {
+					log.G(ctx).WithError(err).Error("Failed to reload config, keeping the current config")
+				}
+				continue
+			} else if s == unix.SIGUSR1 {
+				err := dumpDebugState(ctx, cfg.Root, debuggers)
+				if err != nil {
+					log.G(ctx).WithError(err).Error("Failed to dump debug state")
+				}
+				continue
+			}
+
+			notifyStopping()
+			cancelMonitor()
+			var rpcs []*grpc.Server
+			for _, srv := range servers {
+				srv.hs.Shutdown()
+				rpcs = append(rpcs, srv.rpc)
+			}
+			gracefulStop(ctx, rpcs, tracker, time.Duration(live.config().ShutdownTimeout))
+			return nil
+		case err := <-errCh:
+			notifyStopping()
+			return err
+		}
 	}
-	// if s == unix.SIGINT {
-	// 	return nil
-	// }
-	return nil
 }
@@ -73,6 +73,7 @@ let
       KillMode = "mixed";
       Restart = "always";
       RestartSec = "2";
+      ExecReload = "${pkgs.coreutils}/bin/kill -HUP $MAINPID";
 
       StateDirectory = "nix-snapshotter";
       RuntimeDirectory = "nix-snapshotter";
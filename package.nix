@@ -47,6 +47,14 @@ let
     # root. The store path prefix /nix/store/hash-path is removed. The
     # store path content is then located at the image /.
     copyToRoot ? null,
+    # An attribute set mapping paths in the container to store paths, or paths
+    # under them, that are mounted read-only there. For example:
+    # { "/etc/ssl" = "${cacert}/etc/ssl"; }
+    mountTargets ? {},
+    # If enabled, containers get a nix database with the image's closure
+    # registered, so that nix can be used inside them. New nix store paths are
+    # written to the container's rootfs.
+    writableStore ? false,
     # An attribute set describing an image configuration as defined in:
     # https://github.com/opencontainers/image-spec/blob/8b9d41f48198a7d6d0a5c1a12dc2d1f7f47fc97f/specs-go/v1/config.go#L23
     config ? {},
@@ -58,8 +66,15 @@ let
 
       copyToRootList = lib.toList (args.copyToRoot or []);
 
+      # References the store paths of the mount targets, so that they are
+      # included in the closure.
+      mountTargetsFile =
+        writeText
+          "mount-targets-${baseName}.json"
+          (builtins.toJSON mountTargets);
+
       runtimeClosureInfo = closureInfo {
-        rootPaths = [ configFile ] ++ copyToRootList;
+        rootPaths = [ configFile mountTargetsFile ] ++ copyToRootList;
       };
 
       copyToRootFile =
@@ -69,6 +84,8 @@ let
 
       fromImageFlag = lib.optionalString (fromImage != null) ''--from-image "${fromImage}"'';
 
+      writableStoreFlag = lib.optionalString writableStore "--writable-store";
+
       image =
         let
           imageName = lib.toLower name;
@@ -90,8 +107,10 @@ let
             --config "${configFile}" \
             --closure "${runtimeClosureInfo}/store-paths" \
             --copy-to-root "${copyToRootFile}" \
+            --mount-targets "${mountTargetsFile}" \
             ${refFlag} \
             ${fromImageFlag} \
+            ${writableStoreFlag} \
             $out
         '';
 
@@ -0,0 +1,216 @@
+// Package admin provides a gRPC service for inspecting the state of a running
+// nix-snapshotter.
+//
+// Messages are plain Go structs encoded as JSON, so the service is described
+// by hand instead of being generated from protobuf definitions. Clients
+// created by NewAdminClient select the JSON codec automatically.
+package admin
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// ServiceName is the fully qualified name of the admin gRPC service.
+const ServiceName = "nix_snapshotter.admin.v1.Admin"
+
+// ListSnapshotsRequest is the request for AdminServer.ListSnapshots.
+type ListSnapshotsRequest struct{}
+
+// ListSnapshotsResponse is the response for AdminServer.ListSnapshots.
+type ListSnapshotsResponse struct {
+	Snapshots []Snapshot `json:"snapshots"`
+}
+
+// Snapshot describes a snapshot along with its nix specific state.
+type Snapshot struct {
+	Key           string            `json:"key"`
+	ID            string            `json:"id"`
+	Namespace     string            `json:"namespace,omitempty"`
+	Kind          string            `json:"kind"`
+	Parents       []string          `json:"parents,omitempty"`
+	NixStorePaths []string          `json:"nix_store_paths,omitempty"`
+	GCRootsDir    string            `json:"gc_roots_dir,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Created       time.Time         `json:"created"`
+	Updated       time.Time         `json:"updated"`
+	Usage         Usage             `json:"usage"`
+}
+
+// Usage is the resources used by a snapshot.
+type Usage struct {
+	Inodes int64 `json:"inodes"`
+	Size   int64 `json:"size"`
+}
+
+// NamespaceUsageRequest is the request for AdminServer.NamespaceUsage.
+type NamespaceUsageRequest struct{}
+
+// NamespaceUsageResponse is the response for AdminServer.NamespaceUsage.
+type NamespaceUsageResponse struct {
+	Namespaces []NamespaceUsage `json:"namespaces"`
+}
+
+// NamespaceUsage is the resources used by the snapshots of a containerd
+// namespace.
+type NamespaceUsage struct {
+	Namespace     string `json:"namespace"`
+	Snapshots     int    `json:"snapshots"`
+	NixStorePaths int    `json:"nix_store_paths"`
+	Usage         Usage  `json:"usage"`
+}
+
+// MountsRequest is the request for AdminServer.Mounts.
+type MountsRequest struct {
+	Key string `json:"key"`
+}
+
+// MountsResponse is the response for AdminServer.Mounts.
+type MountsResponse struct {
+	Mounts []Mount `json:"mounts"`
+}
+
+// Mount is a mount returned by the snapshotter.
+type Mount struct {
+	Type    string   `json:"type"`
+	Source  string   `json:"source"`
+	Target  string   `json:"target,omitempty"`
+	Options []string `json:"options,omitempty"`
+}
+
+// AdminServer is the server API for the admin service.
+type AdminServer interface {
+	// ListSnapshots returns every snapshot with its nix specific state.
+	ListSnapshots(context.Context, *ListSnapshotsRequest) (*ListSnapshotsResponse, error)
+
+	// NamespaceUsage returns the resources used by the snapshots of each
+	// containerd namespace.
+	NamespaceUsage(context.Context, *NamespaceUsageRequest) (*NamespaceUsageResponse, error)
+
+	// Mounts returns the mounts the snapshotter returns for a key, without
+	// preparing the snapshot to be mounted.
+	Mounts(context.Context, *MountsRequest) (*MountsResponse, error)
+}
+
+// RegisterAdminServer registers srv on s.
+func RegisterAdminServer(s *grpc.Server, srv AdminServer) {
+	s.RegisterService(&serviceDesc, srv)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListSnapshots",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(ListSnapshotsRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(AdminServer).ListSnapshots(ctx, req.(*ListSnapshotsRequest))
+				}
+				if interceptor == nil {
+					return handler(ctx, req)
+				}
+				info := &grpc.UnaryServerInfo{
+					Server:     srv,
+					FullMethod: "/" + ServiceName + "/ListSnapshots",
+				}
+				return interceptor(ctx, req, info, handler)
+			},
+		},
+		{
+			MethodName: "NamespaceUsage",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(NamespaceUsageRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(AdminServer).NamespaceUsage(ctx, req.(*NamespaceUsageRequest))
+				}
+				if interceptor == nil {
+					return handler(ctx, req)
+				}
+				info := &grpc.UnaryServerInfo{
+					Server:     srv,
+					FullMethod: "/" + ServiceName + "/NamespaceUsage",
+				}
+				return interceptor(ctx, req, info, handler)
+			},
+		},
+		{
+			MethodName: "Mounts",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(MountsRequest)
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(AdminServer).Mounts(ctx, req.(*MountsRequest))
+				}
+				if interceptor == nil {
+					return handler(ctx, req)
+				}
+				info := &grpc.UnaryServerInfo{
+					Server:     srv,
+					FullMethod: "/" + ServiceName + "/Mounts",
+				}
+				return interceptor(ctx, req, info, handler)
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+// AdminClient is the client API for the admin service.
+type AdminClient interface {
+	ListSnapshots(ctx context.Context, req *ListSnapshotsRequest, opts ...grpc.CallOption) (*ListSnapshotsResponse, error)
+	NamespaceUsage(ctx context.Context, req *NamespaceUsageRequest, opts ...grpc.CallOption) (*NamespaceUsageResponse, error)
+	Mounts(ctx context.Context, req *MountsRequest, opts ...grpc.CallOption) (*MountsResponse, error)
+}
+
+type adminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewAdminClient returns an AdminClient using the connection cc.
+func NewAdminClient(cc grpc.ClientConnInterface) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) ListSnapshots(ctx context.Context, req *ListSnapshotsRequest, opts ...grpc.CallOption) (*ListSnapshotsResponse, error) {
+	resp := new(ListSnapshotsResponse)
+	err := c.invoke(ctx, "ListSnapshots", req, resp, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *adminClient) NamespaceUsage(ctx context.Context, req *NamespaceUsageRequest, opts ...grpc.CallOption) (*NamespaceUsageResponse, error) {
+	resp := new(NamespaceUsageResponse)
+	err := c.invoke(ctx, "NamespaceUsage", req, resp, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *adminClient) Mounts(ctx context.Context, req *MountsRequest, opts ...grpc.CallOption) (*MountsResponse, error) {
+	resp := new(MountsResponse)
+	err := c.invoke(ctx, "Mounts", req, resp, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *adminClient) invoke(ctx context.Context, method string, req, resp interface{}, opts ...grpc.CallOption) error {
+	opts = append([]grpc.CallOption{grpc.CallContentSubtype(codecName)}, opts...)
+	return c.cc.Invoke(ctx, "/"+ServiceName+"/"+method, req, resp, opts...)
+}
@@ -0,0 +1,95 @@
+package admin
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/pdtpartners/nix-snapshotter/pkg/nix"
+	"github.com/pdtpartners/nix-snapshotter/pkg/nix2container"
+	"github.com/pdtpartners/nix-snapshotter/pkg/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestAdminService(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+
+	testBuilder := func(ctx context.Context, outLink, nixStorePath string) error {
+		return nil
+	}
+	sn, err := nix.NewSnapshotter(root, nix.WithNixBuilder(testBuilder))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	nixStorePath := "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12.1"
+	labels := map[string]string{
+		nix2container.NixStorePrefixAnnotation + "0": nixStorePath,
+	}
+	_, err = sn.Prepare(ctx, "parent-active", "", snapshots.WithLabels(labels))
+	require.NoError(t, err)
+	err = sn.Commit(ctx, "parent", "parent-active", snapshots.WithLabels(labels))
+	require.NoError(t, err)
+	_, err = sn.Prepare(ctx, "child", "parent")
+	require.NoError(t, err)
+
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	rpc := grpc.NewServer()
+	RegisterAdminServer(rpc, NewServer(sn))
+	go func() {
+		_ = rpc.Serve(l)
+	}()
+	defer rpc.Stop()
+
+	conn, err := grpc.DialContext(ctx, "unix://"+socket,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := NewAdminClient(conn)
+
+	listResp, err := client.ListSnapshots(ctx, &ListSnapshotsRequest{})
+	require.NoError(t, err)
+
+	snapshotsByKey := make(map[string]Snapshot)
+	for _, sn := range listResp.Snapshots {
+		snapshotsByKey[sn.Key] = sn
+	}
+	require.Len(t, snapshotsByKey, 2)
+	require.Equal(t, "Committed", snapshotsByKey["parent"].Kind)
+	require.Equal(t, "Active", snapshotsByKey["child"].Kind)
+	testutil.IsIdentical(t, snapshotsByKey["child"].Parents, []string{"parent"})
+	testutil.IsIdentical(t, snapshotsByKey["child"].NixStorePaths, []string{nixStorePath})
+
+	usageResp, err := client.NamespaceUsage(ctx, &NamespaceUsageRequest{})
+	require.NoError(t, err)
+	require.Len(t, usageResp.Namespaces, 1)
+	require.Equal(t, "", usageResp.Namespaces[0].Namespace)
+	require.Equal(t, 2, usageResp.Namespaces[0].Snapshots)
+	require.Equal(t, 1, usageResp.Namespaces[0].NixStorePaths)
+
+	mountsResp, err := client.Mounts(ctx, &MountsRequest{Key: "child"})
+	require.NoError(t, err)
+
+	mounts, err := sn.Mounts(ctx, "child")
+	require.NoError(t, err)
+
+	var actual []mount.Mount
+	for _, m := range mountsResp.Mounts {
+		actual = append(actual, mount.Mount{
+			Type:    m.Type,
+			Source:  m.Source,
+			Target:  m.Target,
+			Options: m.Options,
+		})
+	}
+	testutil.IsIdentical(t, actual, mounts)
+}
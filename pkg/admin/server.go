@@ -0,0 +1,101 @@
+package admin
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/pdtpartners/nix-snapshotter/pkg/nix"
+)
+
+type server struct {
+	sn snapshots.Snapshotter
+}
+
+// NewServer returns an AdminServer inspecting sn, which requires sn to
+// implement nix.Inspector.
+func NewServer(sn snapshots.Snapshotter) AdminServer {
+	return &server{sn: sn}
+}
+
+func (s *server) ListSnapshots(ctx context.Context, req *ListSnapshotsRequest) (*ListSnapshotsResponse, error) {
+	inspector, ok := s.sn.(nix.Inspector)
+	if !ok {
+		return nil, errdefs.ToGRPCf(errdefs.ErrNotImplemented, "snapshotter cannot be inspected")
+	}
+
+	details, err := inspector.InspectSnapshots(ctx)
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+
+	resp := &ListSnapshotsResponse{}
+	for _, detail := range details {
+		resp.Snapshots = append(resp.Snapshots, Snapshot{
+			Key:           detail.Name,
+			ID:            detail.ID,
+			Namespace:     detail.Namespace,
+			Kind:          detail.Kind.String(),
+			Parents:       detail.Parents,
+			NixStorePaths: detail.NixStorePaths,
+			GCRootsDir:    detail.GCRootsDir,
+			Labels:        detail.Labels,
+			Created:       detail.Created,
+			Updated:       detail.Updated,
+			Usage: Usage{
+				Inodes: detail.Usage.Inodes,
+				Size:   detail.Usage.Size,
+			},
+		})
+	}
+	return resp, nil
+}
+
+func (s *server) NamespaceUsage(ctx context.Context, req *NamespaceUsageRequest) (*NamespaceUsageResponse, error) {
+	inspector, ok := s.sn.(nix.Inspector)
+	if !ok {
+		return nil, errdefs.ToGRPCf(errdefs.ErrNotImplemented, "snapshotter cannot be inspected")
+	}
+
+	details, err := inspector.InspectSnapshots(ctx)
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+
+	resp := &NamespaceUsageResponse{}
+	for _, usage := range nix.NamespaceUsages(details) {
+		resp.Namespaces = append(resp.Namespaces, NamespaceUsage{
+			Namespace:     usage.Namespace,
+			Snapshots:     usage.Snapshots,
+			NixStorePaths: usage.NixStorePaths,
+			Usage: Usage{
+				Inodes: usage.Usage.Inodes,
+				Size:   usage.Usage.Size,
+			},
+		})
+	}
+	return resp, nil
+}
+
+func (s *server) Mounts(ctx context.Context, req *MountsRequest) (*MountsResponse, error) {
+	inspector, ok := s.sn.(nix.Inspector)
+	if !ok {
+		return nil, errdefs.ToGRPCf(errdefs.ErrNotImplemented, "snapshotter cannot be inspected")
+	}
+
+	mounts, err := inspector.InspectMounts(ctx, req.Key)
+	if err != nil {
+		return nil, errdefs.ToGRPC(err)
+	}
+
+	resp := &MountsResponse{}
+	for _, m := range mounts {
+		resp.Mounts = append(resp.Mounts, Mount{
+			Type:    m.Type,
+			Source:  m.Source,
+			Target:  m.Target,
+			Options: m.Options,
+		})
+	}
+	return resp, nil
+}
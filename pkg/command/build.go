@@ -29,6 +29,14 @@ var buildCommand = &cli.Command{
 			Name:  "copy-to-root",
 			Usage: "Path to a JSON describing copy to root config",
 		},
+		&cli.StringFlag{
+			Name:  "mount-targets",
+			Usage: "Path to a JSON mapping mount targets to nix store paths",
+		},
+		&cli.BoolFlag{
+			Name:  "writable-store",
+			Usage: "Register the closure in a nix database in containers so that nix can be used inside them",
+		},
 		&cli.StringFlag{
 			Name:  "ref",
 			Usage: "Specify an alternate image name.",
@@ -49,6 +57,12 @@ var buildCommand = &cli.Command{
 		if c.IsSet("from-image") {
 			opts = append(opts, nix2container.WithFromImage(c.String("from-image")))
 		}
+		if c.IsSet("mount-targets") {
+			opts = append(opts, nix2container.WithMountTargets(c.String("mount-targets")))
+		}
+		if c.Bool("writable-store") {
+			opts = append(opts, nix2container.WithWritableStore())
+		}
 
 		ctx := c.Context
 		img, err := nix2container.Build(ctx,
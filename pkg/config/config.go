@@ -5,24 +5,243 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"dario.cat/mergo"
+	"github.com/containerd/containerd/identifiers"
 	"github.com/containerd/containerd/log"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pelletier/go-toml/v2"
+	"github.com/sirupsen/logrus"
 )
 
 var (
+	defaultLogLevel          = "info"
 	defaultAddress           = "/run/nix-snapshotter/nix-snapshotter.sock"
 	defaultRoot              = "/var/lib/containerd/io.containerd.snapshotter.v1.nix"
 	defaultContainerdAddress = "/run/containerd/containerd.sock"
+	defaultShutdownTimeout   = Duration(30 * time.Second)
+	defaultMountBackend      = "auto"
+	defaultUnderlying        = "overlay"
+
+	mountBackends = []string{"auto", "overlayfs", "rootless-overlayfs", "fuse-overlayfs"}
+	underlyings   = []string{"overlay", "native"}
+
+	// bindMountOptions are the options that may be added to bind mounts of nix
+	// store paths. They can only restrict what containers can do.
+	bindMountOptions = []string{"nosuid", "nodev", "noexec", "noatime", "nodiratime", "relatime"}
+	propagations     = []string{"private", "rprivate", "slave", "rslave", "shared", "rshared", "unbindable", "runbindable"}
 )
 
 // Config provides nix-snapshotter configuration data.
 type Config struct {
+	LogLevel        string             `toml:"log_level"`
 	Address         string             `toml:"address"`
 	Root            string             `toml:"root"`
 	ExternalBuilder string             `toml:"external_builder"`
+	ShutdownTimeout Duration           `toml:"shutdown_timeout"`
+	Socket          SocketConfig       `toml:"socket"`
+	Snapshotter     SnapshotterConfig  `toml:"snapshotter"`
 	ImageService    ImageServiceConfig `toml:"image_service"`
+	Events          EventsConfig       `toml:"events"`
+	Debug           DebugConfig        `toml:"debug"`
+
+	// Instances are additional snapshotters served by the same daemon, keyed
+	// by the name containerd knows them by, e.g. "nix-fuse".
+	Instances map[string]InstanceConfig `toml:"instances"`
+}
+
+// InstanceConfig configures an additional snapshotter served by the daemon.
+// Its nix builder is configured by the daemon's settings with the instance's
+// overrides, and coordinates substitutions with the other snapshotters using
+// the same nix store.
+type InstanceConfig struct {
+	// Root is the directory where the instance stores persistent data.
+	Root string `toml:"root"`
+
+	// Address is the unix socket the instance is served on.
+	Address string `toml:"address"`
+
+	// Snapshotter overrides the settings of the daemon's snapshotter that are
+	// set, e.g. mount_backend.
+	Snapshotter SnapshotterConfig `toml:"snapshotter"`
+}
+
+// SocketConfig configures the ownership of the unix sockets nix-snapshotter
+// creates. Sockets passed by systemd socket activation are left as is.
+type SocketConfig struct {
+	// Mode is the octal file mode of the socket, e.g. "0660".
+	Mode string `toml:"mode"`
+
+	// Group is the group name or ID owning the socket.
+	Group string `toml:"group"`
+}
+
+// FileMode returns the parsed Mode, or zero if it is not set.
+func (sc SocketConfig) FileMode() (os.FileMode, error) {
+	if sc.Mode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(sc.Mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid socket mode %q: %w", sc.Mode, err)
+	}
+	if mode&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("invalid socket mode %q: only permission bits are allowed", sc.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// SnapshotterConfig configures the nix snapshotter.
+type SnapshotterConfig struct {
+	// Underlying is the snapshotter that stores the snapshots nix store paths
+	// are mounted into, one of "overlay" or "native".
+	Underlying string `toml:"underlying"`
+
+	// MountBackend is the filesystem snapshots are mounted with, one of
+	// "auto", "overlayfs", "rootless-overlayfs" or "fuse-overlayfs". The
+	// default "auto" detects a working one at startup. It only applies to the
+	// overlay snapshotter.
+	MountBackend string `toml:"mount_backend"`
+
+	// StoreDir is the nix store directory, passed to the nix builder as
+	// NIX_STORE_DIR if set.
+	StoreDir string `toml:"store_dir"`
+
+	// StoreRoot is the root of a chroot store, e.g. "/data/nix" for a nix
+	// store at "/data/nix/nix/store" used by containers as "/nix/store". The
+	// nix builder is run against the store at StoreRoot if set.
+	StoreRoot string `toml:"store_root"`
+
+	// IDMappedMounts idmaps the mounts of snapshots for containers in a user
+	// namespace, which requires containerd 2.0 or later. Otherwise such
+	// snapshots are rejected, as containerd 1.7 fails to mount them. It isn't
+	// supported with the "fuse-overlayfs" mount backend.
+	IDMappedMounts bool `toml:"idmapped_mounts"`
+
+	Overlay    OverlayConfig    `toml:"overlay"`
+	Builder    BuilderConfig    `toml:"builder"`
+	BindMounts BindMountsConfig `toml:"bind_mounts"`
+	WarmPool   WarmPoolConfig   `toml:"warm_pool"`
+	Scrub      ScrubConfig      `toml:"scrub"`
+	Leases     LeasesConfig     `toml:"leases"`
+
+	// Namespaces override settings for snapshots prepared in the containerd
+	// namespace they are keyed by.
+	Namespaces map[string]NamespaceConfig `toml:"namespaces"`
+}
+
+// OverlayConfig configures the underlying overlay snapshotter.
+type OverlayConfig struct {
+	// AsyncRemove defers removing the contents of snapshots until containerd
+	// calls Cleanup.
+	AsyncRemove bool `toml:"async_remove"`
+
+	// UpperdirLabel labels snapshots with the location of their upperdir.
+	UpperdirLabel bool `toml:"upperdir_label"`
+
+	// MountOptions are added to the options of overlay mounts.
+	MountOptions []string `toml:"mount_options"`
+}
+
+// BuilderConfig configures the nix builder.
+type BuilderConfig struct {
+	// ExtraArgs are passed to nix-store, or to the external builder before
+	// its out-link and nix store path arguments.
+	ExtraArgs []string `toml:"extra_args"`
+
+	// Timeout limits how long a nix store path may take to be realised. Zero
+	// means no limit.
+	Timeout Duration `toml:"timeout"`
+}
+
+// BindMountsConfig configures the bind mounts of nix store paths into
+// containers, which are always read only.
+type BindMountsConfig struct {
+	// Options are added to every bind mount, e.g. "nosuid" and "nodev".
+	Options []string `toml:"options"`
+
+	// Propagation is the mount propagation of the bind mounts, e.g.
+	// "rprivate". The runtime's default is used if empty.
+	Propagation string `toml:"propagation"`
+
+	// NonRecursive bind mounts nix store paths without the mounts under them.
+	NonRecursive bool `toml:"non_recursive"`
+
+	// Rules add options to the bind mounts of matching nix store paths.
+	Rules []BindMountRule `toml:"rules"`
+}
+
+// BindMountRule adds options to the bind mounts of nix store paths matching
+// a pattern.
+type BindMountRule struct {
+	// Pattern is matched against nix store paths as by filepath.Match, e.g.
+	// "/nix/store/*-glibc-*".
+	Pattern string `toml:"pattern"`
+
+	Options []string `toml:"options"`
+}
+
+// WarmPoolConfig configures a pool of active snapshots that are prepared ahead
+// of time for hot images. It is only supported with the overlay snapshotter.
+type WarmPoolConfig struct {
+	// Size is the number of active snapshots kept ready per image. Zero
+	// disables the pool.
+	Size int `toml:"size"`
+
+	// ChainIDs are the chain IDs of the top layer of each hot image.
+	ChainIDs []string `toml:"chain_ids"`
+
+	// IdleTimeout evicts the pooled snapshots of an image that hasn't been
+	// used for this long. Zero means never.
+	IdleTimeout Duration `toml:"idle_timeout"`
+}
+
+// ScrubConfig configures a background scrubber that periodically verifies the
+// nix store paths used by snapshots against their hashes in the nix database.
+type ScrubConfig struct {
+	// Interval is the time between scrubs. Zero disables the scrubber.
+	Interval Duration `toml:"interval"`
+
+	// Repair substitutes corrupted nix store paths again.
+	Repair bool `toml:"repair"`
+}
+
+// LeasesConfig configures attaching the nix gc roots of nix layers to the
+// containerd lease they are prepared under, e.g. that of a pull.
+type LeasesConfig struct {
+	// ReleaseInterval is the time between checks of the leases with gc roots
+	// attached. The gc roots of snapshots that weren't committed before their
+	// lease expired are released, using image_service.containerd_address to
+	// look up leases. Zero disables attaching gc roots to leases.
+	ReleaseInterval Duration `toml:"release_interval"`
+}
+
+// NamespaceConfig overrides settings for snapshots prepared in a containerd
+// namespace.
+type NamespaceConfig struct {
+	// Substituters replace the binary caches nix store paths are substituted
+	// from, passed to the builder, including external_builder, as the
+	// substituters setting of NIX_CONFIG. Unless the nix daemon trusts
+	// nix-snapshotter, they must also be listed in its trusted-substituters.
+	Substituters []string `toml:"substituters"`
+
+	// TrustedPublicKeys replace the keys nix store paths substituted from
+	// binary caches must be signed by, passed to the builder as the
+	// trusted-public-keys setting of NIX_CONFIG.
+	TrustedPublicKeys []string `toml:"trusted_public_keys"`
+
+	// BindMounts replaces snapshotter.bind_mounts if set.
+	BindMounts *BindMountsConfig `toml:"bind_mounts"`
+
+	// MaxClosureSize limits the size in bytes of the nix store paths a
+	// snapshot bind mounts, including those of its parents. Zero means no
+	// limit.
+	MaxClosureSize int64 `toml:"max_closure_size"`
 }
 
 type ImageServiceConfig struct {
@@ -30,16 +249,83 @@ type ImageServiceConfig struct {
 	ContainerdAddress string `toml:"containerd_address"`
 }
 
+// EventsConfig configures publishing nix-specific events to containerd's
+// event service.
+type EventsConfig struct {
+	Enable            bool   `toml:"enable"`
+	ContainerdAddress string `toml:"containerd_address"`
+}
+
+// Duration is a time.Duration that is configured as a string such as "30s".
+type Duration time.Duration
+
+// UnmarshalText parses a duration string.
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// MarshalText formats the duration as a string.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// DebugConfig configures debugging facilities.
+type DebugConfig struct {
+	// Address is where net/http/pprof is served if set. An absolute path is
+	// a unix socket, otherwise it is a TCP address such as "localhost:6060".
+	Address string `toml:"address"`
+}
+
 // New returns a default config.
 func New() *Config {
 	return &Config{
-		Address: defaultAddress,
-		Root:    defaultRoot,
+		LogLevel:        defaultLogLevel,
+		Address:         defaultAddress,
+		Root:            defaultRoot,
+		ShutdownTimeout: defaultShutdownTimeout,
+		Snapshotter: SnapshotterConfig{
+			Underlying:   defaultUnderlying,
+			MountBackend: defaultMountBackend,
+		},
 		ImageService: ImageServiceConfig{
 			Enable:            true,
 			ContainerdAddress: defaultContainerdAddress,
 		},
+		Events: EventsConfig{
+			ContainerdAddress: defaultContainerdAddress,
+		},
+	}
+}
+
+// Instance returns the config of the snapshotter instance name, i.e. cfg with
+// the instance's root, address and snapshotter settings. Other instances are
+// left out.
+func (cfg *Config) Instance(name string) (*Config, error) {
+	ic, ok := cfg.Instances[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown instance %q", name)
+	}
+
+	instance := *cfg
+	instance.Root = ic.Root
+	instance.Address = ic.Address
+	instance.Instances = nil
+
+	// Merging adds to maps in place, so don't share them with cfg.
+	instance.Snapshotter.Namespaces = make(map[string]NamespaceConfig)
+	for namespace, nc := range cfg.Snapshotter.Namespaces {
+		instance.Snapshotter.Namespaces[namespace] = nc
+	}
+	err := mergo.Merge(&instance.Snapshotter, ic.Snapshotter, mergo.WithOverride)
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge config of instance %q: %w", name, err)
 	}
+	return &instance, nil
 }
 
 // Merge will fill any attributes with non-empty override attribute values.
@@ -47,6 +333,229 @@ func (cfg *Config) Merge(override *Config) error {
 	return mergo.Merge(cfg, override, mergo.WithOverride)
 }
 
+// Validate returns an error if the config has invalid values.
+func (cfg *Config) Validate() error {
+	if _, err := logrus.ParseLevel(cfg.LogLevel); err != nil {
+		return err
+	}
+	if cfg.Address == "" {
+		return errors.New("address must not be empty")
+	}
+	if cfg.Root == "" {
+		return errors.New("root must not be empty")
+	}
+	if cfg.ShutdownTimeout < 0 {
+		return errors.New("shutdown_timeout must not be negative")
+	}
+	if _, err := cfg.Socket.FileMode(); err != nil {
+		return err
+	}
+	if !contains(underlyings, cfg.Snapshotter.Underlying) {
+		return fmt.Errorf("snapshotter.underlying %q must be one of %s", cfg.Snapshotter.Underlying, strings.Join(underlyings, ", "))
+	}
+	if !contains(mountBackends, cfg.Snapshotter.MountBackend) {
+		return fmt.Errorf("snapshotter.mount_backend %q must be one of %s", cfg.Snapshotter.MountBackend, strings.Join(mountBackends, ", "))
+	}
+	if cfg.Snapshotter.IDMappedMounts && cfg.Snapshotter.MountBackend == "fuse-overlayfs" {
+		return errors.New("snapshotter.idmapped_mounts is not supported with snapshotter.mount_backend \"fuse-overlayfs\"")
+	}
+	if storeDir := cfg.Snapshotter.StoreDir; storeDir != "" && !filepath.IsAbs(storeDir) {
+		return fmt.Errorf("snapshotter.store_dir %q must be an absolute path", storeDir)
+	}
+	if storeRoot := cfg.Snapshotter.StoreRoot; storeRoot != "" && !filepath.IsAbs(storeRoot) {
+		return fmt.Errorf("snapshotter.store_root %q must be an absolute path", storeRoot)
+	}
+	if cfg.Snapshotter.Builder.Timeout < 0 {
+		return errors.New("snapshotter.builder.timeout must not be negative")
+	}
+	if err := cfg.Snapshotter.BindMounts.validate("snapshotter.bind_mounts"); err != nil {
+		return err
+	}
+	if err := cfg.Snapshotter.WarmPool.validate(cfg.Snapshotter.Underlying); err != nil {
+		return err
+	}
+	if cfg.Snapshotter.Scrub.Interval < 0 {
+		return errors.New("snapshotter.scrub.interval must not be negative")
+	}
+	if cfg.Snapshotter.Leases.ReleaseInterval < 0 {
+		return errors.New("snapshotter.leases.release_interval must not be negative")
+	}
+	for namespace, nc := range cfg.Snapshotter.Namespaces {
+		if err := nc.validate(namespace); err != nil {
+			return err
+		}
+	}
+	return cfg.validateInstances()
+}
+
+// validateInstances returns an error if an instance is invalid, or shares its
+// root or address with the daemon's snapshotter or another instance.
+func (cfg *Config) validateInstances() error {
+	roots := map[string]string{filepath.Clean(cfg.Root): ""}
+	addresses := map[string]string{filepath.Clean(cfg.Address): ""}
+	for name, ic := range cfg.Instances {
+		if err := identifiers.Validate(name); err != nil {
+			return fmt.Errorf("invalid instances key: %w", err)
+		}
+		if name == "nix" {
+			return errors.New("instances key \"nix\" is reserved for the daemon's snapshotter")
+		}
+		if ic.Root == "" || !filepath.IsAbs(ic.Root) {
+			return fmt.Errorf("instances.%s.root %q must be an absolute path", name, ic.Root)
+		}
+		if ic.Address == "" || !filepath.IsAbs(ic.Address) {
+			return fmt.Errorf("instances.%s.address %q must be an absolute path", name, ic.Address)
+		}
+		if other, ok := roots[filepath.Clean(ic.Root)]; ok {
+			return fmt.Errorf("instances.%s.root %q is also the root of %s", name, ic.Root, instanceDescription(other))
+		}
+		roots[filepath.Clean(ic.Root)] = name
+		if other, ok := addresses[filepath.Clean(ic.Address)]; ok {
+			return fmt.Errorf("instances.%s.address %q is also the address of %s", name, ic.Address, instanceDescription(other))
+		}
+		addresses[filepath.Clean(ic.Address)] = name
+
+		instance, err := cfg.Instance(name)
+		if err != nil {
+			return err
+		}
+		if err := instance.Validate(); err != nil {
+			return fmt.Errorf("invalid config of instance %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func instanceDescription(name string) string {
+	if name == "" {
+		return "the daemon's snapshotter"
+	}
+	return fmt.Sprintf("instance %q", name)
+}
+
+func (nc NamespaceConfig) validate(namespace string) error {
+	if err := identifiers.Validate(namespace); err != nil {
+		return fmt.Errorf("invalid snapshotter.namespaces key: %w", err)
+	}
+	prefix := "snapshotter.namespaces." + namespace
+	for _, substituter := range nc.Substituters {
+		if substituter == "" || strings.ContainsAny(substituter, " \t\n") {
+			return fmt.Errorf("%s.substituters %q must be a store URL without whitespace", prefix, substituter)
+		}
+	}
+	for _, key := range nc.TrustedPublicKeys {
+		if name, _, ok := strings.Cut(key, ":"); !ok || name == "" || strings.ContainsAny(key, " \t\n") {
+			return fmt.Errorf("%s.trusted_public_keys %q must be of the form name:base64-key", prefix, key)
+		}
+	}
+	if nc.MaxClosureSize < 0 {
+		return fmt.Errorf("%s.max_closure_size must not be negative", prefix)
+	}
+	if nc.BindMounts != nil {
+		return nc.BindMounts.validate(prefix + ".bind_mounts")
+	}
+	return nil
+}
+
+func (wc WarmPoolConfig) validate(underlying string) error {
+	if wc.Size < 0 {
+		return errors.New("snapshotter.warm_pool.size must not be negative")
+	}
+	if wc.IdleTimeout < 0 {
+		return errors.New("snapshotter.warm_pool.idle_timeout must not be negative")
+	}
+	if wc.Size > 0 && underlying != "overlay" {
+		return fmt.Errorf("snapshotter.warm_pool is not supported with the %s snapshotter", underlying)
+	}
+	for _, chainID := range wc.ChainIDs {
+		if _, err := digest.Parse(chainID); err != nil {
+			return fmt.Errorf("invalid snapshotter.warm_pool.chain_ids %q: %w", chainID, err)
+		}
+	}
+	return nil
+}
+
+func (bc BindMountsConfig) validate(prefix string) error {
+	if bc.Propagation != "" && !contains(propagations, bc.Propagation) {
+		return fmt.Errorf("%s.propagation %q must be one of %s", prefix, bc.Propagation, strings.Join(propagations, ", "))
+	}
+	if err := validateBindMountOptions(bc.Options); err != nil {
+		return err
+	}
+	for _, rule := range bc.Rules {
+		if _, err := filepath.Match(rule.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid %s.rules pattern %q: %w", prefix, rule.Pattern, err)
+		}
+		if err := validateBindMountOptions(rule.Options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateBindMountOptions(options []string) error {
+	for _, option := range options {
+		if !contains(bindMountOptions, option) {
+			return fmt.Errorf("bind mount option %q must be one of %s", option, strings.Join(bindMountOptions, ", "))
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// hotReloadable are the toml keys of settings that a running daemon can apply
+// without restarting. A table's key makes all of its settings hot reloadable.
+// Overrides of these settings by instances still require a restart.
+var hotReloadable = map[string]struct{}{
+	"log_level":        {},
+	"external_builder": {},
+	"shutdown_timeout": {},
+
+	"snapshotter.builder":     {},
+	"snapshotter.bind_mounts": {},
+	"snapshotter.namespaces":  {},
+}
+
+// Reload returns a copy of cfg with the hot reloadable settings of other. It
+// also returns the toml keys of settings that differ in other, but can only
+// take effect by restarting the daemon.
+func (cfg *Config) Reload(other *Config) (*Config, []string) {
+	reloaded := *cfg
+	restartRequired := reload(reflect.ValueOf(&reloaded).Elem(), reflect.ValueOf(other).Elem(), "")
+	return &reloaded, restartRequired
+}
+
+// reload sets the hot reloadable fields of struct dst to those of src, and
+// returns the dotted toml keys of the other fields that differ.
+func reload(dst, src reflect.Value, prefix string) []string {
+	var restartRequired []string
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		key := prefix + name
+
+		if _, ok := hotReloadable[key]; ok {
+			dst.Field(i).Set(src.Field(i))
+		} else if field.Type.Kind() == reflect.Struct {
+			restartRequired = append(restartRequired, reload(dst.Field(i), src.Field(i), key+".")...)
+		} else if !reflect.DeepEqual(dst.Field(i).Interface(), src.Field(i).Interface()) {
+			restartRequired = append(restartRequired, key)
+		}
+	}
+	return restartRequired
+}
+
 // Load will unmarshal a toml file at the given config path and merge it
 // with this config. If it doesn't exist, then do nothing.
 func (cfg *Config) Load(ctx context.Context, configPath string) error {
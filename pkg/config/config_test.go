@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -55,6 +56,122 @@ func TestConfig(t *testing.T) {
 				Address: "/run/foobar/foobar.sock",
 			},
 		},
+		{
+			"load events",
+			func(ctx context.Context, testDir string) (*Config, error) {
+				cfg := New()
+
+				config := []byte(`
+[events]
+enable = true
+containerd_address = "/run/foobar/containerd.sock"
+`)
+				configPath := filepath.Join(testDir, "config.toml")
+				err := os.WriteFile(configPath, config, 0o755)
+				if err != nil {
+					return nil, err
+				}
+
+				return cfg, cfg.Load(ctx, configPath)
+			},
+			&Config{
+				Events: EventsConfig{
+					Enable:            true,
+					ContainerdAddress: "/run/foobar/containerd.sock",
+				},
+			},
+		},
+		{
+			"load duration",
+			func(ctx context.Context, testDir string) (*Config, error) {
+				cfg := New()
+
+				config := []byte(`shutdown_timeout = "1m30s"`)
+				configPath := filepath.Join(testDir, "config.toml")
+				err := os.WriteFile(configPath, config, 0o755)
+				if err != nil {
+					return nil, err
+				}
+
+				return cfg, cfg.Load(ctx, configPath)
+			},
+			&Config{
+				ShutdownTimeout: Duration(90 * time.Second),
+			},
+		},
+		{
+			"load snapshotter",
+			func(ctx context.Context, testDir string) (*Config, error) {
+				cfg := New()
+
+				config := []byte(`
+[snapshotter]
+underlying = "native"
+mount_backend = "fuse-overlayfs"
+store_dir = "/foo/store"
+
+[snapshotter.overlay]
+async_remove = true
+mount_options = ["volatile"]
+
+[snapshotter.builder]
+extra_args = ["--option", "substitute", "false"]
+timeout = "10m"
+
+[snapshotter.scrub]
+interval = "24h"
+repair = true
+
+[snapshotter.leases]
+release_interval = "1m"
+
+[snapshotter.namespaces."k8s.io"]
+substituters = ["https://cache.example.org"]
+max_closure_size = 1073741824
+
+[snapshotter.namespaces."k8s.io".bind_mounts]
+options = ["nosuid", "nodev"]
+`)
+				configPath := filepath.Join(testDir, "config.toml")
+				err := os.WriteFile(configPath, config, 0o755)
+				if err != nil {
+					return nil, err
+				}
+
+				return cfg, cfg.Load(ctx, configPath)
+			},
+			&Config{
+				Snapshotter: SnapshotterConfig{
+					Underlying:   "native",
+					MountBackend: "fuse-overlayfs",
+					StoreDir:     "/foo/store",
+					Overlay: OverlayConfig{
+						AsyncRemove:  true,
+						MountOptions: []string{"volatile"},
+					},
+					Builder: BuilderConfig{
+						ExtraArgs: []string{"--option", "substitute", "false"},
+						Timeout:   Duration(10 * time.Minute),
+					},
+					Scrub: ScrubConfig{
+						Interval: Duration(24 * time.Hour),
+						Repair:   true,
+					},
+					Leases: LeasesConfig{
+						ReleaseInterval: Duration(time.Minute),
+					},
+					Namespaces: map[string]NamespaceConfig{
+						"k8s.io": {
+							Substituters:   []string{"https://cache.example.org"},
+							MaxClosureSize: 1 << 30,
+							BindMounts: &BindMountsConfig{
+								Options: []string{"nosuid", "nodev"},
+							},
+						},
+					},
+				},
+			},
+		},
 		{
 			"load and merge",
 			func(ctx context.Context, testDir string) (*Config, error) {
@@ -100,3 +217,201 @@ func TestConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestConfigValidate(t *testing.T) {
+	cfg := New()
+	require.NoError(t, cfg.Validate())
+
+	cfg.LogLevel = "bogus"
+	require.Error(t, cfg.Validate())
+
+	cfg = New()
+	cfg.ShutdownTimeout = Duration(-time.Second)
+	require.Error(t, cfg.Validate())
+
+	cfg = New()
+	cfg.Socket.Mode = "0660"
+	require.NoError(t, cfg.Validate())
+
+	cfg.Socket.Mode = "01777"
+	require.Error(t, cfg.Validate())
+
+	cfg = New()
+	cfg.Snapshotter.Underlying = "bogus"
+	require.Error(t, cfg.Validate())
+
+	cfg = New()
+	cfg.Snapshotter.IDMappedMounts = true
+	require.NoError(t, cfg.Validate())
+
+	cfg.Snapshotter.MountBackend = "fuse-overlayfs"
+	require.Error(t, cfg.Validate())
+
+	cfg = New()
+	cfg.Snapshotter.WarmPool = WarmPoolConfig{
+		Size:     2,
+		ChainIDs: []string{"sha256:7b8b1f6d5a0f5cda0ac0ae4ad5ddf2b0c87e68ef2c6f7e4e3b95a6f1c2d1d5e9"},
+	}
+	require.NoError(t, cfg.Validate())
+
+	cfg.Snapshotter.Underlying = "native"
+	require.Error(t, cfg.Validate())
+
+	cfg = New()
+	cfg.Snapshotter.WarmPool.ChainIDs = []string{"bogus"}
+	require.Error(t, cfg.Validate())
+
+	cfg = New()
+	cfg.Snapshotter.Scrub.Interval = Duration(-time.Hour)
+	require.Error(t, cfg.Validate())
+
+	cfg = New()
+	cfg.Snapshotter.Leases.ReleaseInterval = Duration(-time.Minute)
+	require.Error(t, cfg.Validate())
+
+	cfg = New()
+	cfg.Snapshotter.MountBackend = "bogus"
+	require.Error(t, cfg.Validate())
+
+	cfg = New()
+	cfg.Snapshotter.StoreDir = "nix/store"
+	require.Error(t, cfg.Validate())
+
+	cfg = New()
+	cfg.Snapshotter.StoreRoot = "data/nix"
+	require.Error(t, cfg.Validate())
+
+	cfg = New()
+	cfg.Snapshotter.Builder.Timeout = Duration(-time.Second)
+	require.Error(t, cfg.Validate())
+
+	cfg = New()
+	cfg.Snapshotter.BindMounts = BindMountsConfig{
+		Options:     []string{"nosuid", "nodev"},
+		Propagation: "rprivate",
+		Rules: []BindMountRule{{
+			Pattern: "/nix/store/*-glibc-*",
+			Options: []string{"noexec"},
+		}},
+	}
+	require.NoError(t, cfg.Validate())
+
+	cfg.Snapshotter.BindMounts.Options = []string{"rw"}
+	require.Error(t, cfg.Validate())
+
+	cfg = New()
+	cfg.Snapshotter.BindMounts.Propagation = "bogus"
+	require.Error(t, cfg.Validate())
+
+	cfg = New()
+	cfg.Snapshotter.BindMounts.Rules = []BindMountRule{{Pattern: "[", Options: []string{"noexec"}}}
+	require.Error(t, cfg.Validate())
+
+	cfg = New()
+	cfg.Snapshotter.Namespaces = map[string]NamespaceConfig{
+		"k8s.io": {
+			Substituters:      []string{"https://cache.example.org"},
+			TrustedPublicKeys: []string{"cache.example.org-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY="},
+			BindMounts:        &BindMountsConfig{Options: []string{"nosuid"}},
+			MaxClosureSize:    1 << 30,
+		},
+	}
+	require.NoError(t, cfg.Validate())
+
+	for _, nc := range []NamespaceConfig{
+		{Substituters: []string{"https://a.example.org https://b.example.org"}},
+		{TrustedPublicKeys: []string{"bogus"}},
+		{BindMounts: &BindMountsConfig{Options: []string{"rw"}}},
+		{MaxClosureSize: -1},
+	} {
+		cfg.Snapshotter.Namespaces = map[string]NamespaceConfig{"k8s.io": nc}
+		require.Error(t, cfg.Validate())
+	}
+
+	cfg.Snapshotter.Namespaces = map[string]NamespaceConfig{"bogus/namespace": {}}
+	require.Error(t, cfg.Validate())
+}
+
+func TestConfigInstance(t *testing.T) {
+	cfg := New()
+	cfg.Snapshotter.StoreRoot = "/data/nix"
+	cfg.Snapshotter.Namespaces = map[string]NamespaceConfig{
+		"k8s.io": {MaxClosureSize: 1 << 30},
+	}
+	cfg.Instances = map[string]InstanceConfig{
+		"nix-fuse": {
+			Root:    "/var/lib/nix-fuse",
+			Address: "/run/nix-snapshotter/nix-fuse.sock",
+			Snapshotter: SnapshotterConfig{
+				MountBackend: "fuse-overlayfs",
+				Namespaces: map[string]NamespaceConfig{
+					"test": {MaxClosureSize: 1 << 20},
+				},
+			},
+		},
+	}
+	require.NoError(t, cfg.Validate())
+
+	instance, err := cfg.Instance("nix-fuse")
+	require.NoError(t, err)
+	require.Equal(t, "/var/lib/nix-fuse", instance.Root)
+	require.Equal(t, "/run/nix-snapshotter/nix-fuse.sock", instance.Address)
+	require.Equal(t, "fuse-overlayfs", instance.Snapshotter.MountBackend)
+	require.Equal(t, "/data/nix", instance.Snapshotter.StoreRoot)
+	require.Len(t, instance.Snapshotter.Namespaces, 2)
+	require.Empty(t, instance.Instances)
+
+	// The daemon's config is left untouched.
+	require.Len(t, cfg.Snapshotter.Namespaces, 1)
+	require.Equal(t, "auto", cfg.Snapshotter.MountBackend)
+
+	_, err = cfg.Instance("bogus")
+	require.Error(t, err)
+
+	for name, ic := range map[string]InstanceConfig{
+		"nix":       {Root: "/var/lib/other", Address: "/run/other.sock"},
+		"no-root":   {Address: "/run/other.sock"},
+		"same-root": {Root: cfg.Root, Address: "/run/other.sock"},
+		"same-addr": {Root: "/var/lib/other", Address: cfg.Address},
+		"bad-snapshotter": {
+			Root:        "/var/lib/other",
+			Address:     "/run/other.sock",
+			Snapshotter: SnapshotterConfig{MountBackend: "bogus"},
+		},
+	} {
+		cfg.Instances = map[string]InstanceConfig{name: ic}
+		require.Error(t, cfg.Validate(), name)
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	cfg := New()
+
+	other := New()
+	other.LogLevel = "debug"
+	other.ExternalBuilder = "/bin/builder"
+	other.Address = "/run/foobar/foobar.sock"
+	other.Events.Enable = true
+	other.Snapshotter.MountBackend = "fuse-overlayfs"
+	other.Snapshotter.Builder.Timeout = Duration(time.Minute)
+	other.Snapshotter.BindMounts.Options = []string{"nosuid"}
+	other.Snapshotter.Namespaces = map[string]NamespaceConfig{
+		"ci": {MaxClosureSize: 4096},
+	}
+
+	reloaded, restartRequired := cfg.Reload(other)
+	require.Equal(t, []string{"address", "snapshotter.mount_backend", "events.enable"}, restartRequired)
+
+	expected := New()
+	expected.LogLevel = "debug"
+	expected.ExternalBuilder = "/bin/builder"
+	expected.Snapshotter.Builder.Timeout = Duration(time.Minute)
+	expected.Snapshotter.BindMounts.Options = []string{"nosuid"}
+	expected.Snapshotter.Namespaces = map[string]NamespaceConfig{
+		"ci": {MaxClosureSize: 4096},
+	}
+	require.Equal(t, expected, reloaded)
+
+	// The original config is left untouched.
+	require.Equal(t, New(), cfg)
+}
@@ -0,0 +1,124 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pdtpartners/nix-snapshotter/pkg/nix2container"
+)
+
+// BindMountPolicy configures the bind mounts of nix store paths, which are
+// always read only.
+type BindMountPolicy struct {
+	// Options are added to every bind mount, e.g. "nosuid" and "nodev".
+	Options []string
+
+	// Propagation is the mount propagation of the bind mounts, e.g.
+	// "rprivate". The runtime's default is used if empty.
+	Propagation string
+
+	// NonRecursive bind mounts nix store paths without the mounts under them.
+	NonRecursive bool
+
+	// Rules add options to the bind mounts of matching nix store paths.
+	Rules []BindMountRule
+}
+
+// BindMountRule adds options to the bind mounts of nix store paths matching
+// Pattern, as by filepath.Match.
+type BindMountRule struct {
+	Pattern string
+	Options []string
+}
+
+// labelBindMountOptions are the options that snapshots may add to their bind
+// mounts with NixMountOptionsAnnotation. They only tighten the policy.
+var labelBindMountOptions = map[string]struct{}{
+	"nosuid": {},
+	"nodev":  {},
+	"noexec": {},
+}
+
+// WithBindMountPolicy sets the policy for bind mounts of nix store paths.
+// Unless set, they are mounted with "ro" and "rbind" only.
+func WithBindMountPolicy(policy BindMountPolicy) SnapshotterOpt {
+	return snapshotterOptFn(func(sc *SnapshotterConfig) {
+		sc.bindMountPolicy = policy
+	})
+}
+
+// options returns the mount options for the bind mount of nixStorePath,
+// including extra options requested by snapshot labels.
+func (p BindMountPolicy) options(nixStorePath string, labelOptions []string) []string {
+	bind := "rbind"
+	if p.NonRecursive {
+		bind = "bind"
+	}
+
+	options := []string{"ro", bind}
+	seen := map[string]struct{}{"ro": {}, bind: {}}
+	add := func(opts ...string) {
+		for _, opt := range opts {
+			if _, ok := seen[opt]; ok {
+				continue
+			}
+			seen[opt] = struct{}{}
+			options = append(options, opt)
+		}
+	}
+
+	add(p.Options...)
+	for _, rule := range p.Rules {
+		if ok, _ := filepath.Match(rule.Pattern, nixStorePath); ok {
+			add(rule.Options...)
+		}
+	}
+	add(labelOptions...)
+	if p.Propagation != "" {
+		add(p.Propagation)
+	}
+	return options
+}
+
+// parseMountOptionsLabel parses the value of a NixMountOptionsAnnotation
+// label, rejecting options that would loosen the bind mount policy.
+func parseMountOptionsLabel(value string) ([]string, error) {
+	var options []string
+	for _, opt := range strings.Split(value, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+		if _, ok := labelBindMountOptions[opt]; !ok {
+			return nil, fmt.Errorf("invalid %s label: option %q is not allowed", nix2container.NixMountOptionsAnnotation, opt)
+		}
+		options = append(options, opt)
+	}
+	return options, nil
+}
+
+// labelMountOptions returns the bind mount options requested by the snapshot
+// key and all its parents. It must be called within a transaction.
+func (o *nixSnapshotter) labelMountOptions(ctx context.Context, key string) ([]string, error) {
+	var options []string
+	for currentKey := key; currentKey != ""; {
+		_, info, _, err := storage.GetInfo(ctx, currentKey)
+		if err != nil {
+			return nil, err
+		}
+
+		if value, ok := info.Labels[nix2container.NixMountOptionsAnnotation]; ok {
+			opts, err := parseMountOptionsLabel(value)
+			if err != nil {
+				return nil, err
+			}
+			options = append(options, opts...)
+		}
+
+		currentKey = info.Parent
+	}
+	return options, nil
+}
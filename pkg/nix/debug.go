@@ -0,0 +1,108 @@
+package nix
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DebugState summarises the in-flight operations of a service for debugging.
+type DebugState struct {
+	Builds       []InFlightBuild       `json:"builds"`
+	Transactions []InFlightTransaction `json:"transactions"`
+
+	// Scrub is set for snapshotters running a scrubber.
+	Scrub *ScrubState `json:"scrub,omitempty"`
+}
+
+// InFlightBuild is a call to a NixBuilder that hasn't returned yet.
+type InFlightBuild struct {
+	Key       string    `json:"key,omitempty"`
+	StorePath string    `json:"store_path"`
+	OutLink   string    `json:"out_link,omitempty"`
+	Started   time.Time `json:"started"`
+}
+
+// InFlightTransaction is a metadata store transaction that hasn't been
+// committed or rolled back yet.
+type InFlightTransaction struct {
+	Operation string    `json:"operation"`
+	Key       string    `json:"key,omitempty"`
+	Writable  bool      `json:"writable"`
+	Started   time.Time `json:"started"`
+}
+
+// Debugger is implemented by services that can summarise their in-flight
+// operations for debugging.
+type Debugger interface {
+	DebugState() DebugState
+}
+
+// inFlight tracks in-flight operations.
+type inFlight struct {
+	mu           sync.Mutex
+	nextID       uint64
+	builds       map[uint64]InFlightBuild
+	transactions map[uint64]InFlightTransaction
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{
+		builds:       make(map[uint64]InFlightBuild),
+		transactions: make(map[uint64]InFlightTransaction),
+	}
+}
+
+// trackBuild records build as in-flight until the returned func is called.
+func (f *inFlight) trackBuild(build InFlightBuild) func() {
+	build.Started = time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.nextID
+	f.nextID++
+	f.builds[id] = build
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.builds, id)
+	}
+}
+
+// trackTransaction records txn as in-flight until the returned func is
+// called.
+func (f *inFlight) trackTransaction(txn InFlightTransaction) func() {
+	txn.Started = time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.nextID
+	f.nextID++
+	f.transactions[id] = txn
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.transactions, id)
+	}
+}
+
+// state returns the in-flight operations, oldest first.
+func (f *inFlight) state() DebugState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	state := DebugState{
+		Builds:       []InFlightBuild{},
+		Transactions: []InFlightTransaction{},
+	}
+	for _, build := range f.builds {
+		state.Builds = append(state.Builds, build)
+	}
+	for _, txn := range f.transactions {
+		state.Transactions = append(state.Transactions, txn)
+	}
+	sort.Slice(state.Builds, func(i, j int) bool {
+		return state.Builds[i].Started.Before(state.Builds[j].Started)
+	})
+	sort.Slice(state.Transactions, func(i, j int) bool {
+		return state.Transactions[i].Started.Before(state.Transactions[j].Started)
+	})
+	return state
+}
@@ -0,0 +1,145 @@
+package nix
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/typeurl/v2"
+)
+
+const (
+	// TopicSubstituteStart is published when a nix store path starts being
+	// substituted.
+	TopicSubstituteStart = "/snapshot/nix/substitute-start"
+
+	// TopicSubstituteDone is published when a nix store path has finished
+	// being substituted, successfully or not.
+	TopicSubstituteDone = "/snapshot/nix/substitute-done"
+
+	// TopicGCRootRemoved is published when a nix gc root held by a snapshot is
+	// removed.
+	TopicGCRootRemoved = "/snapshot/nix/gcroot-removed"
+
+	// TopicScrubCorrupted is published when a scrub finds a corrupted nix
+	// store path.
+	TopicScrubCorrupted = "/snapshot/nix/scrub-corrupted"
+)
+
+// SubstituteStart is the event published to TopicSubstituteStart.
+type SubstituteStart struct {
+	Key       string `json:"key,omitempty"`
+	StorePath string `json:"store_path"`
+}
+
+// SubstituteDone is the event published to TopicSubstituteDone. Error is
+// empty when the substitution succeeded.
+type SubstituteDone struct {
+	Key       string `json:"key,omitempty"`
+	StorePath string `json:"store_path"`
+	Error     string `json:"error,omitempty"`
+}
+
+// GCRootRemoved is the event published to TopicGCRootRemoved.
+type GCRootRemoved struct {
+	Key        string `json:"key,omitempty"`
+	SnapshotID string `json:"snapshot_id"`
+	StorePath  string `json:"store_path"`
+	GCRoot     string `json:"gc_root"`
+}
+
+// ScrubCorrupted is the event published to TopicScrubCorrupted. Error is set
+// when the nix store path couldn't be repaired.
+type ScrubCorrupted struct {
+	StorePath string `json:"store_path"`
+	Repaired  bool   `json:"repaired"`
+	Error     string `json:"error,omitempty"`
+}
+
+func init() {
+	const prefix = "types.nix-snapshotter.io/events"
+	typeurl.Register(&SubstituteStart{}, prefix, "SubstituteStart")
+	typeurl.Register(&SubstituteDone{}, prefix, "SubstituteDone")
+	typeurl.Register(&GCRootRemoved{}, prefix, "GCRootRemoved")
+	typeurl.Register(&ScrubCorrupted{}, prefix, "ScrubCorrupted")
+}
+
+// WithEventPublisher is an option to publish nix-specific events, such as
+// substitutions and gc root removals, to publisher.
+func WithEventPublisher(publisher events.Publisher) Opt {
+	return optFn(func(c *Config) {
+		c.publisher = publisher
+	})
+}
+
+// publish sends an event to publisher if there is one. Events are best effort,
+// so failures are only logged. Requests coming from containerd carry their
+// namespace, otherwise the default namespace is used.
+func publish(ctx context.Context, publisher events.Publisher, topic string, event events.Event) {
+	if publisher == nil {
+		return
+	}
+	if _, ok := namespaces.Namespace(ctx); !ok {
+		ctx = namespaces.WithNamespace(ctx, namespaces.Default)
+	}
+	err := publisher.Publish(ctx, topic, event)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("topic", topic).Debug("[nix-snapshotter] Failed to publish event")
+	}
+}
+
+type containerdPublisher struct {
+	mu        sync.Mutex
+	publisher events.Publisher
+}
+
+// NewContainerdPublisher returns an events.Publisher that publishes to the
+// event service of the containerd at containerdAddr. The connection is
+// established in the background, and events published before it is ready
+// are dropped. The connection is closed once ctx is done.
+func NewContainerdPublisher(ctx context.Context, containerdAddr string) events.Publisher {
+	p := &containerdPublisher{}
+	go func() {
+		for i := 0; i < 100; i++ {
+			client, err := containerd.New(containerdAddr)
+			if err == nil {
+				p.mu.Lock()
+				p.publisher = client.EventService()
+				p.mu.Unlock()
+				log.G(ctx).Info("Connected to containerd event service")
+
+				<-ctx.Done()
+				p.mu.Lock()
+				p.publisher = nil
+				p.mu.Unlock()
+				if err := client.Close(); err != nil {
+					log.G(ctx).WithError(err).Warn("Failed to close connection to containerd event service")
+				}
+				return
+			}
+			log.G(ctx).WithError(err).Warnf("Failed to connect to containerd event service")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(10 * time.Second):
+			}
+		}
+		log.G(ctx).Warnf("No connection is available to containerd event service")
+	}()
+	return p
+}
+
+func (p *containerdPublisher) Publish(ctx context.Context, topic string, event events.Event) error {
+	p.mu.Lock()
+	publisher := p.publisher
+	p.mu.Unlock()
+	if publisher == nil {
+		log.G(ctx).WithField("topic", topic).Debug("[nix-snapshotter] Dropping event, not connected to containerd")
+		return nil
+	}
+	return publisher.Publish(ctx, topic, event)
+}
@@ -0,0 +1,177 @@
+package nix
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/continuity/fs"
+)
+
+// deleteBatchSize limits the number of nix store paths deleted by a single
+// nix-store invocation.
+const deleteBatchSize = 1000
+
+// NixGarbage is a nix store path that only gc roots of a nix snapshotter kept
+// alive, and that nix would now garbage collect.
+type NixGarbage struct {
+	NixStorePath string
+
+	// Size is the disk usage of the nix store path in bytes.
+	Size int64
+}
+
+// FindNixGarbage returns the nix store paths that were kept alive by gc roots
+// of the nix snapshotter at root, and that are dead now that those gc roots
+// are removed. Paths that nix would garbage collect for other reasons are
+// left out.
+//
+// The removed gc roots are found through the links to them that nix keeps in
+// the "gcroots/auto" directory of stateDir until its next garbage collection.
+// Once any garbage collection, e.g. nix-collect-garbage, removes those links,
+// the nix store paths of gc roots removed before it are no longer found.
+func FindNixGarbage(ctx context.Context, root, stateDir string, opts ...BuilderOpt) ([]NixGarbage, error) {
+	removed, err := removedGCRoots(root, filepath.Join(stateDir, "gcroots", "auto"))
+	if err != nil || len(removed) == 0 {
+		return nil, err
+	}
+
+	bc := newBuilderConfig(opts)
+	var args []string
+	if bc.storeRoot != "" {
+		args = append(args, "--store", bc.storeRoot)
+	}
+	args = append(args, "--gc", "--print-dead")
+
+	cmd, cancel := bc.command(ctx, "nix-store", args...)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	log.G(ctx).Infof("[nix-snapshotter] Calling %s", strings.Join(cmd.Args, " "))
+	err = cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find dead nix store paths: %w\n%s", err, stderr.String())
+	}
+
+	var garbage []NixGarbage
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		nixStorePath := strings.TrimSpace(scanner.Text())
+		if _, ok := removed[filepath.Base(nixStorePath)]; !ok || nixStorePath == "" {
+			continue
+		}
+
+		usage, err := fs.DiskUsage(ctx, filepath.Join(bc.storeRoot, nixStorePath))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get size of %s: %w", nixStorePath, err)
+		}
+		garbage = append(garbage, NixGarbage{
+			NixStorePath: nixStorePath,
+			Size:         usage.Size,
+		})
+	}
+	return garbage, scanner.Err()
+}
+
+// removedGCRoots returns the names of the nix store paths, e.g. "abc-hello",
+// of the gc roots of the nix snapshotter at root that links in autoRootsDir
+// still point to, but that have been removed.
+func removedGCRoots(root, autoRootsDir string) (map[string]struct{}, error) {
+	links, err := readDirNames(autoRootsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := make(map[string]struct{})
+	for _, link := range links {
+		target, err := os.Readlink(filepath.Join(autoRootsDir, link))
+		if err != nil {
+			continue
+		}
+		// Out-links are created at "<root>/gcroots/<id>/<name>", or at
+		// "<root>/namespaces/<namespace>/gcroots/<id>/<name>".
+		parentDir := filepath.Dir(filepath.Dir(target))
+		namespaced, _ := filepath.Match(filepath.Join(root, "namespaces", "*", "gcroots"), parentDir)
+		if parentDir != filepath.Join(root, "gcroots") && !namespaced {
+			continue
+		}
+		if _, err := os.Lstat(target); !os.IsNotExist(err) {
+			continue
+		}
+		removed[filepath.Base(target)] = struct{}{}
+	}
+	return removed, nil
+}
+
+// DeleteNixStorePaths deletes nixStorePaths with `nix-store --delete`, which
+// refuses to delete nix store paths that are alive, e.g. because they were
+// realised again since they were found to be dead. It returns the nix store
+// paths that were deleted.
+func DeleteNixStorePaths(ctx context.Context, nixStorePaths []string, opts ...BuilderOpt) ([]string, error) {
+	bc := newBuilderConfig(opts)
+	deleteBatch := func(batch []string) error {
+		var args []string
+		if bc.storeRoot != "" {
+			args = append(args, "--store", bc.storeRoot)
+		}
+		args = append(args, "--delete")
+		args = append(args, batch...)
+
+		cmd, cancel := bc.command(ctx, "nix-store", args...)
+		defer cancel()
+
+		log.G(ctx).Infof("[nix-snapshotter] Deleting %d nix store paths", len(batch))
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%w\n%s", err, string(out))
+		}
+		return nil
+	}
+
+	var deleted []string
+	for start := 0; start < len(nixStorePaths); start += deleteBatchSize {
+		end := start + deleteBatchSize
+		if end > len(nixStorePaths) {
+			end = len(nixStorePaths)
+		}
+		batch := nixStorePaths[start:end]
+		err := deleteBatch(batch)
+		if err == nil {
+			deleted = append(deleted, batch...)
+			continue
+		}
+		if ctx.Err() != nil {
+			return deleted, ctx.Err()
+		}
+
+		// Find out which nix store paths can't be deleted.
+		log.G(ctx).WithError(err).Debug("[nix-snapshotter] Failed to delete nix store paths, deleting them one by one")
+		for _, nixStorePath := range batch {
+			// Some may have been deleted before the failure.
+			if _, err := os.Lstat(filepath.Join(bc.storeRoot, nixStorePath)); os.IsNotExist(err) {
+				deleted = append(deleted, nixStorePath)
+				continue
+			}
+			err := deleteBatch([]string{nixStorePath})
+			if err != nil {
+				if ctx.Err() != nil {
+					return deleted, ctx.Err()
+				}
+				log.G(ctx).WithError(err).WithField("nixStorePath", nixStorePath).Warn("[nix-snapshotter] Skipping nix store path that can't be deleted")
+				continue
+			}
+			deleted = append(deleted, nixStorePath)
+		}
+	}
+	return deleted, nil
+}
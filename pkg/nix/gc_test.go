@@ -0,0 +1,87 @@
+package nix
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindNixGarbage(t *testing.T) {
+	testDir := t.TempDir()
+	root := filepath.Join(testDir, "root")
+	storeRoot := filepath.Join(testDir, "store")
+	autoRootsDir := filepath.Join(storeRoot, "nix", "var", "nix", "gcroots", "auto")
+	require.NoError(t, os.MkdirAll(autoRootsDir, 0o755))
+
+	hello := "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12.1"
+	glibc := "/nix/store/4nlgxhb09sdr51nc9hdm8az5b08vzkgx-glibc-2.35-163"
+	other := "/nix/store/0c4b1b2x8h6l8kq2fvy8gmwg3bl3pn8v-other"
+	strace := "/nix/store/k6j2nh8m0wr0a1dhy4v2z6yvyw6ny5pm-strace-6.3"
+	for _, nixStorePath := range []string{hello, glibc, other, strace} {
+		require.NoError(t, os.MkdirAll(filepath.Join(storeRoot, nixStorePath), 0o755))
+	}
+	err := os.WriteFile(filepath.Join(storeRoot, hello, "hello"), make([]byte, 4096), 0o755)
+	require.NoError(t, err)
+
+	// The gc roots of hello and of strace, in a namespace, were removed, that
+	// of glibc is still there, and other was rooted by something else.
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "gcroots", "2"), 0o755))
+	require.NoError(t, os.Symlink(glibc, filepath.Join(root, "gcroots", "2", filepath.Base(glibc))))
+	for name, target := range map[string]string{
+		"a": filepath.Join(root, "gcroots", "1", filepath.Base(hello)),
+		"b": filepath.Join(root, "gcroots", "2", filepath.Base(glibc)),
+		"c": filepath.Join(testDir, "result"),
+		"d": filepath.Join(root, "namespaces", "ci", "gcroots", "3", filepath.Base(strace)),
+	} {
+		require.NoError(t, os.Symlink(target, filepath.Join(autoRootsDir, name)))
+	}
+
+	binDir := t.TempDir()
+	err = os.WriteFile(filepath.Join(binDir, "nix-store"), []byte(`#!/bin/sh
+printf '%s\n' `+hello+` `+glibc+` `+other+` `+strace+`
+`), 0o755)
+	require.NoError(t, err)
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	garbage, err := FindNixGarbage(context.Background(), root, filepath.Dir(filepath.Dir(autoRootsDir)), WithBuilderStoreRoot(storeRoot))
+	require.NoError(t, err)
+	require.Len(t, garbage, 2)
+	require.Equal(t, hello, garbage[0].NixStorePath)
+	require.GreaterOrEqual(t, garbage[0].Size, int64(4096))
+	require.Equal(t, strace, garbage[1].NixStorePath)
+}
+
+func TestDeleteNixStorePaths(t *testing.T) {
+	testDir := t.TempDir()
+	argsPath := filepath.Join(testDir, "args")
+	alive := "/nix/store/4nlgxhb09sdr51nc9hdm8az5b08vzkgx-glibc-2.35-163"
+	err := os.WriteFile(filepath.Join(testDir, "nix-store"), []byte(`#!/bin/sh
+echo "$@" >> `+argsPath+`
+case "$*" in
+  *`+alive+`*) echo "cannot delete path '`+alive+`' since it is still alive" >&2; exit 1 ;;
+esac
+`), 0o755)
+	require.NoError(t, err)
+	t.Setenv("PATH", testDir+":"+os.Getenv("PATH"))
+
+	// The fake nix-store doesn't delete anything, so hello looks like it was
+	// deleted before the failure.
+	storeRoot := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(storeRoot, alive), 0o755))
+
+	hello := "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12.1"
+	deleted, err := DeleteNixStorePaths(context.Background(), []string{hello, alive}, WithBuilderStoreRoot(storeRoot))
+	require.NoError(t, err)
+	require.Equal(t, []string{hello}, deleted)
+
+	args, err := os.ReadFile(argsPath)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"--store " + storeRoot + " --delete " + hello + " " + alive,
+		"--store " + storeRoot + " --delete " + alive,
+	}, strings.Split(strings.TrimSpace(string(args)), "\n"))
+}
@@ -0,0 +1,68 @@
+package nix
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/snapshots"
+)
+
+// WithIDMappedMounts idmaps the mounts of snapshots labelled with uid and gid
+// mappings. containerd only applies the idmap mount options from 2.0, and
+// fails to mount them before, so without it such snapshots are rejected.
+func WithIDMappedMounts() SnapshotterOpt {
+	return snapshotterOptFn(func(sc *SnapshotterConfig) {
+		sc.idMappedMounts = true
+	})
+}
+
+// idMapOptions returns the mount options that idmap the mounts of a snapshot
+// with the uid and gid mapping labels set by containerd for user-namespaced
+// containers, or nil if the snapshot isn't labelled. Labelled snapshots are
+// rejected unless idmapped mounts are enabled.
+//
+// The options follow containerd's "uidmap=" and "gidmap=" mount options,
+// which are applied by containerd 2.0 or later when mounting.
+func (o *nixSnapshotter) idMapOptions(labels map[string]string) ([]string, error) {
+	uidMapping, hasUIDMapping := labels[snapshots.LabelSnapshotUIDMapping]
+	gidMapping, hasGIDMapping := labels[snapshots.LabelSnapshotGIDMapping]
+	if !hasUIDMapping && !hasGIDMapping {
+		return nil, nil
+	}
+	if !hasUIDMapping || !hasGIDMapping {
+		return nil, fmt.Errorf("both %q and %q labels must be set for idmapped mounts", snapshots.LabelSnapshotUIDMapping, snapshots.LabelSnapshotGIDMapping)
+	}
+
+	if !o.idMappedMounts {
+		return nil, fmt.Errorf("idmapped mounts require containerd 2.0 or later, and are enabled with snapshotter.idmapped_mounts: %w", errdefs.ErrNotImplemented)
+	}
+	for _, mapping := range []string{uidMapping, gidMapping} {
+		if err := validateIDMapping(mapping); err != nil {
+			return nil, err
+		}
+	}
+	return []string{
+		"uidmap=" + uidMapping,
+		"gidmap=" + gidMapping,
+	}, nil
+}
+
+// validateIDMapping returns nil if mapping is of the form
+// "containerID:hostID:size".
+func validateIDMapping(mapping string) error {
+	parts := strings.Split(mapping, ":")
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid id mapping %q: expected containerID:hostID:size", mapping)
+	}
+	for _, part := range parts {
+		if _, err := strconv.ParseUint(part, 10, 32); err != nil {
+			return fmt.Errorf("invalid id mapping %q: %w", mapping, err)
+		}
+	}
+	if parts[2] == "0" {
+		return fmt.Errorf("invalid id mapping %q: size must not be zero", mapping)
+	}
+	return nil
+}
@@ -4,11 +4,13 @@ import (
 	"context"
 	"errors"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/events"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/pdtpartners/nix-snapshotter/pkg/nix2container"
@@ -19,6 +21,12 @@ var (
 	ErrNotInitialized = errors.New("Nix-snapshotter Image Service not yet initialized")
 )
 
+// Checker is implemented by services that can report whether they are ready
+// to serve requests.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
 // ImageServiceConfig is used to configure the image service instance.
 type ImageServiceConfig struct {
 	Config
@@ -34,12 +42,15 @@ type imageService struct {
 	client             *containerd.Client
 	imageServiceClient runtime.ImageServiceClient
 	nixBuilder         NixBuilder
+	publisher          events.Publisher
+	storeRoot          string
+	inFlight           *inFlight
 }
 
 func NewImageService(ctx context.Context, containerdAddr string, opts ...ImageServiceOpt) (runtime.ImageServiceServer, error) {
 	cfg := ImageServiceConfig{
 		Config: Config{
-			nixBuilder: defaultNixBuilder,
+			nixBuilder: DefaultNixBuilder,
 		},
 	}
 	for _, opt := range opts {
@@ -48,6 +59,9 @@ func NewImageService(ctx context.Context, containerdAddr string, opts ...ImageSe
 
 	service := &imageService{
 		nixBuilder: cfg.nixBuilder,
+		publisher:  cfg.publisher,
+		storeRoot:  cfg.storeRoot,
+		inFlight:   newInFlight(),
 	}
 
 	go func() {
@@ -78,6 +92,30 @@ func (is *imageService) getClient() runtime.ImageServiceClient {
 	return client
 }
 
+// Check returns nil when the image service is connected to the backend CRI
+// service and it is serving.
+func (is *imageService) Check(ctx context.Context) error {
+	is.mu.Lock()
+	client := is.client
+	is.mu.Unlock()
+	if client == nil {
+		return ErrNotInitialized
+	}
+
+	serving, err := client.IsServing(ctx)
+	if err != nil {
+		return err
+	} else if !serving {
+		return errors.New("backend CRI service is not serving")
+	}
+	return nil
+}
+
+// DebugState returns the image service's in-flight builds.
+func (is *imageService) DebugState() DebugState {
+	return is.inFlight.state()
+}
+
 // ListImages lists existing images.
 func (is *imageService) ListImages(ctx context.Context, req *runtime.ListImagesRequest) (*runtime.ListImagesResponse, error) {
 	client := is.getClient()
@@ -116,10 +154,23 @@ func (is *imageService) PullImage(ctx context.Context, req *runtime.PullImageReq
 		":latest",
 	)
 
-	_, err := os.Stat(archivePath)
+	// The archive is built into the configured nix store, which may be a
+	// chroot store.
+	archiveFile := filepath.Join(is.storeRoot, archivePath)
+	_, err := os.Stat(archiveFile)
 	if errors.Is(err, os.ErrNotExist) {
 		log.G(ctx).Info("[image-service] Pulling nix image archive")
+		publish(ctx, is.publisher, TopicSubstituteStart, &SubstituteStart{
+			StorePath: archivePath,
+		})
+		done := is.inFlight.trackBuild(InFlightBuild{StorePath: archivePath})
 		err := is.nixBuilder(ctx, "", archivePath)
+		done()
+		substituteDone := &SubstituteDone{StorePath: archivePath}
+		if err != nil {
+			substituteDone.Error = err.Error()
+		}
+		publish(ctx, is.publisher, TopicSubstituteDone, substituteDone)
 		if err != nil {
 			return nil, err
 		}
@@ -129,7 +180,7 @@ func (is *imageService) PullImage(ctx context.Context, req *runtime.PullImageReq
 
 	log.G(ctx).Info("[image-service] Loading nix image archive")
 	ctx = namespaces.WithNamespace(ctx, "k8s.io")
-	img, err := nix2container.Load(ctx, is.client, archivePath)
+	img, err := nix2container.Load(ctx, is.client, archiveFile)
 	if err != nil {
 		return nil, err
 	}
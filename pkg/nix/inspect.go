@@ -0,0 +1,124 @@
+package nix
+
+import (
+	"context"
+	"os"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+)
+
+// SnapshotDetail describes a snapshot along with its nix specific state.
+type SnapshotDetail struct {
+	snapshots.Info
+
+	// ID is the snapshot's identifier in the metadata store, which also names
+	// its directories under the snapshotter root.
+	ID string
+
+	// Namespace is the containerd namespace the snapshot was created in, or
+	// empty if it wasn't created by containerd.
+	Namespace string
+
+	// Parents is the chain of parents of the snapshot, closest first.
+	Parents []string
+
+	// NixStorePaths are the nix store paths bind mounted for the snapshot,
+	// including those required by its parents.
+	NixStorePaths []string
+
+	// GCRootsDir is the directory holding the snapshot's nix gc roots, or
+	// empty if the snapshot doesn't hold any.
+	GCRootsDir string
+
+	Usage snapshots.Usage
+}
+
+// Inspector is implemented by snapshotters returned by NewSnapshotter to
+// expose their nix specific state for administration and debugging.
+type Inspector interface {
+	InspectSnapshots(ctx context.Context) ([]SnapshotDetail, error)
+
+	// InspectMounts returns the mounts of the snapshot key like Mounts, but
+	// without preparing the snapshot to be mounted, e.g. by mounting the
+	// tmpfs of a tmpfs-backed snapshot.
+	InspectMounts(ctx context.Context, key string) ([]mount.Mount, error)
+}
+
+// InspectMounts returns the mounts of the snapshot key without side effects.
+func (o *nixSnapshotter) InspectMounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	mounts, err := o.Snapshotter.Mounts(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return o.withNixBindMounts(ctx, key, o.convertToOverlayMountType(mounts))
+}
+
+// InspectSnapshots returns the details of every snapshot.
+func (o *nixSnapshotter) InspectSnapshots(ctx context.Context) ([]SnapshotDetail, error) {
+	var details []SnapshotDetail
+	err := o.Snapshotter.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		details = append(details, SnapshotDetail{
+			Info:      info,
+			Namespace: snapshotNamespace(info.Name),
+		})
+		return nil
+	})
+	if errdefs.IsNotFound(err) {
+		// The metadata store has no buckets until the first snapshot is created.
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	done := o.inFlight.trackTransaction(InFlightTransaction{
+		Operation: "inspect",
+		Writable:  false,
+	})
+	err = o.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		for i := range details {
+			detail := &details[i]
+			id, _, _, err := storage.GetInfo(ctx, detail.Name)
+			if err != nil {
+				return err
+			}
+			detail.ID = id
+
+			for parent := detail.Parent; parent != ""; {
+				detail.Parents = append(detail.Parents, parent)
+				_, info, _, err := storage.GetInfo(ctx, parent)
+				if err != nil {
+					return err
+				}
+				parent = info.Parent
+			}
+
+			detail.NixStorePaths, err = o.nixStorePaths(ctx, detail.Name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	done()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range details {
+		detail := &details[i]
+		gcRootsDir := o.gcRootsDir(detail.Name, detail.ID)
+		if _, err := os.Stat(gcRootsDir); err == nil {
+			detail.GCRootsDir = gcRootsDir
+		}
+
+		detail.Usage, err = o.Snapshotter.Usage(ctx, detail.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return details, nil
+}
@@ -0,0 +1,275 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/identifiers"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/snapshots/storage"
+)
+
+// leaseExpireLabel is the label containerd sets on leases created with an
+// expiration.
+const leaseExpireLabel = "containerd.io/gc.expire"
+
+// LeaseChecker returns whether the containerd lease leaseID in namespace is
+// still alive, i.e. it exists and hasn't expired.
+type LeaseChecker func(ctx context.Context, namespace, leaseID string) (alive bool, err error)
+
+// NewContainerdLeaseChecker returns a LeaseChecker that looks up leases in the
+// lease service of the containerd at containerdAddr. The connection is
+// established on first use, and retried by later checks if it fails.
+func NewContainerdLeaseChecker(containerdAddr string) LeaseChecker {
+	var (
+		mu     sync.Mutex
+		client *containerd.Client
+	)
+	return func(ctx context.Context, namespace, leaseID string) (bool, error) {
+		mu.Lock()
+		if client == nil {
+			c, err := containerd.New(containerdAddr, containerd.WithTimeout(10*time.Second))
+			if err != nil {
+				mu.Unlock()
+				return false, fmt.Errorf("failed to connect to containerd at %s: %w", containerdAddr, err)
+			}
+			client = c
+		}
+		ls := client.LeasesService()
+		mu.Unlock()
+
+		ctx = namespaces.WithNamespace(ctx, namespace)
+		found, err := ls.List(ctx, "id=="+strconv.Quote(leaseID))
+		if err != nil {
+			return false, err
+		}
+		for _, l := range found {
+			if l.ID != leaseID {
+				continue
+			}
+			// Expired leases are only deleted by containerd's next garbage
+			// collection.
+			if expire, ok := l.Labels[leaseExpireLabel]; ok {
+				t, err := time.Parse(time.RFC3339, expire)
+				if err == nil && t.Before(time.Now()) {
+					return false, nil
+				}
+			}
+			return true, nil
+		}
+		return false, nil
+	}
+}
+
+// LeaseReleasePolicy configures releasing the nix gc roots of snapshots
+// prepared under a containerd lease once the lease is gone, e.g. when a pull
+// is interrupted after some nix layers were prepared. Only the gc roots of
+// snapshots that were never committed are released, the snapshots themselves
+// are left for containerd's garbage collection.
+type LeaseReleasePolicy struct {
+	// Checker looks up whether leases are still alive.
+	Checker LeaseChecker
+
+	// Interval is the time between checks of the leases with gc roots.
+	Interval time.Duration
+}
+
+// WithLeaseRelease attaches the nix gc roots prepared for a nix layer to the
+// containerd lease of the request, and releases them as configured by policy.
+func WithLeaseRelease(policy LeaseReleasePolicy) SnapshotterOpt {
+	return snapshotterOptFn(func(sc *SnapshotterConfig) {
+		sc.leaseReleasePolicy = policy
+	})
+}
+
+// leaseRoots records which snapshots' nix gc roots belong to which lease, as
+// files at "<dir>/<namespace>/<lease>/<snapshot id>" containing the path of
+// the gc roots directory, so that records survive restarts.
+type leaseRoots struct {
+	sn     *nixSnapshotter
+	policy LeaseReleasePolicy
+	dir    string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// mu serializes changes to records with releasing them.
+	mu sync.Mutex
+}
+
+func newLeaseRoots(sn *nixSnapshotter, policy LeaseReleasePolicy) *leaseRoots {
+	ctx, cancel := context.WithCancel(context.Background())
+	lr := &leaseRoots{
+		sn:     sn,
+		policy: policy,
+		dir:    filepath.Join(sn.root, "leases"),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	lr.wg.Add(1)
+	go lr.run()
+	return lr
+}
+
+func (lr *leaseRoots) run() {
+	defer lr.wg.Done()
+	ticker := time.NewTicker(lr.policy.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lr.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := lr.release(lr.ctx)
+		if err != nil && lr.ctx.Err() == nil {
+			log.G(lr.ctx).WithError(err).Warn("[nix-snapshotter] Failed to release nix gc roots of leases")
+		}
+	}
+}
+
+// attach records that the nix gc roots of the snapshot key belong to the
+// lease of the request, if it has one.
+func (lr *leaseRoots) attach(ctx context.Context, key string) error {
+	leaseID, ok := leases.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	namespace, ok := namespaces.Namespace(ctx)
+	if !ok {
+		namespace = snapshotNamespace(key)
+	}
+	if namespace == "" {
+		return nil
+	}
+	// Both are named by the client, and are used in paths.
+	if err := identifiers.Validate(namespace); err != nil {
+		return fmt.Errorf("invalid namespace: %w", err)
+	}
+	if err := identifiers.Validate(leaseID); err != nil {
+		return fmt.Errorf("invalid lease: %w", err)
+	}
+
+	var id string
+	err := lr.sn.ms.WithTransaction(ctx, false, func(ctx context.Context) (err error) {
+		id, _, _, err = storage.GetInfo(ctx, key)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	leaseDir := filepath.Join(lr.dir, namespace, leaseID)
+	err = os.MkdirAll(leaseDir, 0o700)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(leaseDir, id), []byte(lr.sn.gcRootsDir(key, id)), 0o600)
+}
+
+// detach forgets the lease of the snapshot id, once the snapshot is committed
+// or removed.
+func (lr *leaseRoots) detach(ctx context.Context, id string) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	records, err := filepath.Glob(filepath.Join(lr.dir, "*", "*", id))
+	if err != nil {
+		return
+	}
+	for _, record := range records {
+		if err := os.Remove(record); err != nil && !os.IsNotExist(err) {
+			log.G(ctx).WithError(err).WithField("path", record).Warn("[nix-snapshotter] Failed to remove lease record")
+			continue
+		}
+		// Only succeeds once the lease has no other snapshots.
+		os.Remove(filepath.Dir(record))
+	}
+}
+
+// release checks every lease with nix gc roots once, and removes the nix gc
+// roots of the leases that are gone.
+func (lr *leaseRoots) release(ctx context.Context) error {
+	namespaceDirs, err := readDirNames(lr.dir)
+	if err != nil {
+		return err
+	}
+	for _, namespace := range namespaceDirs {
+		if identifiers.Validate(namespace) != nil {
+			continue
+		}
+		leaseIDs, err := readDirNames(filepath.Join(lr.dir, namespace))
+		if err != nil {
+			return err
+		}
+		for _, leaseID := range leaseIDs {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if identifiers.Validate(leaseID) != nil {
+				continue
+			}
+			alive, err := lr.policy.Checker(ctx, namespace, leaseID)
+			if err != nil {
+				return fmt.Errorf("failed to check lease %q in namespace %q: %w", leaseID, namespace, err)
+			}
+			if !alive {
+				lr.releaseLease(ctx, namespace, leaseID)
+			}
+		}
+	}
+	return nil
+}
+
+// releaseLease removes the nix gc roots of the snapshots still attached to a
+// lease that is gone, and forgets the lease.
+func (lr *leaseRoots) releaseLease(ctx context.Context, namespace, leaseID string) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	leaseDir := filepath.Join(lr.dir, namespace, leaseID)
+	ids, err := readDirNames(leaseDir)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("path", leaseDir).Warn("[nix-snapshotter] Failed to read lease records")
+		return
+	}
+
+	log.G(ctx).
+		WithField("namespace", namespace).
+		WithField("lease", leaseID).
+		Infof("[nix-snapshotter] Releasing nix gc roots of %d snapshots of a lease that is gone", len(ids))
+	for _, id := range ids {
+		gcRootsDir, err := os.ReadFile(filepath.Join(leaseDir, id))
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("id", id).Warn("[nix-snapshotter] Failed to read lease record")
+			continue
+		}
+		// Only remove gc roots directories of the snapshotter.
+		if !lr.sn.isGCRootsDir(string(gcRootsDir)) || filepath.Base(string(gcRootsDir)) != id {
+			continue
+		}
+		lr.sn.removeDirectory(ctx, string(gcRootsDir), "")
+	}
+	if err := os.RemoveAll(leaseDir); err != nil {
+		log.G(ctx).WithError(err).WithField("path", leaseDir).Warn("[nix-snapshotter] Failed to remove lease records")
+	}
+	// Only succeeds once the namespace has no other leases.
+	os.Remove(filepath.Dir(leaseDir))
+}
+
+// close stops releasing nix gc roots and waits for an in-progress release to
+// return.
+func (lr *leaseRoots) close() {
+	lr.cancel()
+	lr.wg.Wait()
+}
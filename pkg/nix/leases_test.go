@@ -0,0 +1,107 @@
+package nix
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/pdtpartners/nix-snapshotter/pkg/nix2container"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNixSnapshotterLeaseRelease(t *testing.T) {
+	root := t.TempDir()
+	hello := "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12.1"
+
+	var mu sync.Mutex
+	alive := map[string]bool{"pull-1": true, "pull-2": true}
+	checker := func(ctx context.Context, namespace, leaseID string) (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		require.Equal(t, "default", namespace)
+		return alive[leaseID], nil
+	}
+
+	publisher := &testPublisher{}
+	sn, err := NewSnapshotter(root,
+		WithNixBuilder(func(ctx context.Context, outLink, nixStorePath string) error {
+			err := os.MkdirAll(filepath.Dir(outLink), 0o755)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(nixStorePath, outLink)
+		}),
+		WithEventPublisher(publisher),
+		// Leases are checked by hand rather than by the ticker.
+		WithLeaseRelease(LeaseReleasePolicy{Checker: checker, Interval: time.Hour}),
+	)
+	require.NoError(t, err)
+	defer sn.Close()
+	o := sn.(*nixSnapshotter)
+
+	labels := map[string]string{
+		nix2container.NixLayerAnnotation:             "true",
+		nix2container.NixStorePrefixAnnotation + "0": hello,
+	}
+	ctx := namespaces.WithNamespace(context.Background(), "default")
+	pullCtx := leases.WithLease(ctx, "pull-1")
+
+	// An interrupted pull leaves an active snapshot, a complete one commits.
+	_, err = sn.Prepare(pullCtx, "default/1/extract-a", "", snapshots.WithLabels(labels))
+	require.NoError(t, err)
+	_, err = sn.Prepare(pullCtx, "default/2/extract-b", "", snapshots.WithLabels(labels))
+	require.NoError(t, err)
+	err = sn.Commit(pullCtx, "default/3/layer-b", "default/2/extract-b", snapshots.WithLabels(labels))
+	require.NoError(t, err)
+
+	// Snapshots prepared without a lease, or removed, aren't attached.
+	_, err = sn.Prepare(ctx, "default/4/extract-c", "", snapshots.WithLabels(labels))
+	require.NoError(t, err)
+	_, err = sn.Prepare(leases.WithLease(ctx, "pull-2"), "default/5/extract-d", "", snapshots.WithLabels(labels))
+	require.NoError(t, err)
+	require.NoError(t, sn.Remove(ctx, "default/5/extract-d"))
+
+	// Leases are named by the client, and can't escape the lease records.
+	_, err = sn.Prepare(leases.WithLease(ctx, "../../escape"), "default/6/extract-e", "", snapshots.WithLabels(labels))
+	require.Error(t, err)
+	_, err = sn.Stat(ctx, "default/6/extract-e")
+	require.ErrorIs(t, err, errdefs.ErrNotFound)
+	require.NoDirExists(t, filepath.Join(root, "escape"))
+
+	records, err := filepath.Glob(filepath.Join(root, "leases", "*", "*", "*"))
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(root, "leases", "default", "pull-1", "1")}, records)
+
+	// Nothing is released while the lease is alive.
+	require.NoError(t, o.leaseRoots.release(ctx))
+	require.DirExists(t, filepath.Join(root, "namespaces", "default", "gcroots", "1"))
+
+	mu.Lock()
+	delete(alive, "pull-1")
+	mu.Unlock()
+	require.NoError(t, o.leaseRoots.release(ctx))
+	require.NoDirExists(t, filepath.Join(root, "namespaces", "default", "gcroots", "1"))
+	require.DirExists(t, filepath.Join(root, "namespaces", "default", "gcroots", "2"))
+	require.DirExists(t, filepath.Join(root, "namespaces", "default", "gcroots", "3"))
+	require.NoDirExists(t, filepath.Join(root, "leases", "default"))
+
+	last := len(publisher.topics) - 1
+	require.Equal(t, TopicGCRootRemoved, publisher.topics[last])
+	require.Equal(t, &GCRootRemoved{
+		SnapshotID: "1",
+		StorePath:  hello,
+		GCRoot:     filepath.Join(root, "namespaces", "default", "gcroots", "1", filepath.Base(hello)),
+	}, publisher.events[last])
+
+	// The snapshot itself is left for containerd's garbage collection.
+	_, err = sn.Stat(ctx, "default/1/extract-a")
+	require.NoError(t, err)
+	require.NoError(t, sn.Remove(ctx, "default/1/extract-a"))
+}
@@ -0,0 +1,104 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/pkg/userns"
+	"github.com/containerd/containerd/snapshots/overlay/overlayutils"
+)
+
+// MountBackend is the filesystem snapshots are mounted with.
+type MountBackend string
+
+const (
+	// MountBackendAuto detects the mount backend when the snapshotter is
+	// created. See DetectMountBackend.
+	MountBackendAuto MountBackend = "auto"
+
+	// MountBackendOverlayfs mounts snapshots with the kernel's overlayfs.
+	MountBackendOverlayfs MountBackend = "overlayfs"
+
+	// MountBackendRootlessOverlayfs mounts snapshots with the kernel's
+	// overlayfs from inside a user namespace, which requires the "userxattr"
+	// mount option, added by the overlay snapshotter, and Linux 5.11 or later.
+	MountBackendRootlessOverlayfs MountBackend = "rootless-overlayfs"
+
+	// MountBackendFuseOverlayfs mounts snapshots with fuse-overlayfs, an FUSE
+	// implementation of overlayfs.
+	//
+	// See: https://github.com/containers/fuse-overlayfs
+	MountBackendFuseOverlayfs MountBackend = "fuse-overlayfs"
+)
+
+// fuseOverlayfsBinary is the executable mounts of type fuse3.fuse-overlayfs
+// are handled by.
+const fuseOverlayfsBinary = "fuse-overlayfs"
+
+// DetectMountBackend returns the mount backend that works for snapshots under
+// root. The kernel's overlayfs is preferred, falling back to fuse-overlayfs.
+func DetectMountBackend(ctx context.Context, root string) (MountBackend, error) {
+	overlayErr := overlayutils.Supported(root)
+	if overlayErr == nil {
+		if !userns.RunningInUserNS() {
+			return MountBackendOverlayfs, nil
+		}
+
+		// Older kernels patched by some distributions allow overlayfs in a user
+		// namespace without "userxattr".
+		userxattr, err := overlayutils.NeedsUserXAttr(root)
+		if err != nil {
+			log.G(ctx).WithError(err).Debug("[nix-snapshotter] Failed to detect whether overlayfs needs userxattr")
+		}
+		if userxattr {
+			return MountBackendRootlessOverlayfs, nil
+		}
+		return MountBackendOverlayfs, nil
+	}
+	log.G(ctx).WithError(overlayErr).Debug("[nix-snapshotter] Kernel overlayfs is not supported")
+
+	_, err := exec.LookPath(fuseOverlayfsBinary)
+	if err != nil {
+		return "", fmt.Errorf("no mount backend is supported: overlayfs: %v, fuse-overlayfs: %w", overlayErr, err)
+	}
+	return MountBackendFuseOverlayfs, nil
+}
+
+// CheckMountBackend returns nil when snapshots under root can be mounted with
+// backend.
+func CheckMountBackend(ctx context.Context, root string, backend MountBackend) error {
+	switch backend {
+	case MountBackendAuto:
+		_, err := DetectMountBackend(ctx, root)
+		return err
+	case MountBackendOverlayfs:
+		return overlayutils.Supported(root)
+	case MountBackendRootlessOverlayfs:
+		if !userns.RunningInUserNS() {
+			return fmt.Errorf("%s requires running in a user namespace", backend)
+		}
+		userxattr, err := overlayutils.NeedsUserXAttr(root)
+		if err != nil {
+			return err
+		}
+		if !userxattr {
+			return fmt.Errorf("%s requires overlayfs with userxattr support", backend)
+		}
+		return overlayutils.Supported(root)
+	case MountBackendFuseOverlayfs:
+		_, err := exec.LookPath(fuseOverlayfsBinary)
+		return err
+	default:
+		return fmt.Errorf("unknown mount backend %q", backend)
+	}
+}
+
+// WithMountBackend sets the mount backend used to mount snapshots. Unless
+// set, the kernel's overlayfs is used.
+func WithMountBackend(backend MountBackend) SnapshotterOpt {
+	return snapshotterOptFn(func(sc *SnapshotterConfig) {
+		sc.mountBackend = backend
+	})
+}
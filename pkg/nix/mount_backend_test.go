@@ -0,0 +1,26 @@
+package nix
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containerd/containerd/pkg/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectMountBackend(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.Background()
+	root := t.TempDir()
+
+	backend, err := DetectMountBackend(ctx, root)
+	require.NoError(t, err)
+	require.NoError(t, CheckMountBackend(ctx, root, backend))
+
+	sn, err := NewSnapshotter(root, WithMountBackend(MountBackendAuto))
+	require.NoError(t, err)
+	require.NoError(t, sn.Close())
+
+	_, err = NewSnapshotter(t.TempDir(), WithMountBackend("bogus"))
+	require.Error(t, err)
+}
@@ -0,0 +1,170 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/containerd/continuity/fs"
+	"github.com/pdtpartners/nix-snapshotter/pkg/nix2container"
+)
+
+// mountTarget is a nix store path, or a path under one, that is also mounted
+// at target.
+type mountTarget struct {
+	source string
+	target string
+}
+
+// parseMountTargetLabel parses the value of a NixMountTargetPrefixAnnotation
+// label of the form "<source>:<target>".
+func parseMountTargetLabel(value string) (mountTarget, error) {
+	source, target, ok := strings.Cut(value, ":")
+	if !ok {
+		return mountTarget{}, fmt.Errorf("invalid mount target %q: expected <source>:<target>", value)
+	}
+	if !filepath.IsAbs(source) {
+		return mountTarget{}, fmt.Errorf("invalid mount target %q: source must be an absolute path", value)
+	}
+	if !filepath.IsAbs(target) || filepath.Clean(target) == "/" {
+		return mountTarget{}, fmt.Errorf("invalid mount target %q: target must be an absolute path other than /", value)
+	}
+	return mountTarget{
+		source: filepath.Clean(source),
+		target: filepath.Clean(target),
+	}, nil
+}
+
+// validateMountTargetLabels returns an error if any mount target label in
+// labels is invalid.
+func validateMountTargetLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if !strings.HasPrefix(key, nix2container.NixMountTargetPrefixAnnotation) {
+			continue
+		}
+		if _, err := parseMountTargetLabel(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountTargets returns the mount targets of the snapshot key and all its
+// parents, sorted by target. Targets must neither conflict with each other
+// nor with the nix store paths mounted at their own location. It must be
+// called within a transaction.
+func (o *nixSnapshotter) mountTargets(ctx context.Context, key string, nixStorePaths []string) ([]mountTarget, error) {
+	byTarget := make(map[string]mountTarget)
+	for currentKey := key; currentKey != ""; {
+		_, info, _, err := storage.GetInfo(ctx, currentKey)
+		if err != nil {
+			return nil, err
+		}
+
+		for labelKey, value := range info.Labels {
+			if !strings.HasPrefix(labelKey, nix2container.NixMountTargetPrefixAnnotation) {
+				continue
+			}
+			mt, err := parseMountTargetLabel(value)
+			if err != nil {
+				return nil, err
+			}
+			if existing, ok := byTarget[mt.target]; ok && existing.source != mt.source {
+				return nil, fmt.Errorf("conflicting mount targets: %s is mounted from both %s and %s", mt.target, existing.source, mt.source)
+			}
+			byTarget[mt.target] = mt
+		}
+
+		currentKey = info.Parent
+	}
+
+	var mountTargets []mountTarget
+	for _, mt := range byTarget {
+		mountTargets = append(mountTargets, mt)
+	}
+	sort.Slice(mountTargets, func(i, j int) bool {
+		return mountTargets[i].target < mountTargets[j].target
+	})
+
+	for i, mt := range mountTargets {
+		// Targets sort after those they are nested under, but not necessarily
+		// right after, e.g. "/etc/ssl-foo" sorts between "/etc/ssl" and
+		// "/etc/ssl/certs".
+		for _, earlier := range mountTargets[:i] {
+			if isPathUnder(mt.target, earlier.target) {
+				return nil, fmt.Errorf("conflicting mount targets: %s is nested under %s", mt.target, earlier.target)
+			}
+		}
+		for _, nixStorePath := range nixStorePaths {
+			if mt.target == nixStorePath || isPathUnder(mt.target, nixStorePath) || isPathUnder(nixStorePath, mt.target) {
+				return nil, fmt.Errorf("conflicting mount targets: %s overlaps nix store path %s", mt.target, nixStorePath)
+			}
+		}
+	}
+	return mountTargets, nil
+}
+
+// resolveMountSource returns the physical path to mount for the source of a
+// mount target, and the nix store path it is in. The source must be within
+// one of nixStorePaths, also after resolving symlinks, so that images can't
+// mount arbitrary paths from the host.
+func (o *nixSnapshotter) resolveMountSource(source string, nixStorePaths []string) (string, string, error) {
+	var sourceStorePath string
+	for _, nixStorePath := range nixStorePaths {
+		if source == nixStorePath || isPathUnder(source, nixStorePath) {
+			sourceStorePath = nixStorePath
+			break
+		}
+	}
+	if sourceStorePath == "" {
+		return "", "", fmt.Errorf("mount source %s is not within the snapshot's nix store paths", source)
+	}
+
+	resolved, err := o.resolveInStore(source)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to resolve mount source %s: %w", source, err)
+	}
+
+	// Symlinks in nix store paths commonly point to their dependencies, which
+	// are also in the closure.
+	for _, nixStorePath := range nixStorePaths {
+		resolvedStorePath, err := o.resolveInStore(nixStorePath)
+		if err != nil {
+			continue
+		}
+		if resolved == resolvedStorePath || isPathUnder(resolved, resolvedStorePath) {
+			return resolved, sourceStorePath, nil
+		}
+	}
+	return "", "", fmt.Errorf("mount source %s resolves to %s outside the snapshot's nix store paths", source, resolved)
+}
+
+// resolveInStore returns the physical path of path in the nix store after
+// resolving symlinks. Symlinks are resolved one path component at a time
+// relative to the store root, as nix store paths link to their dependencies
+// with absolute paths, and following those from a chroot store would lead to
+// the host's nix store.
+func (o *nixSnapshotter) resolveInStore(path string) (string, error) {
+	root := o.storeRoot
+	if root == "" {
+		root = "/"
+	}
+	resolved, err := fs.RootPath(root, path)
+	if err != nil {
+		return "", err
+	}
+	// RootPath stops resolving at paths that don't exist.
+	if _, err := os.Lstat(resolved); err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// isPathUnder returns true if path is strictly under dir.
+func isPathUnder(path, dir string) bool {
+	return strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
@@ -0,0 +1,250 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/identifiers"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/continuity/fs"
+)
+
+// NamespacePolicy overrides the snapshotter's settings for snapshots in a
+// containerd namespace.
+type NamespacePolicy struct {
+	// Substituters replace the binary caches the nix store paths of the
+	// namespace's snapshots are substituted from, if set.
+	Substituters []string
+
+	// TrustedPublicKeys replace the keys that substituted nix store paths
+	// must be signed by, if set.
+	TrustedPublicKeys []string
+
+	// BindMountPolicy replaces the snapshotter's bind mount policy if set.
+	BindMountPolicy *BindMountPolicy
+
+	// MaxClosureSize limits the size in bytes of the nix store paths a
+	// snapshot bind mounts, including those of its parents. Zero means no
+	// limit.
+	MaxClosureSize int64
+}
+
+// WithNamespacePolicy overrides the snapshotter's settings for snapshots in
+// namespace.
+func WithNamespacePolicy(namespace string, policy NamespacePolicy) SnapshotterOpt {
+	return snapshotterOptFn(func(sc *SnapshotterConfig) {
+		if sc.namespacePolicies == nil {
+			sc.namespacePolicies = make(map[string]NamespacePolicy)
+		}
+		sc.namespacePolicies[namespace] = policy
+	})
+}
+
+// PolicyReloader is implemented by snapshotters returned by NewSnapshotter to
+// replace their bind mount and namespace policies while running, e.g. when
+// the daemon's config is reloaded. Snapshots prepared before keep the mounts
+// they were given until they are next requested.
+type PolicyReloader interface {
+	ReloadPolicies(bindMountPolicy BindMountPolicy, namespacePolicies map[string]NamespacePolicy)
+}
+
+// snapshotterPolicies are the policies of a snapshotter that can be reloaded.
+type snapshotterPolicies struct {
+	bindMountPolicy   BindMountPolicy
+	namespacePolicies map[string]NamespacePolicy
+}
+
+// ReloadPolicies atomically replaces the bind mount and namespace policies,
+// so that an operation never sees a mix of old and new policies.
+func (o *nixSnapshotter) ReloadPolicies(bindMountPolicy BindMountPolicy, namespacePolicies map[string]NamespacePolicy) {
+	o.policies.Store(&snapshotterPolicies{
+		bindMountPolicy:   bindMountPolicy,
+		namespacePolicies: namespacePolicies,
+	})
+}
+
+// nixConfig returns the nix.conf settings the namespace's nix store paths are
+// realised with. They are passed to the snapshotter's NixBuilder through
+// NIX_CONFIG, so that builds still go through the shared builder.
+func (p NamespacePolicy) nixConfig() string {
+	var lines []string
+	if len(p.Substituters) > 0 {
+		lines = append(lines, "substituters = "+strings.Join(p.Substituters, " "))
+	}
+	if len(p.TrustedPublicKeys) > 0 {
+		lines = append(lines, "trusted-public-keys = "+strings.Join(p.TrustedPublicKeys, " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// snapshotNamespace returns the containerd namespace of the snapshot key, or
+// empty if it isn't named by containerd as "<namespace>/<id>/<name>". As keys
+// come from clients, namespaces that containerd wouldn't accept, e.g. "..",
+// are ignored so that they are safe to use in paths.
+func snapshotNamespace(key string) string {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) != 3 || identifiers.Validate(parts[0]) != nil {
+		return ""
+	}
+	if _, err := strconv.ParseUint(parts[1], 10, 64); err != nil {
+		return ""
+	}
+	return parts[0]
+}
+
+// namespacePolicy returns the settings for the snapshot key, as overridden
+// for the namespace of the request in ctx. Requests without one, such as
+// those of the admin service, use the namespace the snapshot was created in.
+func (o *nixSnapshotter) namespacePolicy(ctx context.Context, key string) NamespacePolicy {
+	policies := o.policies.Load()
+	policy := NamespacePolicy{
+		BindMountPolicy: &policies.bindMountPolicy,
+	}
+
+	namespace, ok := namespaces.Namespace(ctx)
+	if !ok {
+		namespace = snapshotNamespace(key)
+	}
+	override, ok := policies.namespacePolicies[namespace]
+	if !ok {
+		return policy
+	}
+	policy.Substituters = override.Substituters
+	policy.TrustedPublicKeys = override.TrustedPublicKeys
+	if override.BindMountPolicy != nil {
+		policy.BindMountPolicy = override.BindMountPolicy
+	}
+	policy.MaxClosureSize = override.MaxClosureSize
+	return policy
+}
+
+// gcRootsDir returns the directory of the nix gc roots of the snapshot key
+// with the given id. The gc roots of snapshots in a containerd namespace are
+// kept under "namespaces/<namespace>/gcroots", so that each namespace's roots
+// can be told apart. Other snapshots, and snapshots whose gc roots predate
+// this layout, use the flat "gcroots" directory.
+func (o *nixSnapshotter) gcRootsDir(key, id string) string {
+	flat := filepath.Join(o.root, "gcroots", id)
+	namespace := snapshotNamespace(key)
+	if namespace == "" {
+		return flat
+	}
+	if _, err := os.Stat(flat); err == nil {
+		return flat
+	}
+	return filepath.Join(o.root, "namespaces", namespace, "gcroots", id)
+}
+
+// gcRootsParentDirs returns the directories containing the nix gc roots
+// directories of snapshots, i.e. the flat one and one per namespace.
+func (o *nixSnapshotter) gcRootsParentDirs() ([]string, error) {
+	parentDirs := []string{filepath.Join(o.root, "gcroots")}
+	namespaces, err := readDirNames(filepath.Join(o.root, "namespaces"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(namespaces)
+	for _, namespace := range namespaces {
+		parentDirs = append(parentDirs, filepath.Join(o.root, "namespaces", namespace, "gcroots"))
+	}
+	return parentDirs, nil
+}
+
+// isGCRootsDir returns whether dir is the nix gc roots directory of a
+// snapshot.
+func (o *nixSnapshotter) isGCRootsDir(dir string) bool {
+	parentDir := filepath.Dir(dir)
+	if parentDir == filepath.Join(o.root, "gcroots") {
+		return true
+	}
+	matched, _ := filepath.Match(filepath.Join(o.root, "namespaces", "*", "gcroots"), parentDir)
+	return matched
+}
+
+// checkClosureSize returns an error if the nix store paths bind mounted by the
+// snapshot key exceed the maximum closure size of its namespace.
+func (o *nixSnapshotter) checkClosureSize(ctx context.Context, key string) error {
+	maxSize := o.namespacePolicy(ctx, key).MaxClosureSize
+	if maxSize <= 0 {
+		return nil
+	}
+
+	var nixStorePaths []string
+	err := o.ms.WithTransaction(ctx, false, func(ctx context.Context) (err error) {
+		nixStorePaths, err = o.nixStorePaths(ctx, key)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	roots := make([]string, len(nixStorePaths))
+	for i, nixStorePath := range nixStorePaths {
+		roots[i] = filepath.Join(o.storeRoot, nixStorePath)
+	}
+	usage, err := fs.DiskUsage(ctx, roots...)
+	if err != nil {
+		return fmt.Errorf("failed to get closure size: %w", err)
+	}
+
+	log.G(ctx).WithField("key", key).Debugf("[nix-snapshotter] Closure of %d nix store paths is %d bytes", len(nixStorePaths), usage.Size)
+	if usage.Size > maxSize {
+		return fmt.Errorf("closure of %d nix store paths is %d bytes, more than the maximum of %d bytes: %w", len(nixStorePaths), usage.Size, maxSize, errdefs.ErrFailedPrecondition)
+	}
+	return nil
+}
+
+// NamespaceUsage accounts for the snapshots of a containerd namespace.
+type NamespaceUsage struct {
+	// Namespace is the containerd namespace, or empty for snapshots that
+	// weren't created by containerd.
+	Namespace string
+
+	Snapshots int
+
+	// NixStorePaths is the number of distinct nix store paths bind mounted by
+	// the namespace's snapshots.
+	NixStorePaths int
+
+	// Usage is the total usage of the namespace's snapshots, excluding their
+	// nix store paths.
+	Usage snapshots.Usage
+}
+
+// NamespaceUsages returns the usage of each namespace with snapshots in
+// details, sorted by namespace.
+func NamespaceUsages(details []SnapshotDetail) []NamespaceUsage {
+	usages := make(map[string]*NamespaceUsage)
+	nixStorePaths := make(map[string]map[string]struct{})
+	for _, detail := range details {
+		usage, ok := usages[detail.Namespace]
+		if !ok {
+			usage = &NamespaceUsage{Namespace: detail.Namespace}
+			usages[detail.Namespace] = usage
+			nixStorePaths[detail.Namespace] = make(map[string]struct{})
+		}
+		usage.Snapshots++
+		usage.Usage.Add(detail.Usage)
+		for _, nixStorePath := range detail.NixStorePaths {
+			nixStorePaths[detail.Namespace][nixStorePath] = struct{}{}
+		}
+	}
+
+	var result []NamespaceUsage
+	for namespace, usage := range usages {
+		usage.NixStorePaths = len(nixStorePaths[namespace])
+		result = append(result, *usage)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Namespace < result[j].Namespace
+	})
+	return result
+}
@@ -0,0 +1,146 @@
+package nix
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/pdtpartners/nix-snapshotter/pkg/nix2container"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotNamespace(t *testing.T) {
+	for key, expected := range map[string]string{
+		"k8s.io/12/sha256:abc":          "k8s.io",
+		"default/3/extract-1234 sha256": "default",
+		"active":                        "",
+		"nix-snapshotter/warm-pool/123": "",
+		"/12/sha256:abc":                "",
+		"../12/sha256:abc":              "",
+		"../../../etc/5/x":              "",
+	} {
+		require.Equal(t, expected, snapshotNamespace(key), key)
+	}
+}
+
+func TestNixSnapshotterGCRootsDir(t *testing.T) {
+	root := t.TempDir()
+	sn, err := NewSnapshotter(root)
+	require.NoError(t, err)
+	defer sn.Close()
+	o := sn.(*nixSnapshotter)
+
+	require.Equal(t, filepath.Join(root, "namespaces", "k8s.io", "gcroots", "5"), o.gcRootsDir("k8s.io/5/x", "5"))
+	require.Equal(t, filepath.Join(root, "gcroots", "5"), o.gcRootsDir("active", "5"))
+
+	// Keys that aren't named by containerd can't escape root.
+	require.Equal(t, filepath.Join(root, "gcroots", "5"), o.gcRootsDir("../../../etc/5/x", "5"))
+}
+
+func TestNixSnapshotterNamespacePolicy(t *testing.T) {
+	storeRoot := t.TempDir()
+	hello := "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12.1"
+	require.NoError(t, os.MkdirAll(filepath.Join(storeRoot, hello), 0o755))
+	err := os.WriteFile(filepath.Join(storeRoot, hello, "hello"), make([]byte, 64*1024), 0o755)
+	require.NoError(t, err)
+
+	// Every namespace builds with the same builder, only the nix config of the
+	// build differs.
+	built := make(map[string][]string)
+	nixConfigs := make(map[string]string)
+	root := t.TempDir()
+	sn, err := NewSnapshotter(root,
+		WithNixStoreRoot(storeRoot),
+		WithNixBuilder(func(ctx context.Context, outLink, nixStorePath string) error {
+			namespace, _ := namespaces.Namespace(ctx)
+			built[namespace] = append(built[namespace], nixStorePath)
+			nixConfigs[namespace], _ = ctx.Value(nixConfigKey{}).(string)
+			err := os.MkdirAll(filepath.Dir(outLink), 0o755)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(nixStorePath, outLink)
+		}),
+		WithNamespacePolicy("ci", NamespacePolicy{
+			Substituters:      []string{"https://cache.example.com"},
+			TrustedPublicKeys: []string{"cache.example.com-1:abc="},
+			BindMountPolicy:   &BindMountPolicy{Options: []string{"nosuid"}},
+		}),
+		WithNamespacePolicy("small", NamespacePolicy{
+			MaxClosureSize: 4096,
+		}),
+	)
+	require.NoError(t, err)
+	defer sn.Close()
+
+	labels := map[string]string{
+		nix2container.NixLayerAnnotation:             "true",
+		nix2container.NixStorePrefixAnnotation + "0": hello,
+	}
+	for _, namespace := range []string{"default", "ci"} {
+		ctx := namespaces.WithNamespace(context.Background(), namespace)
+		_, err = sn.Prepare(ctx, namespace+"/1/layer-active", "", snapshots.WithLabels(labels))
+		require.NoError(t, err)
+		err = sn.Commit(ctx, namespace+"/2/layer", namespace+"/1/layer-active", snapshots.WithLabels(labels))
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{hello}, built["default"])
+	require.Equal(t, []string{hello}, built["ci"])
+	require.Equal(t, "", nixConfigs["default"])
+	require.Equal(t, "substituters = https://cache.example.com\ntrusted-public-keys = cache.example.com-1:abc=", nixConfigs["ci"])
+
+	// Gc roots are kept apart by namespace.
+	require.DirExists(t, filepath.Join(root, "namespaces", "default", "gcroots", "1"))
+	require.DirExists(t, filepath.Join(root, "namespaces", "ci", "gcroots", "2"))
+	require.NoDirExists(t, filepath.Join(root, "gcroots"))
+
+	// Bind mounts follow the namespace of the request, or of the snapshot for
+	// requests without one.
+	ctx := namespaces.WithNamespace(context.Background(), "ci")
+	mounts, err := sn.Prepare(ctx, "ci/3/container", "ci/2/layer")
+	require.NoError(t, err)
+	require.Equal(t, []string{"ro", "rbind", "nosuid"}, mounts[1].Options)
+
+	mounts, err = sn.Mounts(context.Background(), "ci/3/container")
+	require.NoError(t, err)
+	require.Equal(t, []string{"ro", "rbind", "nosuid"}, mounts[1].Options)
+
+	mounts, err = sn.Prepare(context.Background(), "default/3/container", "default/2/layer")
+	require.NoError(t, err)
+	require.Equal(t, []string{"ro", "rbind"}, mounts[1].Options)
+
+	// Reloaded policies apply to the next request.
+	sn.(PolicyReloader).ReloadPolicies(BindMountPolicy{Options: []string{"nodev"}}, nil)
+	mounts, err = sn.Mounts(context.Background(), "ci/3/container")
+	require.NoError(t, err)
+	require.Equal(t, []string{"ro", "rbind", "nodev"}, mounts[1].Options)
+	sn.(PolicyReloader).ReloadPolicies(BindMountPolicy{}, map[string]NamespacePolicy{
+		"ci":    {BindMountPolicy: &BindMountPolicy{Options: []string{"nosuid"}}},
+		"small": {MaxClosureSize: 4096},
+	})
+
+	// Nix layers with too large a closure are rejected and removed.
+	ctx = namespaces.WithNamespace(context.Background(), "small")
+	_, err = sn.Prepare(ctx, "small/1/layer-active", "", snapshots.WithLabels(labels))
+	require.ErrorIs(t, err, errdefs.ErrFailedPrecondition)
+	_, err = sn.Stat(ctx, "small/1/layer-active")
+	require.ErrorIs(t, err, errdefs.ErrNotFound)
+
+	usages := NamespaceUsages(mustInspectSnapshots(t, sn))
+	require.Len(t, usages, 2)
+	require.Equal(t, "ci", usages[0].Namespace)
+	require.Equal(t, 2, usages[0].Snapshots)
+	require.Equal(t, 1, usages[0].NixStorePaths)
+	require.Equal(t, "default", usages[1].Namespace)
+	require.Equal(t, 2, usages[1].Snapshots)
+}
+
+func mustInspectSnapshots(t *testing.T, sn snapshots.Snapshotter) []SnapshotDetail {
+	details, err := sn.(Inspector).InspectSnapshots(context.Background())
+	require.NoError(t, err)
+	return details
+}
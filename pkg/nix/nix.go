@@ -2,9 +2,14 @@ package nix
 
 import (
 	"context"
+	"fmt"
+	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/containerd/containerd/events"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/snapshots/overlay/overlayutils"
 )
@@ -19,6 +24,8 @@ func Supported(root string) error {
 // Config is used to configure common options.
 type Config struct {
 	nixBuilder NixBuilder
+	publisher  events.Publisher
+	storeRoot  string
 }
 
 func (c *Config) apply(fn func(c *Config)) {
@@ -48,6 +55,16 @@ func WithNixBuilder(nixBuilder NixBuilder) Opt {
 	})
 }
 
+// WithNixStoreRoot uses nix store paths from the chroot store at root, e.g.
+// "/nix/store/...-hello" is read from "/data/nix/nix/store/...-hello" for a
+// root of "/data/nix". Snapshotters bind mount them from there, and the image
+// service loads image archives from there.
+func WithNixStoreRoot(root string) Opt {
+	return optFn(func(c *Config) {
+		c.storeRoot = root
+	})
+}
+
 // NixBuilder is a function that is able to substitute a nix store path and
 // optionally create an out-link. outLink may be empty in which case out-links
 // are not needed.
@@ -56,28 +73,158 @@ func WithNixBuilder(nixBuilder NixBuilder) Opt {
 // however it can also be done by `nix copy` and alternate implementations.
 type NixBuilder func(ctx context.Context, outLink, nixStorePath string) error
 
-func defaultNixBuilder(ctx context.Context, outLink, nixStorePath string) error {
-	var args []string
-	if outLink != "" {
-		args = append(args, "--add-root", outLink)
+// DefaultNixBuilder is the NixBuilder used unless overridden, which realises
+// nix store paths using nix-store.
+func DefaultNixBuilder(ctx context.Context, outLink, nixStorePath string) error {
+	return NewNixStoreBuilder()(ctx, outLink, nixStorePath)
+}
+
+// BuilderOpt is an option for NewNixStoreBuilder and NewExternalBuilder.
+type BuilderOpt func(bc *builderConfig)
+
+type builderConfig struct {
+	extraArgs []string
+	env       []string
+	timeout   time.Duration
+	storeRoot string
+}
+
+// WithBuilderArgs adds extra arguments to the command run by the builder.
+func WithBuilderArgs(args ...string) BuilderOpt {
+	return func(bc *builderConfig) {
+		bc.extraArgs = append(bc.extraArgs, args...)
+	}
+}
+
+// WithBuilderStoreDir sets the nix store directory used by the builder.
+func WithBuilderStoreDir(storeDir string) BuilderOpt {
+	return func(bc *builderConfig) {
+		bc.env = append(bc.env, "NIX_STORE_DIR="+storeDir)
+	}
+}
+
+// WithBuilderStoreRoot runs the builder against the chroot store at root. It
+// is passed to nix-store as --store, and to external builders as NIX_REMOTE.
+func WithBuilderStoreRoot(root string) BuilderOpt {
+	return func(bc *builderConfig) {
+		bc.storeRoot = root
+	}
+}
+
+// WithBuilderTimeout limits how long the builder may take to realise a nix
+// store path.
+func WithBuilderTimeout(timeout time.Duration) BuilderOpt {
+	return func(bc *builderConfig) {
+		bc.timeout = timeout
+	}
+}
+
+type nixConfigKey struct{}
+
+// withNixConfig returns a context in which builders run nix with the nix.conf
+// settings in nixConfig, e.g. "substituters = https://cache.example.org",
+// passed through the NIX_CONFIG environment variable. Unlike command line
+// options, NIX_CONFIG is honoured by every nix command an external builder
+// runs.
+func withNixConfig(ctx context.Context, nixConfig string) context.Context {
+	if nixConfig == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, nixConfigKey{}, nixConfig)
+}
+
+func newBuilderConfig(opts []BuilderOpt) builderConfig {
+	var bc builderConfig
+	for _, opt := range opts {
+		opt(&bc)
+	}
+	return bc
+}
+
+// command returns the command to run name with args, after the extra
+// arguments, bounded by the timeout if any. Nix settings from withNixConfig
+// are appended to those of the daemon's NIX_CONFIG.
+func (bc builderConfig) command(ctx context.Context, name string, args ...string) (*exec.Cmd, context.CancelFunc) {
+	env := bc.env
+	if nixConfig, ok := ctx.Value(nixConfigKey{}).(string); ok {
+		existing := os.Getenv("NIX_CONFIG")
+		for _, kv := range env {
+			if strings.HasPrefix(kv, "NIX_CONFIG=") {
+				existing = strings.TrimPrefix(kv, "NIX_CONFIG=")
+			}
+		}
+		if existing != "" {
+			nixConfig = existing + "\n" + nixConfig
+		}
+		env = append(env[:len(env):len(env)], "NIX_CONFIG="+nixConfig)
+	}
+
+	cancel := func() {}
+	if bc.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, bc.timeout)
 	}
-	args = append(args, "--realise", nixStorePath)
+	cmd := exec.CommandContext(ctx, name, append(append([]string{}, bc.extraArgs...), args...)...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd, cancel
+}
+
+// NewNixStoreBuilder returns a NixBuilder that realises nix store paths using
+// nix-store, like DefaultNixBuilder.
+func NewNixStoreBuilder(opts ...BuilderOpt) NixBuilder {
+	bc := newBuilderConfig(opts)
+	return func(ctx context.Context, outLink, nixStorePath string) error {
+		var args []string
+		if bc.storeRoot != "" {
+			args = append(args, "--store", bc.storeRoot)
+		}
+		if outLink != "" {
+			args = append(args, "--add-root", outLink)
+		}
+		args = append(args, "--realise", nixStorePath)
+
+		cmd, cancel := bc.command(ctx, "nix-store", args...)
+		defer cancel()
+
+		log.G(ctx).Infof("[nix-snapshotter] Calling %s", strings.Join(cmd.Args, " "))
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			log.G(ctx).
+				WithField("nixStorePath", nixStorePath).
+				Errorf("Failed to create gc root: %s\n%s", err, string(out))
+		}
+		return err
+	}
+}
 
-	log.G(ctx).Infof("[nix-snapshotter] Calling nix-store %s", strings.Join(args, " "))
-	out, err := exec.Command("nix-store", args...).CombinedOutput()
+// CheckBuilder returns nil when the executable used by the nix builder can be
+// found. An empty externalBuilder checks the default builder, otherwise it is
+// the name of an external builder as given to NewExternalBuilder.
+func CheckBuilder(externalBuilder string) error {
+	name := externalBuilder
+	if name == "" {
+		name = "nix-store"
+	}
+	_, err := exec.LookPath(name)
 	if err != nil {
-		log.G(ctx).
-			WithField("nixStorePath", nixStorePath).
-			Errorf("Failed to create gc root: %s\n%s", err, string(out))
+		return fmt.Errorf("nix builder is unavailable: %w", err)
 	}
-	return err
+	return nil
 }
 
 // NewExternalBuilder returns a NixBuilder from an external executable with
 // two arguments: an out-link path, and a Nix store path.
-func NewExternalBuilder(name string) NixBuilder {
+func NewExternalBuilder(name string, opts ...BuilderOpt) NixBuilder {
+	bc := newBuilderConfig(opts)
+	if bc.storeRoot != "" {
+		bc.env = append(bc.env, "NIX_REMOTE="+bc.storeRoot)
+	}
 	return func(ctx context.Context, outLink, nixStorePath string) error {
-		out, err := exec.Command(name, outLink, nixStorePath).CombinedOutput()
+		cmd, cancel := bc.command(ctx, name, outLink, nixStorePath)
+		defer cancel()
+
+		out, err := cmd.CombinedOutput()
 		if err != nil {
 			log.G(ctx).
 				WithField("nixStorePath", nixStorePath).
@@ -86,3 +233,62 @@ func NewExternalBuilder(name string) NixBuilder {
 		return err
 	}
 }
+
+// SerializeBuilds returns a NixBuilder that runs builder for one out-link of a
+// nix store path at a time, so that snapshotters sharing it don't substitute
+// the same nix store path concurrently. Waiting builds still run to create
+// their out-links, but find the nix store path already valid.
+func SerializeBuilds(builder NixBuilder) NixBuilder {
+	return (&BuildSerializer{}).Serialize(builder)
+}
+
+// BuildSerializer serializes the builds of a nix store path across the
+// NixBuilders it wraps, e.g. the different builders of snapshotters sharing a
+// nix store. The zero value is ready to use.
+type BuildSerializer struct {
+	mu    sync.Mutex
+	locks map[string]*buildLock
+}
+
+// Serialize returns a NixBuilder that runs builder for one out-link of a nix
+// store path at a time, across all the builders serialized by s.
+func (s *BuildSerializer) Serialize(builder NixBuilder) NixBuilder {
+	return func(ctx context.Context, outLink, nixStorePath string) error {
+		s.mu.Lock()
+		if s.locks == nil {
+			s.locks = make(map[string]*buildLock)
+		}
+		l, ok := s.locks[nixStorePath]
+		if !ok {
+			l = &buildLock{ch: make(chan struct{}, 1)}
+			s.locks[nixStorePath] = l
+		}
+		l.refs++
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			l.refs--
+			if l.refs == 0 {
+				delete(s.locks, nixStorePath)
+			}
+			s.mu.Unlock()
+		}()
+
+		select {
+		case l.ch <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		defer func() {
+			<-l.ch
+		}()
+		return builder(ctx, outLink, nixStorePath)
+	}
+}
+
+// buildLock is held while a nix store path is built, and freed once no build
+// of it is waiting.
+type buildLock struct {
+	ch   chan struct{}
+	refs int
+}
@@ -0,0 +1,168 @@
+package nix
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExternalBuilder(t *testing.T) {
+	testDir := t.TempDir()
+	argsPath := filepath.Join(testDir, "args")
+	builderPath := filepath.Join(testDir, "builder")
+	err := os.WriteFile(builderPath, []byte(`#!/bin/sh
+echo "$NIX_REMOTE" "$NIX_STORE_DIR" "$@" > `+argsPath+`
+`), 0o755)
+	require.NoError(t, err)
+
+	nixBuilder := NewExternalBuilder(builderPath,
+		WithBuilderArgs("--foo", "bar"),
+		WithBuilderStoreDir("/foo/store"),
+		WithBuilderStoreRoot("/data/nix"),
+	)
+	err = nixBuilder(context.Background(), "/out-link", "/foo/store/abc-hello")
+	require.NoError(t, err)
+
+	args, err := os.ReadFile(argsPath)
+	require.NoError(t, err)
+	require.Equal(t, "/data/nix /foo/store --foo bar /out-link /foo/store/abc-hello", strings.TrimSpace(string(args)))
+}
+
+func TestExternalBuilderTimeout(t *testing.T) {
+	builderPath := filepath.Join(t.TempDir(), "builder")
+	err := os.WriteFile(builderPath, []byte("#!/bin/sh\nexec sleep 10\n"), 0o755)
+	require.NoError(t, err)
+
+	nixBuilder := NewExternalBuilder(builderPath, WithBuilderTimeout(100*time.Millisecond))
+	start := time.Now()
+	err = nixBuilder(context.Background(), "/out-link", "/nix/store/abc-hello")
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestNixDatabaseBuilder(t *testing.T) {
+	testDir := t.TempDir()
+	argsPath := filepath.Join(testDir, "args")
+	err := os.WriteFile(filepath.Join(testDir, "nix-store"), []byte(`#!/bin/sh
+case "$*" in
+  *--dump-db*) echo registration ;;
+  *) echo "$@" "$(cat)" >> `+argsPath+` ;;
+esac
+`), 0o755)
+	require.NoError(t, err)
+	t.Setenv("PATH", testDir+":"+os.Getenv("PATH"))
+
+	nixDatabaseBuilder := NewNixDatabaseBuilder(WithBuilderStoreRoot("/data/nix"))
+	err = nixDatabaseBuilder(context.Background(), "/state", []string{"/nix/store/abc-hello"})
+	require.NoError(t, err)
+
+	args, err := os.ReadFile(argsPath)
+	require.NoError(t, err)
+	require.Equal(t, "--store local?root=/state --load-db registration", strings.TrimSpace(string(args)))
+}
+
+func TestSerializeBuilds(t *testing.T) {
+	var (
+		running    = make(map[string]int)
+		maxRunning = make(map[string]int)
+		total      atomic.Int32
+		mu         sync.Mutex
+	)
+	nixBuilder := SerializeBuilds(func(ctx context.Context, outLink, nixStorePath string) error {
+		mu.Lock()
+		running[nixStorePath]++
+		if running[nixStorePath] > maxRunning[nixStorePath] {
+			maxRunning[nixStorePath] = running[nixStorePath]
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+		total.Add(1)
+
+		mu.Lock()
+		running[nixStorePath]--
+		mu.Unlock()
+		return nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		for _, nixStorePath := range []string{"/nix/store/abc-hello", "/nix/store/def-world"} {
+			wg.Add(1)
+			go func(i int, nixStorePath string) {
+				defer wg.Done()
+				outLink := filepath.Join("/gcroots", strconv.Itoa(i), filepath.Base(nixStorePath))
+				require.NoError(t, nixBuilder(context.Background(), outLink, nixStorePath))
+			}(i, nixStorePath)
+		}
+	}
+	wg.Wait()
+
+	require.Equal(t, int32(8), total.Load())
+	require.Equal(t, map[string]int{"/nix/store/abc-hello": 1, "/nix/store/def-world": 1}, maxRunning)
+
+	// Waiting builds give up when cancelled.
+	started := make(chan struct{})
+	release := make(chan struct{})
+	blocking := SerializeBuilds(func(ctx context.Context, outLink, nixStorePath string) error {
+		close(started)
+		<-release
+		return nil
+	})
+	go func() {
+		_ = blocking(context.Background(), "/gcroots/0/abc-hello", "/nix/store/abc-hello")
+	}()
+	<-started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := blocking(ctx, "/gcroots/1/abc-hello", "/nix/store/abc-hello")
+	require.ErrorIs(t, err, context.Canceled)
+	close(release)
+}
+
+func TestBuildSerializer(t *testing.T) {
+	var (
+		running    int
+		maxRunning int
+		mu         sync.Mutex
+	)
+	build := func(ctx context.Context, outLink, nixStorePath string) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	}
+
+	// Builds of the same nix store path by different builders are serialized.
+	var serializer BuildSerializer
+	builders := []NixBuilder{serializer.Serialize(build), serializer.Serialize(build)}
+
+	var wg sync.WaitGroup
+	for i, nixBuilder := range builders {
+		wg.Add(1)
+		go func(i int, nixBuilder NixBuilder) {
+			defer wg.Done()
+			outLink := filepath.Join("/gcroots", strconv.Itoa(i), "abc-hello")
+			require.NoError(t, nixBuilder(context.Background(), outLink, "/nix/store/abc-hello"))
+		}(i, nixBuilder)
+	}
+	wg.Wait()
+	require.Equal(t, 1, maxRunning)
+}
@@ -0,0 +1,153 @@
+package nix
+
+import (
+	"time"
+
+	"github.com/containerd/containerd/snapshots/overlay"
+	"github.com/pdtpartners/nix-snapshotter/pkg/config"
+)
+
+// NewNixBuilderFromConfig returns the NixBuilder configured by cfg.
+func NewNixBuilderFromConfig(cfg *config.Config) NixBuilder {
+	opts := BuilderOptsFromConfig(cfg)
+	if cfg.ExternalBuilder != "" {
+		return NewExternalBuilder(cfg.ExternalBuilder, opts...)
+	}
+	return NewNixStoreBuilder(opts...)
+}
+
+// BuilderOptsFromConfig returns the options for running nix commands
+// configured by cfg.
+func BuilderOptsFromConfig(cfg *config.Config) []BuilderOpt {
+	opts := []BuilderOpt{
+		WithBuilderArgs(cfg.Snapshotter.Builder.ExtraArgs...),
+		WithBuilderTimeout(time.Duration(cfg.Snapshotter.Builder.Timeout)),
+	}
+	if cfg.Snapshotter.StoreDir != "" {
+		opts = append(opts, WithBuilderStoreDir(cfg.Snapshotter.StoreDir))
+	}
+	if cfg.Snapshotter.StoreRoot != "" {
+		opts = append(opts, WithBuilderStoreRoot(cfg.Snapshotter.StoreRoot))
+	}
+	return opts
+}
+
+// ImageServiceOptsFromConfig returns the options for NewImageService
+// configured by cfg, so that images are pulled with the same builder and nix
+// store as the snapshotter.
+func ImageServiceOptsFromConfig(cfg *config.Config) []ImageServiceOpt {
+	opts := []ImageServiceOpt{
+		WithNixBuilder(NewNixBuilderFromConfig(cfg)),
+	}
+	if cfg.Snapshotter.StoreRoot != "" {
+		opts = append(opts, WithNixStoreRoot(cfg.Snapshotter.StoreRoot))
+	}
+	return opts
+}
+
+// SnapshotterOptsFromConfig returns the options for NewSnapshotter configured
+// by cfg, so that the standalone daemon and the containerd plugin behave the
+// same.
+func SnapshotterOptsFromConfig(cfg *config.Config) []SnapshotterOpt {
+	opts := []SnapshotterOpt{
+		WithNixBuilder(NewNixBuilderFromConfig(cfg)),
+		WithNixDatabaseBuilder(NewNixDatabaseBuilder(BuilderOptsFromConfig(cfg)...)),
+	}
+	if cfg.Snapshotter.StoreRoot != "" {
+		opts = append(opts, WithNixStoreRoot(cfg.Snapshotter.StoreRoot))
+	}
+	if fn, ok := UnderlyingSnapshotters[cfg.Snapshotter.Underlying]; ok {
+		opts = append(opts, WithUnderlyingSnapshotter(fn))
+	}
+	if cfg.Snapshotter.MountBackend != "" {
+		opts = append(opts, WithMountBackend(MountBackend(cfg.Snapshotter.MountBackend)))
+	}
+	if cfg.Snapshotter.IDMappedMounts {
+		opts = append(opts, WithIDMappedMounts())
+	}
+
+	overlayCfg := cfg.Snapshotter.Overlay
+	if overlayCfg.AsyncRemove {
+		opts = append(opts, WithAsynchronousRemove())
+	}
+	if overlayCfg.UpperdirLabel {
+		opts = append(opts, WithOverlayOpts(overlay.WithUpperdirLabel))
+	}
+	if len(overlayCfg.MountOptions) > 0 {
+		opts = append(opts, WithOverlayOpts(overlay.WithMountOptions(overlayCfg.MountOptions)))
+	}
+
+	bindMountPolicy, namespacePolicies := PoliciesFromConfig(cfg)
+	opts = append(opts, WithBindMountPolicy(bindMountPolicy))
+	for namespace, policy := range namespacePolicies {
+		opts = append(opts, WithNamespacePolicy(namespace, policy))
+	}
+
+	warmPool := cfg.Snapshotter.WarmPool
+	if warmPool.Size > 0 {
+		opts = append(opts, WithWarmPool(WarmPoolPolicy{
+			Size:        warmPool.Size,
+			ChainIDs:    warmPool.ChainIDs,
+			IdleTimeout: time.Duration(warmPool.IdleTimeout),
+		}))
+	}
+
+	scrub := cfg.Snapshotter.Scrub
+	if scrub.Interval > 0 {
+		opts = append(opts,
+			WithNixVerifier(NewNixStoreVerifier(BuilderOptsFromConfig(cfg)...)),
+			WithScrubber(ScrubPolicy{
+				Interval: time.Duration(scrub.Interval),
+				Repair:   scrub.Repair,
+			}),
+		)
+	}
+
+	if interval := cfg.Snapshotter.Leases.ReleaseInterval; interval > 0 {
+		opts = append(opts, WithLeaseRelease(LeaseReleasePolicy{
+			Checker:  NewContainerdLeaseChecker(cfg.ImageService.ContainerdAddress),
+			Interval: time.Duration(interval),
+		}))
+	}
+	return opts
+}
+
+// PoliciesFromConfig returns the bind mount and namespace policies configured
+// by cfg, e.g. to reload them with a PolicyReloader.
+func PoliciesFromConfig(cfg *config.Config) (BindMountPolicy, map[string]NamespacePolicy) {
+	namespacePolicies := make(map[string]NamespacePolicy)
+	for namespace, nc := range cfg.Snapshotter.Namespaces {
+		namespacePolicies[namespace] = namespacePolicyFromConfig(nc)
+	}
+	return bindMountPolicyFromConfig(cfg.Snapshotter.BindMounts), namespacePolicies
+}
+
+func bindMountPolicyFromConfig(bindMounts config.BindMountsConfig) BindMountPolicy {
+	policy := BindMountPolicy{
+		Options:      bindMounts.Options,
+		Propagation:  bindMounts.Propagation,
+		NonRecursive: bindMounts.NonRecursive,
+	}
+	for _, rule := range bindMounts.Rules {
+		policy.Rules = append(policy.Rules, BindMountRule{
+			Pattern: rule.Pattern,
+			Options: rule.Options,
+		})
+	}
+	return policy
+}
+
+// namespacePolicyFromConfig returns the NamespacePolicy configured by nc.
+func namespacePolicyFromConfig(nc config.NamespaceConfig) NamespacePolicy {
+	policy := NamespacePolicy{
+		Substituters:      nc.Substituters,
+		TrustedPublicKeys: nc.TrustedPublicKeys,
+		MaxClosureSize:    nc.MaxClosureSize,
+	}
+
+	if nc.BindMounts != nil {
+		bindMountPolicy := bindMountPolicyFromConfig(*nc.BindMounts)
+		policy.BindMountPolicy = &bindMountPolicy
+	}
+	return policy
+}
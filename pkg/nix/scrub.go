@@ -0,0 +1,272 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+)
+
+// NixVerifier verifies a nix store path against the narHash recorded in the
+// nix database, and returns whether it was corrupted. If repair is true, a
+// corrupted nix store path is substituted again, and an error is returned if
+// it couldn't be repaired.
+type NixVerifier func(ctx context.Context, nixStorePath string, repair bool) (corrupted bool, err error)
+
+// DefaultNixVerifier is the NixVerifier used unless overridden, which
+// verifies and repairs nix store paths using nix-store.
+func DefaultNixVerifier(ctx context.Context, nixStorePath string, repair bool) (bool, error) {
+	return NewNixStoreVerifier()(ctx, nixStorePath, repair)
+}
+
+// NewNixStoreVerifier returns a NixVerifier that verifies nix store paths with
+// `nix-store --verify-path`, and repairs them with `nix-store --repair-path`.
+func NewNixStoreVerifier(opts ...BuilderOpt) NixVerifier {
+	bc := newBuilderConfig(opts)
+	run := func(ctx context.Context, operation, nixStorePath string) (string, error) {
+		var args []string
+		if bc.storeRoot != "" {
+			args = append(args, "--store", bc.storeRoot)
+		}
+		args = append(args, operation, nixStorePath)
+
+		cmd, cancel := bc.command(ctx, "nix-store", args...)
+		defer cancel()
+
+		log.G(ctx).Debugf("[nix-snapshotter] Calling %s", strings.Join(cmd.Args, " "))
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	return func(ctx context.Context, nixStorePath string, repair bool) (bool, error) {
+		out, err := run(ctx, "--verify-path", nixStorePath)
+		if err == nil {
+			return false, nil
+		}
+		if !strings.Contains(out, "was modified") {
+			return false, fmt.Errorf("failed to verify nix store path: %w\n%s", err, out)
+		}
+		if !repair {
+			return true, nil
+		}
+
+		out, err = run(ctx, "--repair-path", nixStorePath)
+		if err != nil {
+			return true, fmt.Errorf("failed to repair nix store path: %w\n%s", err, out)
+		}
+		return true, nil
+	}
+}
+
+// WithNixVerifier is an option to override the default NixVerifier.
+func WithNixVerifier(nixVerifier NixVerifier) SnapshotterOpt {
+	return snapshotterOptFn(func(sc *SnapshotterConfig) {
+		sc.nixVerifier = nixVerifier
+	})
+}
+
+// ScrubPolicy configures a background scrubber that periodically verifies the
+// nix store paths bind mounted by snapshots, so that corruption is noticed
+// before containers misbehave.
+type ScrubPolicy struct {
+	// Interval is the time between the start of scrubs.
+	Interval time.Duration
+
+	// Repair substitutes corrupted nix store paths again.
+	Repair bool
+}
+
+// WithScrubber runs a scrubber as configured by policy.
+func WithScrubber(policy ScrubPolicy) SnapshotterOpt {
+	return snapshotterOptFn(func(sc *SnapshotterConfig) {
+		sc.scrubPolicy = policy
+	})
+}
+
+// ScrubState summarises the scrubs of a snapshotter for debugging.
+type ScrubState struct {
+	LastStarted  time.Time `json:"last_started,omitempty"`
+	LastFinished time.Time `json:"last_finished,omitempty"`
+
+	// Verified is the number of nix store paths verified by the last scrub.
+	Verified int `json:"verified"`
+
+	// Corrupted are the nix store paths found corrupted by the last scrub.
+	Corrupted []string `json:"corrupted"`
+
+	// Repaired are the corrupted nix store paths that were repaired.
+	Repaired []string `json:"repaired"`
+}
+
+// scrubber verifies the nix store paths of snapshots in the background.
+type scrubber struct {
+	sn     *nixSnapshotter
+	policy ScrubPolicy
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	state ScrubState
+}
+
+func newScrubber(sn *nixSnapshotter, policy ScrubPolicy) *scrubber {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &scrubber{
+		sn:     sn,
+		policy: policy,
+		ctx:    ctx,
+		cancel: cancel,
+		state: ScrubState{
+			Corrupted: []string{},
+			Repaired:  []string{},
+		},
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+func (s *scrubber) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.policy.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := s.scrub(s.ctx)
+		if err != nil && s.ctx.Err() == nil {
+			log.G(s.ctx).WithError(err).Warn("[nix-snapshotter] Failed to scrub nix store paths")
+		}
+	}
+}
+
+// scrub verifies every nix store path bind mounted by a snapshot once.
+func (s *scrubber) scrub(ctx context.Context) error {
+	started := time.Now()
+	s.mu.Lock()
+	s.state.LastStarted = started
+	s.mu.Unlock()
+
+	nixStorePaths, err := s.sn.referencedNixStorePaths(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.G(ctx).Infof("[nix-snapshotter] Scrubbing %d nix store paths", len(nixStorePaths))
+	state := ScrubState{
+		LastStarted: started,
+		Corrupted:   []string{},
+		Repaired:    []string{},
+	}
+	for _, nixStorePath := range nixStorePaths {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		corrupted, err := s.sn.nixVerifier(ctx, nixStorePath, s.policy.Repair)
+		if corrupted {
+			state.Corrupted = append(state.Corrupted, nixStorePath)
+			scrubCorrupted := &ScrubCorrupted{
+				StorePath: nixStorePath,
+				Repaired:  s.policy.Repair && err == nil,
+			}
+			if err != nil {
+				scrubCorrupted.Error = err.Error()
+			}
+			if scrubCorrupted.Repaired {
+				state.Repaired = append(state.Repaired, nixStorePath)
+				log.G(ctx).WithField("nixStorePath", nixStorePath).Warn("[nix-snapshotter] Repaired corrupted nix store path")
+			} else {
+				log.G(ctx).WithError(err).WithField("nixStorePath", nixStorePath).Error("[nix-snapshotter] Found corrupted nix store path")
+			}
+			publish(ctx, s.sn.publisher, TopicScrubCorrupted, scrubCorrupted)
+		} else if err != nil {
+			log.G(ctx).WithError(err).WithField("nixStorePath", nixStorePath).Warn("[nix-snapshotter] Failed to verify nix store path")
+		}
+		state.Verified++
+	}
+
+	state.LastFinished = time.Now()
+	s.mu.Lock()
+	s.state = state
+	s.mu.Unlock()
+
+	log.G(ctx).
+		WithField("corrupted", len(state.Corrupted)).
+		WithField("repaired", len(state.Repaired)).
+		Infof("[nix-snapshotter] Scrubbed %d nix store paths in %s", state.Verified, state.LastFinished.Sub(started))
+	return nil
+}
+
+func (s *scrubber) debugState() *ScrubState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state
+	return &state
+}
+
+// close stops the scrubber and waits for an in-progress scrub to return.
+func (s *scrubber) close() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+// referencedNixStorePaths returns the nix store paths bind mounted by any
+// snapshot, sorted and without duplicates.
+func (o *nixSnapshotter) referencedNixStorePaths(ctx context.Context) ([]string, error) {
+	var keys []string
+	err := o.Snapshotter.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		keys = append(keys, info.Name)
+		return nil
+	})
+	if errdefs.IsNotFound(err) {
+		// The metadata store has no buckets until the first snapshot is created.
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	done := o.inFlight.trackTransaction(InFlightTransaction{
+		Operation: "scrub",
+		Writable:  false,
+	})
+	seen := make(map[string]struct{})
+	err = o.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		for _, key := range keys {
+			nixStorePaths, err := o.nixStorePaths(ctx, key)
+			if errdefs.IsNotFound(err) {
+				// Removed since the walk.
+				continue
+			} else if err != nil {
+				return err
+			}
+			for _, nixStorePath := range nixStorePaths {
+				seen[nixStorePath] = struct{}{}
+			}
+		}
+		return nil
+	})
+	done()
+	if err != nil {
+		return nil, err
+	}
+
+	nixStorePaths := make([]string, 0, len(seen))
+	for nixStorePath := range seen {
+		nixStorePaths = append(nixStorePaths, nixStorePath)
+	}
+	sort.Strings(nixStorePaths)
+	return nixStorePaths, nil
+}
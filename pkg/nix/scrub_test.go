@@ -0,0 +1,119 @@
+package nix
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/snapshots"
+	"github.com/pdtpartners/nix-snapshotter/pkg/nix2container"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNixStoreVerifier(t *testing.T) {
+	testDir := t.TempDir()
+	argsPath := filepath.Join(testDir, "args")
+	hello := "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12.1"
+	glibc := "/nix/store/4nlgxhb09sdr51nc9hdm8az5b08vzkgx-glibc-2.35-163"
+	broken := "/nix/store/0c4b1b2x8h6l8kq2fvy8gmwg3bl3pn8v-broken"
+	err := os.WriteFile(filepath.Join(testDir, "nix-store"), []byte(`#!/bin/sh
+echo "$@" >> `+argsPath+`
+case "$*" in
+  *--verify-path*`+glibc+`*|*--verify-path*`+broken+`*)
+    echo "path '$4' was modified! expected hash 'sha256:abc', got 'sha256:def'" >&2; exit 1 ;;
+  *--repair-path*`+broken+`*)
+    echo "cannot repair path '$4'" >&2; exit 1 ;;
+  *--verify-path*|*--repair-path*) ;;
+  *) exit 1 ;;
+esac
+`), 0o755)
+	require.NoError(t, err)
+	t.Setenv("PATH", testDir+":"+os.Getenv("PATH"))
+
+	verify := NewNixStoreVerifier(WithBuilderStoreRoot("/data/nix"))
+	ctx := context.Background()
+
+	corrupted, err := verify(ctx, hello, true)
+	require.NoError(t, err)
+	require.False(t, corrupted)
+
+	corrupted, err = verify(ctx, glibc, false)
+	require.NoError(t, err)
+	require.True(t, corrupted)
+
+	corrupted, err = verify(ctx, glibc, true)
+	require.NoError(t, err)
+	require.True(t, corrupted)
+
+	corrupted, err = verify(ctx, broken, true)
+	require.Error(t, err)
+	require.True(t, corrupted)
+
+	args, err := os.ReadFile(argsPath)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"--store /data/nix --verify-path " + hello,
+		"--store /data/nix --verify-path " + glibc,
+		"--store /data/nix --verify-path " + glibc,
+		"--store /data/nix --repair-path " + glibc,
+		"--store /data/nix --verify-path " + broken,
+		"--store /data/nix --repair-path " + broken,
+	}, strings.Split(strings.TrimSpace(string(args)), "\n"))
+}
+
+func TestNixSnapshotterScrub(t *testing.T) {
+	ctx := context.Background()
+	hello := "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12.1"
+	glibc := "/nix/store/4nlgxhb09sdr51nc9hdm8az5b08vzkgx-glibc-2.35-163"
+
+	var verified []string
+	verifier := func(ctx context.Context, nixStorePath string, repair bool) (bool, error) {
+		verified = append(verified, nixStorePath)
+		require.True(t, repair)
+		return nixStorePath == glibc, nil
+	}
+
+	publisher := &testPublisher{}
+	sn, err := NewSnapshotter(t.TempDir(),
+		WithNixBuilder(func(ctx context.Context, outLink, nixStorePath string) error {
+			return nil
+		}),
+		WithEventPublisher(publisher),
+		WithNixVerifier(verifier),
+		// Scrubs are run by hand rather than by the ticker.
+		WithScrubber(ScrubPolicy{Interval: time.Hour, Repair: true}),
+	)
+	require.NoError(t, err)
+	defer sn.Close()
+	o := sn.(*nixSnapshotter)
+
+	// Scrubbing a snapshotter without snapshots verifies nothing.
+	require.NoError(t, o.scrubber.scrub(ctx))
+	require.Empty(t, verified)
+
+	// Nix store paths shared by several snapshots are verified once.
+	for i, nixStorePaths := range [][]string{{hello, glibc}, {glibc}} {
+		labels := map[string]string{nix2container.NixLayerAnnotation: "true"}
+		for j, nixStorePath := range nixStorePaths {
+			labels[nix2container.NixStorePrefixAnnotation+string(rune('0'+j))] = nixStorePath
+		}
+		_, err = sn.Prepare(ctx, "layer-"+string(rune('a'+i)), "", snapshots.WithLabels(labels))
+		require.NoError(t, err)
+	}
+	require.NoError(t, o.scrubber.scrub(ctx))
+	require.Equal(t, []string{glibc, hello}, verified)
+
+	state := sn.(Debugger).DebugState().Scrub
+	require.NotNil(t, state)
+	require.Equal(t, 2, state.Verified)
+	require.Equal(t, []string{glibc}, state.Corrupted)
+	require.Equal(t, []string{glibc}, state.Repaired)
+	require.False(t, state.LastFinished.Before(state.LastStarted))
+
+	last := len(publisher.topics) - 1
+	require.Equal(t, TopicScrubCorrupted, publisher.topics[last])
+	require.Equal(t, &ScrubCorrupted{StorePath: glibc, Repaired: true}, publisher.events[last])
+}
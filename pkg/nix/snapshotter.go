@@ -2,12 +2,17 @@ package nix
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/events"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/mount"
 	"github.com/containerd/containerd/snapshots"
@@ -19,8 +24,18 @@ import (
 // SnapshotterConfig is used to configure the nix snapshotter instance.
 type SnapshotterConfig struct {
 	Config
-	fuse        bool
-	overlayOpts []overlay.Opt
+	mountBackend       MountBackend
+	asyncRemove        bool
+	overlayOpts        []overlay.Opt
+	bindMountPolicy    BindMountPolicy
+	nixDatabaseBuilder NixDatabaseBuilder
+	underlying         UnderlyingSnapshotterFunc
+	warmPoolPolicy     WarmPoolPolicy
+	namespacePolicies  map[string]NamespacePolicy
+	nixVerifier        NixVerifier
+	scrubPolicy        ScrubPolicy
+	leaseReleasePolicy LeaseReleasePolicy
+	idMappedMounts     bool
 }
 
 // SnapshotterOpt is an option for NewSnapshotter.
@@ -39,8 +54,15 @@ func (fn snapshotterOptFn) SetSnapshotterOpt(sc *SnapshotterConfig) {
 //
 // See: https://github.com/containers/fuse-overlayfs
 func WithFuseOverlayfs() SnapshotterOpt {
+	return WithMountBackend(MountBackendFuseOverlayfs)
+}
+
+// WithAsynchronousRemove defers removing the contents of snapshots, including
+// their nix gc roots, until Cleanup is called.
+func WithAsynchronousRemove() SnapshotterOpt {
 	return snapshotterOptFn(func(sc *SnapshotterConfig) {
-		sc.fuse = true
+		sc.asyncRemove = true
+		sc.overlayOpts = append(sc.overlayOpts, overlay.AsynchronousRemove)
 	})
 }
 
@@ -53,26 +75,66 @@ func WithOverlayOpts(opts ...overlay.Opt) SnapshotterOpt {
 
 type nixSnapshotter struct {
 	snapshots.Snapshotter
-	ms          *storage.MetaStore
-	asyncRemove bool
-	root        string
-	fuse        bool
-	nixBuilder  NixBuilder
+	ms                 *storage.MetaStore
+	mirror             bool
+	asyncRemove        bool
+	root               string
+	fuse               bool
+	nixBuilder         NixBuilder
+	publisher          events.Publisher
+	inFlight           *inFlight
+	policies           atomic.Pointer[snapshotterPolicies]
+	storeRoot          string
+	nixDatabaseBuilder NixDatabaseBuilder
+	warmPool           *warmPool
+	nixVerifier        NixVerifier
+	scrubber           *scrubber
+	leaseRoots         *leaseRoots
+	idMappedMounts     bool
+
+	// mirrorMu is held for reading while a snapshot is created by the
+	// underlying snapshotter and not yet mirrored, and for writing while
+	// Cleanup removes the snapshots that aren't mirrored.
+	mirrorMu sync.RWMutex
 }
 
-// NewSnapshotter returns a Snapshotter which uses overlayfs. The overlayfs
+// NewSnapshotter returns a Snapshotter which uses overlayfs, unless another
+// underlying snapshotter is given by WithUnderlyingSnapshotter. The overlayfs
 // diffs are stored under the provided root. A metadata file is stored under
 // the root.
 func NewSnapshotter(root string, opts ...SnapshotterOpt) (snapshots.Snapshotter, error) {
 	cfg := SnapshotterConfig{
 		Config: Config{
-			nixBuilder: defaultNixBuilder,
+			nixBuilder: DefaultNixBuilder,
 		},
+		mountBackend:       MountBackendOverlayfs,
+		nixDatabaseBuilder: DefaultNixDatabaseBuilder,
+		nixVerifier:        DefaultNixVerifier,
 	}
 	for _, opt := range opts {
 		opt.SetSnapshotterOpt(&cfg)
 	}
 
+	if cfg.underlying != nil {
+		return newWithUnderlyingSnapshotter(root, cfg)
+	}
+
+	if cfg.mountBackend == MountBackendAuto {
+		backend, err := DetectMountBackend(context.Background(), root)
+		if err != nil {
+			return nil, err
+		}
+		log.L.WithField("backend", backend).Info("[nix-snapshotter] Detected mount backend")
+		cfg.mountBackend = backend
+	}
+	switch cfg.mountBackend {
+	// The overlay snapshotter adds the "userxattr" mount option itself where
+	// overlayfs needs it.
+	case MountBackendOverlayfs, MountBackendRootlessOverlayfs, MountBackendFuseOverlayfs:
+	default:
+		return nil, fmt.Errorf("unknown mount backend %q", cfg.mountBackend)
+	}
+
 	ms, err := storage.NewMetaStore(filepath.Join(root, "metadata.db"))
 	if err != nil {
 		return nil, err
@@ -84,18 +146,86 @@ func NewSnapshotter(root string, opts ...SnapshotterOpt) (snapshots.Snapshotter,
 		return nil, err
 	}
 
-	return &nixSnapshotter{
-		Snapshotter: overlaySnapshotter,
-		ms:          ms,
-		asyncRemove: false,
-		root:        root,
-		fuse:        cfg.fuse,
-		nixBuilder:  cfg.nixBuilder,
-	}, nil
+	o := &nixSnapshotter{
+		Snapshotter:        overlaySnapshotter,
+		ms:                 ms,
+		asyncRemove:        cfg.asyncRemove,
+		root:               root,
+		fuse:               cfg.mountBackend == MountBackendFuseOverlayfs,
+		nixBuilder:         cfg.nixBuilder,
+		publisher:          cfg.publisher,
+		inFlight:           newInFlight(),
+		storeRoot:          cfg.storeRoot,
+		nixDatabaseBuilder: cfg.nixDatabaseBuilder,
+		nixVerifier:        cfg.nixVerifier,
+		idMappedMounts:     cfg.idMappedMounts,
+	}
+	o.ReloadPolicies(cfg.bindMountPolicy, cfg.namespacePolicies)
+
+	policy := cfg.warmPoolPolicy
+	if policy.Size > 0 && len(policy.ChainIDs) > 0 {
+		o.warmPool = newWarmPool(o, policy)
+		err = o.warmPool.removeStale(context.Background())
+		if err != nil {
+			o.Close()
+			return nil, err
+		}
+	}
+	if cfg.scrubPolicy.Interval > 0 {
+		o.scrubber = newScrubber(o, cfg.scrubPolicy)
+	}
+	if cfg.leaseReleasePolicy.Interval > 0 {
+		o.leaseRoots = newLeaseRoots(o, cfg.leaseReleasePolicy)
+	}
+	return o, nil
+}
+
+func newWithUnderlyingSnapshotter(root string, cfg SnapshotterConfig) (snapshots.Snapshotter, error) {
+	if cfg.warmPoolPolicy.Size > 0 {
+		return nil, errors.New("warm pool is only supported with the overlay snapshotter")
+	}
+
+	err := os.MkdirAll(root, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	underlying, err := cfg.underlying(filepath.Join(root, "underlying"))
+	if err != nil {
+		return nil, err
+	}
+
+	ms, err := storage.NewMetaStore(filepath.Join(root, "metadata.db"))
+	if err != nil {
+		underlying.Close()
+		return nil, err
+	}
 
+	o := &nixSnapshotter{
+		Snapshotter:        underlying,
+		ms:                 ms,
+		mirror:             true,
+		asyncRemove:        cfg.asyncRemove,
+		root:               root,
+		nixBuilder:         cfg.nixBuilder,
+		publisher:          cfg.publisher,
+		inFlight:           newInFlight(),
+		storeRoot:          cfg.storeRoot,
+		nixDatabaseBuilder: cfg.nixDatabaseBuilder,
+		nixVerifier:        cfg.nixVerifier,
+		idMappedMounts:     cfg.idMappedMounts,
+	}
+	o.ReloadPolicies(cfg.bindMountPolicy, cfg.namespacePolicies)
+	if cfg.scrubPolicy.Interval > 0 {
+		o.scrubber = newScrubber(o, cfg.scrubPolicy)
+	}
+	if cfg.leaseReleasePolicy.Interval > 0 {
+		o.leaseRoots = newLeaseRoots(o, cfg.leaseReleasePolicy)
+	}
+	return o, nil
 }
 
-func (o *nixSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+func (o *nixSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) (_ []mount.Mount, err error) {
 	var base snapshots.Info
 	for _, opt := range opts {
 		if err := opt(&base); err != nil {
@@ -103,10 +233,47 @@ func (o *nixSnapshotter) Prepare(ctx context.Context, key, parent string, opts .
 		}
 	}
 
+	// Reject invalid labels before the snapshot is created.
+	if err := o.validateLabels(base.Labels); err != nil {
+		return nil, err
+	}
+
+	// Hand out a snapshot prepared ahead of time if there is one.
+	if o.warmPool != nil && !isWarmPoolKey(key) {
+		if pooledKey, ok := o.warmPool.take(parent, base.Labels); ok {
+			mounts, err := o.adoptWarmPoolSnapshot(ctx, pooledKey, key)
+			if err == nil {
+				return mounts, nil
+			}
+			log.G(ctx).WithError(err).Warn("[nix-snapshotter] Failed to hand out snapshot from warm pool")
+			o.warmPool.remove(ctx, pooledKey)
+		}
+	}
+
+	o.mirrorMu.RLock()
 	mounts, err := o.Snapshotter.Prepare(ctx, key, parent, opts...)
+	if err == nil {
+		err = o.mirrorSnapshot(ctx, snapshots.KindActive, key, parent, opts...)
+	}
+	o.mirrorMu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't leave behind a snapshot that containerd doesn't know about.
+	defer func() {
+		if err != nil {
+			if rerr := o.Remove(ctx, key); rerr != nil {
+				log.G(ctx).WithError(rerr).WithField("key", key).Warn("failed to remove snapshot")
+			}
+		}
+	}()
+
+	err = o.prepareTmpfs(ctx, key)
 	if err != nil {
 		return nil, err
 	}
+	mounts = o.convertToOverlayMountType(mounts)
 
 	// Annotations with prefix `containerd.io/snapshot/` will be passed down by
 	// the unpacker during CRI pull time. If this is a nix layer, then we need to
@@ -118,10 +285,29 @@ func (o *nixSnapshotter) Prepare(ctx context.Context, key, parent string, opts .
 	// mountpoints and copyToRoot symlinks. Returning nix bind mounts will error
 	// due to the paths being read only.
 	if _, ok := base.Labels[nix2container.NixLayerAnnotation]; ok {
+		// Attach the gc roots to the lease first, so that those prepared by an
+		// interrupted pull are released too.
+		if o.leaseRoots != nil {
+			err = o.leaseRoots.attach(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+		}
 		err = o.prepareNixGCRoots(ctx, key, base.Labels)
-		return mounts, err
+		if err != nil {
+			return nil, err
+		}
+		err = o.checkClosureSize(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		return mounts, nil
 	}
 
+	err = o.prepareNixDatabase(ctx, key)
+	if err != nil {
+		return nil, err
+	}
 	return o.withNixBindMounts(ctx, key, mounts)
 }
 
@@ -130,8 +316,16 @@ func (o *nixSnapshotter) prepareNixGCRoots(ctx context.Context, key string, labe
 	if err != nil {
 		return err
 	}
+	defer o.inFlight.trackTransaction(InFlightTransaction{
+		Operation: "prepare",
+		Key:       key,
+		Writable:  false,
+	})()
 	defer func() {
-		err = t.Rollback()
+		// Keep the error of a failed build.
+		if rerr := t.Rollback(); err == nil {
+			err = rerr
+		}
 	}()
 	id, _, _, err := storage.GetInfo(ctx, key)
 	if err != nil {
@@ -145,7 +339,8 @@ func (o *nixSnapshotter) prepareNixGCRoots(ctx context.Context, key string, labe
 	}
 	sort.Strings(sortedLabels)
 
-	gcRootsDir := filepath.Join(o.root, "gcroots", id)
+	buildCtx := withNixConfig(ctx, o.namespacePolicy(ctx, key).nixConfig())
+	gcRootsDir := o.gcRootsDir(key, id)
 	log.G(ctx).Infof("[nix-snapshotter] Preparing %d nix gc roots at %s", len(sortedLabels), gcRootsDir)
 	for _, labelKey := range sortedLabels {
 		if !strings.HasPrefix(labelKey, nix2container.NixStorePrefixAnnotation) {
@@ -156,7 +351,25 @@ func (o *nixSnapshotter) prepareNixGCRoots(ctx context.Context, key string, labe
 		// substituters, if it doesn't already exist.
 		nixStorePath := labels[labelKey]
 		outLink := filepath.Join(gcRootsDir, filepath.Base(nixStorePath))
-		err = o.nixBuilder(ctx, outLink, nixStorePath)
+		publish(ctx, o.publisher, TopicSubstituteStart, &SubstituteStart{
+			Key:       key,
+			StorePath: nixStorePath,
+		})
+		done := o.inFlight.trackBuild(InFlightBuild{
+			Key:       key,
+			StorePath: nixStorePath,
+			OutLink:   outLink,
+		})
+		err = o.nixBuilder(buildCtx, outLink, nixStorePath)
+		done()
+		substituteDone := &SubstituteDone{
+			Key:       key,
+			StorePath: nixStorePath,
+		}
+		if err != nil {
+			substituteDone.Error = err.Error()
+		}
+		publish(ctx, o.publisher, TopicSubstituteDone, substituteDone)
 		if err != nil {
 			return err
 		}
@@ -165,8 +378,22 @@ func (o *nixSnapshotter) prepareNixGCRoots(ctx context.Context, key string, labe
 	return nil
 }
 
+// DebugState returns the snapshotter's in-flight builds and transactions.
+func (o *nixSnapshotter) DebugState() DebugState {
+	state := o.inFlight.state()
+	if o.scrubber != nil {
+		state.Scrub = o.scrubber.debugState()
+	}
+	return state
+}
+
 func (o *nixSnapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	o.mirrorMu.RLock()
 	mounts, err := o.Snapshotter.View(ctx, key, parent, opts...)
+	if err == nil {
+		err = o.mirrorSnapshot(ctx, snapshots.KindView, key, parent, opts...)
+	}
+	o.mirrorMu.RUnlock()
 	if err != nil {
 		return nil, err
 	}
@@ -182,17 +409,146 @@ func (o *nixSnapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount,
 	if err != nil {
 		return nil, err
 	}
+	err = o.prepareTmpfs(ctx, key)
+	if err != nil {
+		return nil, err
+	}
 	return o.withNixBindMounts(ctx, key, o.convertToOverlayMountType(mounts))
 }
 
+// Update updates the info of a snapshot. New nix store path labels on an
+// active snapshot are realised with gc roots before the labels are updated,
+// so that the nix store paths are bind mounted by subsequent calls to Mounts.
+// They are also registered in the snapshot's nix database, if it has one.
+func (o *nixSnapshotter) Update(ctx context.Context, info snapshots.Info, fieldpaths ...string) (snapshots.Info, error) {
+	current, err := o.Snapshotter.Stat(ctx, info.Name)
+	if err != nil {
+		return snapshots.Info{}, err
+	}
+
+	labels := updatedLabels(current.Labels, info, fieldpaths)
+	if err := o.validateLabels(labels); err != nil {
+		return snapshots.Info{}, err
+	}
+	// The directory of a snapshot can't move on or off a tmpfs once written.
+	if labels[TmpfsSizeLabel] != current.Labels[TmpfsSizeLabel] {
+		return snapshots.Info{}, fmt.Errorf("%s can't be updated: %w", TmpfsSizeLabel, errdefs.ErrFailedPrecondition)
+	}
+
+	added := addedNixStorePathLabels(current.Labels, labels)
+	if len(added) > 0 {
+		if current.Kind != snapshots.KindActive {
+			return snapshots.Info{}, fmt.Errorf("nix store paths can only be added to active snapshots: %w", errdefs.ErrFailedPrecondition)
+		}
+		err = o.prepareNixGCRoots(ctx, info.Name, added)
+		if err != nil {
+			return snapshots.Info{}, err
+		}
+	}
+
+	updated, err := o.Snapshotter.Update(ctx, info, fieldpaths...)
+	if err != nil {
+		return snapshots.Info{}, err
+	}
+	if o.mirror {
+		err = o.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+			_, err := storage.UpdateInfo(ctx, info, fieldpaths...)
+			return err
+		})
+		if err != nil {
+			return snapshots.Info{}, err
+		}
+	}
+	if len(added) > 0 {
+		err = o.prepareNixDatabase(ctx, info.Name)
+		if err != nil {
+			return snapshots.Info{}, err
+		}
+	}
+	return updated, nil
+}
+
+// validateLabels returns an error if any of the labels configuring how a
+// snapshot is mounted is invalid.
+func (o *nixSnapshotter) validateLabels(labels map[string]string) error {
+	if _, err := o.idMapOptions(labels); err != nil {
+		return err
+	}
+	if value, ok := labels[nix2container.NixMountOptionsAnnotation]; ok {
+		if _, err := parseMountOptionsLabel(value); err != nil {
+			return err
+		}
+	}
+	if err := validateMountTargetLabels(labels); err != nil {
+		return err
+	}
+	return o.validateTmpfsSizeLabel(labels)
+}
+
+// updatedLabels returns the labels a snapshot with labels current will have
+// after being updated with info and fieldpaths, as by storage.UpdateInfo.
+func updatedLabels(current map[string]string, info snapshots.Info, fieldpaths []string) map[string]string {
+	if len(fieldpaths) == 0 {
+		return info.Labels
+	}
+
+	labels := make(map[string]string)
+	for k, v := range current {
+		labels[k] = v
+	}
+	for _, path := range fieldpaths {
+		if key, ok := strings.CutPrefix(path, "labels."); ok {
+			labels[key] = info.Labels[key]
+		} else if path == "labels" {
+			labels = make(map[string]string)
+			for k, v := range info.Labels {
+				labels[k] = v
+			}
+		}
+	}
+	return labels
+}
+
+// addedNixStorePathLabels returns the nix store path labels in updated whose
+// nix store paths aren't in current.
+func addedNixStorePathLabels(current, updated map[string]string) map[string]string {
+	existing := make(map[string]struct{})
+	for k, v := range current {
+		if strings.HasPrefix(k, nix2container.NixStorePrefixAnnotation) {
+			existing[v] = struct{}{}
+		}
+	}
+
+	added := make(map[string]string)
+	for k, v := range updated {
+		if !strings.HasPrefix(k, nix2container.NixStorePrefixAnnotation) || v == "" {
+			continue
+		}
+		if _, ok := existing[v]; !ok {
+			added[k] = v
+		}
+	}
+	return added
+}
+
 // Remove abandons the snapshot identified by key. The snapshot will
 // immediately become unavailable and unrecoverable. Disk space will
 // be freed up on the next call to `Cleanup`.
 func (o *nixSnapshotter) Remove(ctx context.Context, key string) (err error) {
+	// Pooled children would keep the snapshot from being removed.
+	if o.warmPool != nil {
+		o.warmPool.evict(ctx, key)
+	}
+
 	ctx, t, err := o.ms.TransactionContext(ctx, true)
 	if err != nil {
 		return err
 	}
+	defer o.inFlight.trackTransaction(InFlightTransaction{
+		Operation: "remove",
+		Key:       key,
+		Writable:  true,
+	})()
 	defer func() {
 		if err != nil {
 			if rerr := t.Rollback(); rerr != nil {
@@ -201,7 +557,7 @@ func (o *nixSnapshotter) Remove(ctx context.Context, key string) (err error) {
 		}
 	}()
 
-	_, _, err = storage.Remove(ctx, key)
+	id, _, err := storage.Remove(ctx, key)
 	if err != nil {
 		return fmt.Errorf("failed to remove: %w", err)
 	}
@@ -219,34 +575,105 @@ func (o *nixSnapshotter) Remove(ctx context.Context, key string) (err error) {
 		defer func() {
 			if err == nil {
 				for _, dir := range removals {
-					if err := os.RemoveAll(dir); err != nil {
-						log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to remove directory")
+					removedKey := ""
+					if filepath.Base(dir) == id {
+						removedKey = key
 					}
+					o.removeDirectory(ctx, dir, removedKey)
 				}
 			}
 		}()
 
 	}
 
-	return t.Commit()
+	err = t.Commit()
+	if err != nil {
+		return err
+	}
+
+	// The overlay snapshotter shares the metadata store, so its snapshots are
+	// removed above. Otherwise they are removed from the underlying
+	// snapshotter once their mirrored metadata is.
+	if o.mirror {
+		o.removeUnderlying(ctx, key)
+	}
+	if o.leaseRoots != nil {
+		o.leaseRoots.detach(ctx, id)
+	}
+	return nil
 }
 
 // Cleanup cleans up disk resources from removed or abandoned snapshots
 func (o *nixSnapshotter) Cleanup(ctx context.Context) error {
+	if o.mirror {
+		err := o.cleanupUnderlying(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if cleaner, ok := o.Snapshotter.(snapshots.Cleaner); ok && o.mirror {
+		err := cleaner.Cleanup(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
 	cleanup, err := o.cleanupDirectories(ctx)
 	if err != nil {
 		return err
 	}
 
 	for _, dir := range cleanup {
-		if err := os.RemoveAll(dir); err != nil {
-			log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to remove directory")
-		}
+		o.removeDirectory(ctx, dir, "")
 	}
 
 	return nil
 }
 
+// removeDirectory removes a directory returned by getCleanupDirectories. If
+// it is a directory of nix gc roots, an event is published for every gc root
+// removed. The key of the removed snapshot is included in events if known.
+func (o *nixSnapshotter) removeDirectory(ctx context.Context, dir, key string) {
+	var gcRoots []string
+	if o.isGCRootsDir(dir) {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to read nix gc roots")
+		}
+		for _, entry := range entries {
+			gcRoots = append(gcRoots, filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	// Resolve the gc roots before they are removed.
+	nixStorePaths := make([]string, len(gcRoots))
+	for i, gcRoot := range gcRoots {
+		nixStorePaths[i], _ = os.Readlink(gcRoot)
+	}
+
+	// Snapshots labelled with TmpfsSizeLabel are on a tmpfs.
+	if mounted, _ := isMountpoint(dir); mounted {
+		if err := mount.UnmountAll(dir, 0); err != nil {
+			log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to unmount tmpfs")
+			return
+		}
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to remove directory")
+		return
+	}
+
+	for i, gcRoot := range gcRoots {
+		publish(ctx, o.publisher, TopicGCRootRemoved, &GCRootRemoved{
+			Key:        key,
+			SnapshotID: filepath.Base(dir),
+			StorePath:  nixStorePaths[i],
+			GCRoot:     gcRoot,
+		})
+	}
+}
+
 func (o *nixSnapshotter) cleanupDirectories(ctx context.Context) ([]string, error) {
 	// Get a write transaction to ensure no other write transaction can be entered
 	// while the cleanup is scanning.
@@ -254,6 +681,10 @@ func (o *nixSnapshotter) cleanupDirectories(ctx context.Context) ([]string, erro
 	if err != nil {
 		return nil, err
 	}
+	defer o.inFlight.trackTransaction(InFlightTransaction{
+		Operation: "cleanup",
+		Writable:  true,
+	})()
 
 	defer func() {
 		err = t.Rollback()
@@ -264,40 +695,61 @@ func (o *nixSnapshotter) cleanupDirectories(ctx context.Context) ([]string, erro
 
 func (o *nixSnapshotter) getCleanupDirectories(ctx context.Context) ([]string, error) {
 	ids, err := storage.IDMap(ctx)
-	if err != nil {
+	if errdefs.IsNotFound(err) {
+		// The metadata store has no buckets until the first snapshot is created.
+		ids = make(map[string]string)
+	} else if err != nil {
 		return nil, err
 	}
 
-	snapshotDir := filepath.Join(o.root, "snapshots")
-	fd, err := os.Open(snapshotDir)
+	// Cleanup the snapshots of the overlay snapshotter, and the nix gc roots
+	// and nix databases of all removed snapshots.
+	parentDirs, err := o.gcRootsParentDirs()
 	if err != nil {
 		return nil, err
 	}
-	defer fd.Close()
-
-	dirs, err := fd.Readdirnames(0)
-	if err != nil {
-		return nil, err
+	parentDirs = append(parentDirs, filepath.Join(o.root, "nixstate"))
+	if !o.mirror {
+		parentDirs = append([]string{filepath.Join(o.root, "snapshots")}, parentDirs...)
 	}
 
 	cleanup := []string{}
-	gcRootsDir := filepath.Join(o.root, "gcroots")
-	for _, d := range dirs {
-		if _, ok := ids[d]; ok {
-			continue
+	for _, parentDir := range parentDirs {
+		dirs, err := readDirNames(parentDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range dirs {
+			if _, ok := ids[d]; ok {
+				continue
+			}
+			cleanup = append(cleanup, filepath.Join(parentDir, d))
 		}
-		// Cleanup the snapshot and its corresponding nix gc roots.
-		cleanup = append(cleanup, filepath.Join(snapshotDir, d))
-		cleanup = append(cleanup, filepath.Join(gcRootsDir, d))
 	}
 
 	return cleanup, nil
 }
 
+// readDirNames returns the names of the entries in dir, or none if it doesn't
+// exist.
+func readDirNames(dir string) ([]string, error) {
+	fd, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return fd.Readdirnames(0)
+}
+
 func (o *nixSnapshotter) convertToOverlayMountType(mounts []mount.Mount) []mount.Mount {
 	if o.fuse {
-		for _, mount := range mounts {
-			mount.Type = "fuse3.fuse-overlayfs"
+		for i := range mounts {
+			if mounts[i].Type == "overlay" {
+				mounts[i].Type = "fuse3.fuse-overlayfs"
+			}
 		}
 	}
 	return mounts
@@ -308,12 +760,96 @@ func (o *nixSnapshotter) withNixBindMounts(ctx context.Context, key string, moun
 	if err != nil {
 		return nil, err
 	}
+	defer o.inFlight.trackTransaction(InFlightTransaction{
+		Operation: "mounts",
+		Key:       key,
+		Writable:  false,
+	})()
 	defer func() {
 		err = t.Rollback()
 	}()
 
+	// Containers in a user namespace need their lowerdirs and nix store paths
+	// idmapped to be owned by the expected users.
+	id, info, _, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	idmapOpts, err := o.idMapOptions(info.Labels)
+	if err != nil {
+		return nil, err
+	}
+	if len(idmapOpts) > 0 {
+		if o.fuse {
+			return nil, fmt.Errorf("idmapped mounts are not supported with %s", MountBackendFuseOverlayfs)
+		}
+		for i := range mounts {
+			if mounts[i].Type == "overlay" {
+				mounts[i].Options = append(mounts[i].Options, idmapOpts...)
+			}
+		}
+	}
+
 	// Add a read only bind mount for every nix path required for the current
 	// snapshot and all its parents.
+	nixStorePaths, err := o.nixStorePaths(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	labelOpts, err := o.labelMountOptions(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	bindMountPolicy := o.namespacePolicy(ctx, key).BindMountPolicy
+
+	for _, nixStorePath := range nixStorePaths {
+		log.G(ctx).Debugf("[nix-snapshotter] Bind mounting nix store path %s", nixStorePath)
+		mounts = append(mounts, mount.Mount{
+			Type:    "bind",
+			Source:  filepath.Join(o.storeRoot, nixStorePath),
+			Target:  nixStorePath,
+			Options: append(bindMountPolicy.options(nixStorePath, labelOpts), idmapOpts...),
+		})
+	}
+
+	// Add a read only bind mount for every nix store path, or path under one,
+	// to mount at another target.
+	mountTargets, err := o.mountTargets(ctx, key, nixStorePaths)
+	if err != nil {
+		return nil, err
+	}
+	for _, mt := range mountTargets {
+		source, sourceStorePath, err := o.resolveMountSource(mt.source, nixStorePaths)
+		if err != nil {
+			return nil, err
+		}
+
+		log.G(ctx).Debugf("[nix-snapshotter] Bind mounting %s at %s", mt.source, mt.target)
+		mounts = append(mounts, mount.Mount{
+			Type:    "bind",
+			Source:  source,
+			Target:  mt.target,
+			Options: append(bindMountPolicy.options(sourceStorePath, labelOpts), idmapOpts...),
+		})
+	}
+
+	// Add a read write bind mount for the nix database of a writable nix store.
+	nixStateMount, err := o.nixStateMount(ctx, id, info)
+	if err != nil {
+		return nil, err
+	}
+	if nixStateMount != nil {
+		nixStateMount.Options = append(nixStateMount.Options, idmapOpts...)
+		mounts = append(mounts, *nixStateMount)
+	}
+	return mounts, nil
+}
+
+// nixStorePaths returns the nix store paths required by the snapshot
+// identified by key and all its parents, without duplicates. It must be called
+// within a transaction.
+func (o *nixSnapshotter) nixStorePaths(ctx context.Context, key string) ([]string, error) {
+	var nixStorePaths []string
 	pathsSeen := make(map[string]struct{})
 	for currentKey := key; currentKey != ""; {
 		_, info, _, err := storage.GetInfo(ctx, currentKey)
@@ -336,24 +872,14 @@ func (o *nixSnapshotter) withNixBindMounts(ctx context.Context, key string, moun
 			// Avoid duplicate mounts.
 			nixStorePath := info.Labels[labelKey]
 			_, ok := pathsSeen[nixStorePath]
-			if ok {
+			if ok || nixStorePath == "" {
 				continue
 			}
 			pathsSeen[nixStorePath] = struct{}{}
-
-			log.G(ctx).Debugf("[nix-snapshotter] Bind mounting nix store path %s", nixStorePath)
-			mounts = append(mounts, mount.Mount{
-				Type:   "bind",
-				Source: nixStorePath,
-				Target: nixStorePath,
-				Options: []string{
-					"ro",
-					"rbind",
-				},
-			})
+			nixStorePaths = append(nixStorePaths, nixStorePath)
 		}
 
 		currentKey = info.Parent
 	}
-	return mounts, nil
+	return nixStorePaths, nil
 }
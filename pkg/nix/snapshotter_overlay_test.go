@@ -17,6 +17,7 @@ import (
 	"github.com/containerd/containerd/mount"
 	"github.com/containerd/containerd/pkg/testutil"
 	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/native"
 	"github.com/containerd/containerd/snapshots/overlay"
 	"github.com/containerd/containerd/snapshots/overlay/overlayutils"
 	"github.com/containerd/containerd/snapshots/storage"
@@ -39,6 +40,11 @@ func TestNixSnapshotterWithSnaphotterSuite(t *testing.T) {
 			testsuite.SnapshotterSuite(t, "overlayfs", newSnapshotter)
 		})
 	}
+
+	t.Run("native", func(t *testing.T) {
+		newSnapshotter := newSnapshotterWithOpts(WithUnderlyingSnapshotter(native.NewSnapshotter))
+		testsuite.SnapshotterSuite(t, "native", newSnapshotter)
+	})
 }
 
 func TestSnapshotter(t *testing.T) {
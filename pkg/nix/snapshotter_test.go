@@ -2,12 +2,19 @@ package nix
 
 import (
 	"context"
+	"errors"
+	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/events"
 	"github.com/containerd/containerd/mount"
 	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/native"
 	"github.com/containerd/containerd/snapshots/storage"
 	"github.com/containerd/containerd/snapshots/testsuite"
 	"github.com/pdtpartners/nix-snapshotter/pkg/nix2container"
@@ -26,6 +33,13 @@ func newSnapshotterWithOpts(opts ...SnapshotterOpt) testsuite.SnapshotterFunc {
 	}
 }
 
+// underlyingTestCases are the options to test the nix snapshotter with each
+// kind of underlying snapshotter.
+var underlyingTestCases = map[string][]SnapshotterOpt{
+	"overlay": nil,
+	"native":  {WithUnderlyingSnapshotter(native.NewSnapshotter)},
+}
+
 type testCase struct {
 	name          string
 	nixStorePaths []string
@@ -85,27 +99,32 @@ func TestNixSnapshotter(t *testing.T) {
 			},
 		},
 	} {
-		t.Run(tc.name, func(t *testing.T) {
-			ctx := context.Background()
+		for name, opts := range underlyingTestCases {
+			t.Run(tc.name+"/"+name, func(t *testing.T) {
+				ctx := context.Background()
 
-			labels := map[string]string{}
-			for idx, value := range tc.nixStorePaths {
-				labels[nix2container.NixStorePrefixAnnotation+strconv.Itoa(idx)] = value
-			}
-			for idx, value := range tc.extraLabels {
-				labels[idx] = value
-			}
+				labels := map[string]string{}
+				for idx, value := range tc.nixStorePaths {
+					labels[nix2container.NixStorePrefixAnnotation+strconv.Itoa(idx)] = value
+				}
+				for idx, value := range tc.extraLabels {
+					labels[idx] = value
+				}
 
-			testBindMounts(ctx, t, tc, labels)
-			testGCRoots(ctx, t, tc, labels)
-		})
+				testBindMounts(ctx, t, tc, labels, opts...)
+				testGCRoots(ctx, t, tc, labels, opts...)
+			})
+		}
 	}
 }
 
-func testBindMounts(ctx context.Context, t *testing.T, tc testCase, labels map[string]string) {
+func testBindMounts(ctx context.Context, t *testing.T, tc testCase, labels map[string]string, opts ...SnapshotterOpt) {
 	key := "test"
 	root := t.TempDir()
-	snapshotterFunc := newSnapshotterWithOpts()
+	testBuilder := func(ctx context.Context, outLink, nixStorePath string) error {
+		return nil
+	}
+	snapshotterFunc := newSnapshotterWithOpts(append(opts, WithNixBuilder(testBuilder))...)
 	snapshotter, _, err := snapshotterFunc(ctx, root)
 	require.NoError(t, err)
 	s := snapshotter.(*nixSnapshotter)
@@ -132,7 +151,7 @@ func testBindMounts(ctx context.Context, t *testing.T, tc testCase, labels map[s
 	testutil.IsIdentical(t, mounts, expectedMounts)
 }
 
-func testGCRoots(ctx context.Context, t *testing.T, tc testCase, labels map[string]string) {
+func testGCRoots(ctx context.Context, t *testing.T, tc testCase, labels map[string]string, opts ...SnapshotterOpt) {
 	key := "test"
 	root := t.TempDir()
 
@@ -143,7 +162,7 @@ func testGCRoots(ctx context.Context, t *testing.T, tc testCase, labels map[stri
 		return nil
 	}
 
-	snapshotterFunc := newSnapshotterWithOpts(WithNixBuilder(testBuilder))
+	snapshotterFunc := newSnapshotterWithOpts(append(opts, WithNixBuilder(testBuilder))...)
 	snapshotter, _, err := snapshotterFunc(ctx, root)
 	require.NoError(t, err)
 	s := snapshotter.(*nixSnapshotter)
@@ -170,3 +189,698 @@ func testGCRoots(ctx context.Context, t *testing.T, tc testCase, labels map[stri
 		require.Equal(t, 0, len(outLinks))
 	}
 }
+
+type testPublisher struct {
+	topics []string
+	events []events.Event
+}
+
+func (p *testPublisher) Publish(ctx context.Context, topic string, event events.Event) error {
+	p.topics = append(p.topics, topic)
+	p.events = append(p.events, event)
+	return nil
+}
+
+func TestNixSnapshotterEvents(t *testing.T) {
+	ctx := context.Background()
+	key := "test"
+	root := t.TempDir()
+	nixStorePath := "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12.1"
+
+	testBuilder := func(ctx context.Context, outLink, nixStorePath string) error {
+		err := os.MkdirAll(filepath.Dir(outLink), 0o755)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(nixStorePath, outLink)
+	}
+
+	publisher := &testPublisher{}
+	snapshotterFunc := newSnapshotterWithOpts(
+		WithNixBuilder(testBuilder),
+		WithEventPublisher(publisher),
+	)
+	snapshotter, _, err := snapshotterFunc(ctx, root)
+	require.NoError(t, err)
+	s := snapshotter.(*nixSnapshotter)
+
+	labels := map[string]string{
+		nix2container.NixLayerAnnotation:             "true",
+		nix2container.NixStorePrefixAnnotation + "0": nixStorePath,
+	}
+	_, err = s.Prepare(ctx, key, "", snapshots.WithLabels(labels))
+	require.NoError(t, err)
+
+	var id string
+	err = s.ms.WithTransaction(ctx, false, func(ctx context.Context) (err error) {
+		id, _, _, err = storage.GetInfo(ctx, key)
+		return err
+	})
+	require.NoError(t, err)
+
+	err = s.Remove(ctx, key)
+	require.NoError(t, err)
+
+	testutil.IsIdentical(t, publisher.topics, []string{
+		TopicSubstituteStart,
+		TopicSubstituteDone,
+		TopicGCRootRemoved,
+	})
+	testutil.IsIdentical(t, publisher.events, []events.Event{
+		&SubstituteStart{Key: key, StorePath: nixStorePath},
+		&SubstituteDone{Key: key, StorePath: nixStorePath},
+		&GCRootRemoved{
+			Key:        key,
+			SnapshotID: id,
+			StorePath:  nixStorePath,
+			GCRoot:     filepath.Join(root, "gcroots", id, filepath.Base(nixStorePath)),
+		},
+	})
+}
+
+func TestNixSnapshotterDebugState(t *testing.T) {
+	ctx := context.Background()
+	key := "test"
+	root := t.TempDir()
+	nixStorePath := "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12.1"
+
+	building := make(chan struct{})
+	release := make(chan struct{})
+	testBuilder := func(ctx context.Context, outLink, nixStorePath string) error {
+		close(building)
+		<-release
+		return nil
+	}
+
+	snapshotterFunc := newSnapshotterWithOpts(WithNixBuilder(testBuilder))
+	snapshotter, _, err := snapshotterFunc(ctx, root)
+	require.NoError(t, err)
+	s := snapshotter.(*nixSnapshotter)
+
+	labels := map[string]string{
+		nix2container.NixLayerAnnotation:             "true",
+		nix2container.NixStorePrefixAnnotation + "0": nixStorePath,
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := s.Prepare(ctx, key, "", snapshots.WithLabels(labels))
+		errCh <- err
+	}()
+
+	<-building
+	state := s.DebugState()
+	require.Len(t, state.Builds, 1)
+	require.Equal(t, key, state.Builds[0].Key)
+	require.Equal(t, nixStorePath, state.Builds[0].StorePath)
+	require.Len(t, state.Transactions, 1)
+	require.Equal(t, "prepare", state.Transactions[0].Operation)
+
+	close(release)
+	require.NoError(t, <-errCh)
+
+	state = s.DebugState()
+	require.Empty(t, state.Builds)
+	require.Empty(t, state.Transactions)
+}
+
+func TestNixSnapshotterFuseOverlayfs(t *testing.T) {
+	ctx := context.Background()
+	sn, err := NewSnapshotter(t.TempDir(), WithFuseOverlayfs())
+	require.NoError(t, err)
+	defer sn.Close()
+
+	// A snapshot without a parent is a bind mount, so create a parent to get
+	// an overlay mount.
+	_, err = sn.Prepare(ctx, "parent-active", "")
+	require.NoError(t, err)
+	err = sn.Commit(ctx, "parent", "parent-active")
+	require.NoError(t, err)
+
+	mounts, err := sn.Prepare(ctx, "child", "parent")
+	require.NoError(t, err)
+	require.Len(t, mounts, 1)
+	require.Equal(t, "fuse3.fuse-overlayfs", mounts[0].Type)
+
+	mounts, err = sn.Mounts(ctx, "child")
+	require.NoError(t, err)
+	require.Equal(t, "fuse3.fuse-overlayfs", mounts[0].Type)
+}
+
+func TestNixSnapshotterIDMap(t *testing.T) {
+	ctx := context.Background()
+	sn, err := NewSnapshotter(t.TempDir(), WithIDMappedMounts())
+	require.NoError(t, err)
+	defer sn.Close()
+
+	nixStorePath := "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12.1"
+	_, err = sn.Prepare(ctx, "parent-active", "")
+	require.NoError(t, err)
+	err = sn.Commit(ctx, "parent", "parent-active", snapshots.WithLabels(map[string]string{
+		nix2container.NixStorePrefixAnnotation + "0": nixStorePath,
+	}))
+	require.NoError(t, err)
+
+	mounts, err := sn.Prepare(ctx, "child", "parent", snapshots.WithLabels(map[string]string{
+		snapshots.LabelSnapshotUIDMapping: "0:100000:65536",
+		snapshots.LabelSnapshotGIDMapping: "0:200000:65536",
+	}))
+	require.NoError(t, err)
+	require.Len(t, mounts, 2)
+	require.Equal(t, "overlay", mounts[0].Type)
+	require.Subset(t, mounts[0].Options, []string{"uidmap=0:100000:65536", "gidmap=0:200000:65536"})
+	require.Equal(t, mount.Mount{
+		Type:    "bind",
+		Source:  nixStorePath,
+		Target:  nixStorePath,
+		Options: []string{"ro", "rbind", "uidmap=0:100000:65536", "gidmap=0:200000:65536"},
+	}, mounts[1])
+
+	_, err = sn.Prepare(ctx, "invalid", "parent", snapshots.WithLabels(map[string]string{
+		snapshots.LabelSnapshotUIDMapping: "0:100000",
+		snapshots.LabelSnapshotGIDMapping: "0:200000:65536",
+	}))
+	require.Error(t, err)
+	_, err = sn.Stat(ctx, "invalid")
+	require.True(t, errdefs.IsNotFound(err))
+
+	// containerd 1.7 fails to mount idmapped snapshots, so they are rejected
+	// unless enabled.
+	disabled, err := NewSnapshotter(t.TempDir())
+	require.NoError(t, err)
+	defer disabled.Close()
+	_, err = disabled.Prepare(ctx, "child", "", snapshots.WithLabels(map[string]string{
+		snapshots.LabelSnapshotUIDMapping: "0:100000:65536",
+		snapshots.LabelSnapshotGIDMapping: "0:200000:65536",
+	}))
+	require.True(t, errdefs.IsNotImplemented(err))
+}
+
+func TestNixSnapshotterBindMountPolicy(t *testing.T) {
+	ctx := context.Background()
+	sn, err := NewSnapshotter(t.TempDir(), WithBindMountPolicy(BindMountPolicy{
+		Options:      []string{"nosuid"},
+		Propagation:  "rprivate",
+		NonRecursive: true,
+		Rules: []BindMountRule{{
+			Pattern: "/nix/store/*-glibc-*",
+			Options: []string{"nodev"},
+		}},
+	}))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	glibc := "/nix/store/4nlgxhb09sdr51nc9hdm8az5b08vzkgx-glibc-2.35-163"
+	hello := "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12.1"
+	_, err = sn.Prepare(ctx, "parent-active", "")
+	require.NoError(t, err)
+	err = sn.Commit(ctx, "parent", "parent-active", snapshots.WithLabels(map[string]string{
+		nix2container.NixStorePrefixAnnotation + "0": glibc,
+		nix2container.NixStorePrefixAnnotation + "1": hello,
+		nix2container.NixMountOptionsAnnotation:      "noexec",
+	}))
+	require.NoError(t, err)
+
+	mounts, err := sn.Prepare(ctx, "child", "parent")
+	require.NoError(t, err)
+	require.Len(t, mounts, 3)
+	require.Equal(t, []string{"ro", "bind", "nosuid", "nodev", "noexec", "rprivate"}, mounts[1].Options)
+	require.Equal(t, []string{"ro", "bind", "nosuid", "noexec", "rprivate"}, mounts[2].Options)
+
+	// Labels may only tighten the policy.
+	_, err = sn.Prepare(ctx, "loosened", "parent", snapshots.WithLabels(map[string]string{
+		nix2container.NixMountOptionsAnnotation: "suid",
+	}))
+	require.Error(t, err)
+}
+
+func TestNixSnapshotterCleanupEmpty(t *testing.T) {
+	sn, err := NewSnapshotter(t.TempDir())
+	require.NoError(t, err)
+	defer sn.Close()
+
+	err = sn.(snapshots.Cleaner).Cleanup(context.Background())
+	require.NoError(t, err)
+}
+
+func TestNixSnapshotterStoreRoot(t *testing.T) {
+	ctx := context.Background()
+	sn, err := NewSnapshotter(t.TempDir(), WithNixStoreRoot("/data/nix"))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	nixStorePath := "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12.1"
+	mounts, err := sn.Prepare(ctx, "active", "", snapshots.WithLabels(map[string]string{
+		nix2container.NixStorePrefixAnnotation + "0": nixStorePath,
+	}))
+	require.NoError(t, err)
+	require.Len(t, mounts, 2)
+	require.Equal(t, "/data/nix"+nixStorePath, mounts[1].Source)
+	require.Equal(t, nixStorePath, mounts[1].Target)
+}
+
+func TestNixSnapshotterUpdateInjectsNixStorePaths(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+
+	var built []string
+	testBuilder := func(ctx context.Context, outLink, nixStorePath string) error {
+		built = append(built, nixStorePath)
+		err := os.MkdirAll(filepath.Dir(outLink), 0o755)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(nixStorePath, outLink)
+	}
+
+	sn, err := NewSnapshotter(root, WithNixBuilder(testBuilder))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	hello := "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12.1"
+	strace := "/nix/store/0c4b1b2x8h6l8kq2fvy8gmwg3bl3pn8v-strace-6.3"
+	_, err = sn.Prepare(ctx, "active", "", snapshots.WithLabels(map[string]string{
+		nix2container.NixStorePrefixAnnotation + "0": hello,
+	}))
+	require.NoError(t, err)
+
+	label := nix2container.NixStorePrefixAnnotation + "1"
+	_, err = sn.Update(ctx, snapshots.Info{
+		Name:   "active",
+		Labels: map[string]string{label: strace},
+	}, "labels."+label)
+	require.NoError(t, err)
+	require.Equal(t, []string{strace}, built)
+
+	mounts, err := sn.Mounts(ctx, "active")
+	require.NoError(t, err)
+	require.Len(t, mounts, 3)
+	require.Equal(t, hello, mounts[1].Target)
+	require.Equal(t, strace, mounts[2].Target)
+
+	var id string
+	err = sn.(*nixSnapshotter).ms.WithTransaction(ctx, false, func(ctx context.Context) (err error) {
+		id, _, _, err = storage.GetInfo(ctx, "active")
+		return err
+	})
+	require.NoError(t, err)
+	target, err := os.Readlink(filepath.Join(root, "gcroots", id, filepath.Base(strace)))
+	require.NoError(t, err)
+	require.Equal(t, strace, target)
+
+	// Committed snapshots are shared by their children, so their nix store
+	// paths can't change.
+	err = sn.Commit(ctx, "committed", "active")
+	require.NoError(t, err)
+	_, err = sn.Update(ctx, snapshots.Info{
+		Name:   "committed",
+		Labels: map[string]string{label: strace},
+	}, "labels."+label)
+	require.True(t, errdefs.IsFailedPrecondition(err))
+}
+
+func TestNixSnapshotterFailingBuilder(t *testing.T) {
+	ctx := context.Background()
+	errBuild := errors.New("build failed")
+	sn, err := NewSnapshotter(t.TempDir(), WithNixBuilder(func(ctx context.Context, outLink, nixStorePath string) error {
+		return errBuild
+	}))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	hello := "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12.1"
+	_, err = sn.Prepare(ctx, "layer-active", "", snapshots.WithLabels(map[string]string{
+		nix2container.NixLayerAnnotation:             "true",
+		nix2container.NixStorePrefixAnnotation + "0": hello,
+	}))
+	require.ErrorIs(t, err, errBuild)
+
+	// Snapshots that failed to be prepared are removed.
+	_, err = sn.Stat(ctx, "layer-active")
+	require.ErrorIs(t, err, errdefs.ErrNotFound)
+
+	_, err = sn.Prepare(ctx, "active", "")
+	require.NoError(t, err)
+	label := nix2container.NixStorePrefixAnnotation + "0"
+	_, err = sn.Update(ctx, snapshots.Info{
+		Name:   "active",
+		Labels: map[string]string{label: hello},
+	}, "labels."+label)
+	require.ErrorIs(t, err, errBuild)
+
+	// The nix store path isn't recorded, since it was never realised.
+	info, err := sn.Stat(ctx, "active")
+	require.NoError(t, err)
+	require.NotContains(t, info.Labels, label)
+}
+
+func TestNixSnapshotterMountTargets(t *testing.T) {
+	ctx := context.Background()
+	storeRoot := t.TempDir()
+	sn, err := NewSnapshotter(t.TempDir(), WithNixStoreRoot(storeRoot))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	cacert := "/nix/store/8v1ajxq4ck6rbqg9bcf34gfbvbgzbsfj-nss-cacert-3.92"
+	escape := "/nix/store/0c4b1b2x8h6l8kq2fvy8gmwg3bl3pn8v-escape"
+	require.NoError(t, os.MkdirAll(filepath.Join(storeRoot, cacert, "etc", "ssl"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(storeRoot, escape), 0o755))
+	require.NoError(t, os.Symlink("/etc", filepath.Join(storeRoot, escape, "etc")))
+	// Symlinks to dependencies are absolute, and resolved within the store root.
+	require.NoError(t, os.Symlink(escape, filepath.Join(storeRoot, cacert, "etc", "escape")))
+
+	_, err = sn.Prepare(ctx, "parent-active", "")
+	require.NoError(t, err)
+	err = sn.Commit(ctx, "parent", "parent-active", snapshots.WithLabels(map[string]string{
+		nix2container.NixStorePrefixAnnotation + "0":       cacert,
+		nix2container.NixStorePrefixAnnotation + "1":       escape,
+		nix2container.NixMountTargetPrefixAnnotation + "0": cacert + "/etc/ssl:/etc/ssl",
+	}))
+	require.NoError(t, err)
+
+	mounts, err := sn.Prepare(ctx, "child", "parent")
+	require.NoError(t, err)
+	require.Len(t, mounts, 4)
+	require.Equal(t, mount.Mount{
+		Type:    "bind",
+		Source:  filepath.Join(storeRoot, cacert, "etc", "ssl"),
+		Target:  "/etc/ssl",
+		Options: []string{"ro", "rbind"},
+	}, mounts[3])
+
+	mounts, err = sn.Prepare(ctx, "dependency", "parent", snapshots.WithLabels(map[string]string{
+		nix2container.NixMountTargetPrefixAnnotation + "0": cacert + "/etc/escape:/opt",
+	}))
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(storeRoot, escape), mounts[len(mounts)-1].Source)
+
+	for name, target := range map[string]string{
+		"conflicting target":     escape + ":/etc/ssl",
+		"nested target":          cacert + "/etc/ssl:/etc/ssl/certs",
+		"store path target":      cacert + ":" + escape,
+		"source outside closure": "/nix/store/3a4b1b2x8h6l8kq2fvy8gmwg3bl3pn8v-other:/opt",
+		"symlink outside store":  escape + "/etc:/opt",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err = sn.Prepare(ctx, name, "parent", snapshots.WithLabels(map[string]string{
+				nix2container.NixMountTargetPrefixAnnotation + "0": target,
+			}))
+			require.Error(t, err)
+		})
+	}
+
+	_, err = sn.Prepare(ctx, "invalid", "parent", snapshots.WithLabels(map[string]string{
+		nix2container.NixMountTargetPrefixAnnotation + "0": "/opt",
+	}))
+	require.Error(t, err)
+
+	// Sibling targets that sort in between don't hide nesting.
+	_, err = sn.Prepare(ctx, "sibling", "parent", snapshots.WithLabels(map[string]string{
+		nix2container.NixMountTargetPrefixAnnotation + "1": cacert + "/etc/ssl:/etc/ssl-foo",
+	}))
+	require.NoError(t, err)
+	_, err = sn.Prepare(ctx, "nested under sibling", "parent", snapshots.WithLabels(map[string]string{
+		nix2container.NixMountTargetPrefixAnnotation + "1": cacert + "/etc/ssl:/etc/ssl-foo",
+		nix2container.NixMountTargetPrefixAnnotation + "2": cacert + "/etc/ssl:/etc/ssl/certs",
+	}))
+	require.Error(t, err)
+}
+
+func TestNixSnapshotterWritableStore(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+
+	registered := make(map[string][]string)
+	testDatabaseBuilder := func(ctx context.Context, root string, nixStorePaths []string) error {
+		registered[root] = nixStorePaths
+		return os.MkdirAll(filepath.Join(root, "nix", "var", "nix", "db"), 0o755)
+	}
+
+	testBuilder := func(ctx context.Context, outLink, nixStorePath string) error {
+		return nil
+	}
+
+	sn, err := NewSnapshotter(root,
+		WithNixBuilder(testBuilder),
+		WithNixDatabaseBuilder(testDatabaseBuilder),
+	)
+	require.NoError(t, err)
+	defer sn.Close()
+
+	hello := "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12.1"
+	labels := snapshots.WithLabels(map[string]string{
+		nix2container.NixLayerAnnotation:             "true",
+		nix2container.NixWritableStoreAnnotation:     "true",
+		nix2container.NixStorePrefixAnnotation + "0": hello,
+	})
+	_, err = sn.Prepare(ctx, "layer-active", "", labels)
+	require.NoError(t, err)
+	err = sn.Commit(ctx, "layer", "layer-active", labels)
+	require.NoError(t, err)
+	require.Empty(t, registered)
+
+	mounts, err := sn.Prepare(ctx, "active", "layer")
+	require.NoError(t, err)
+	require.Len(t, mounts, 3)
+	require.Equal(t, hello, mounts[1].Target)
+	require.Equal(t, "/nix/var/nix", mounts[2].Target)
+	require.Equal(t, []string{"rw", "rbind"}, mounts[2].Options)
+
+	nixStateRoot := filepath.Dir(filepath.Dir(filepath.Dir(mounts[2].Source)))
+	require.Equal(t, map[string][]string{nixStateRoot: {hello}}, registered)
+
+	// Views are read only, so they don't get a nix database.
+	mounts, err = sn.View(ctx, "view", "layer")
+	require.NoError(t, err)
+	require.Len(t, mounts, 2)
+
+	err = sn.Remove(ctx, "active")
+	require.NoError(t, err)
+	_, err = os.Stat(nixStateRoot)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestNixSnapshotterWritableStoreFailure(t *testing.T) {
+	ctx := context.Background()
+	errRegister := errors.New("register failed")
+	sn, err := NewSnapshotter(t.TempDir(),
+		WithNixBuilder(func(ctx context.Context, outLink, nixStorePath string) error {
+			return nil
+		}),
+		WithNixDatabaseBuilder(func(ctx context.Context, root string, nixStorePaths []string) error {
+			return errRegister
+		}),
+	)
+	require.NoError(t, err)
+	defer sn.Close()
+
+	labels := snapshots.WithLabels(map[string]string{
+		nix2container.NixLayerAnnotation:             "true",
+		nix2container.NixWritableStoreAnnotation:     "true",
+		nix2container.NixStorePrefixAnnotation + "0": "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12.1",
+	})
+	_, err = sn.Prepare(ctx, "layer-active", "", labels)
+	require.NoError(t, err)
+	err = sn.Commit(ctx, "layer", "layer-active", labels)
+	require.NoError(t, err)
+
+	_, err = sn.Prepare(ctx, "active", "layer")
+	require.ErrorIs(t, err, errRegister)
+	_, err = sn.Stat(ctx, "active")
+	require.ErrorIs(t, err, errdefs.ErrNotFound)
+}
+
+func TestNixSnapshotterWarmPool(t *testing.T) {
+	ctx := context.Background()
+	chainID := "sha256:7b8b1f6d5a0f5cda0ac0ae4ad5ddf2b0c87e68ef2c6f7e4e3b95a6f1c2d1d5e9"
+	sn, err := NewSnapshotter(t.TempDir(), WithWarmPool(WarmPoolPolicy{
+		Size:     1,
+		ChainIDs: []string{chainID},
+	}))
+	require.NoError(t, err)
+	defer sn.Close()
+	s := sn.(*nixSnapshotter)
+
+	pooled := func() []string {
+		var keys []string
+		err := s.Snapshotter.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+			if isWarmPoolKey(info.Name) {
+				keys = append(keys, info.Name)
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		return keys
+	}
+
+	// Committing the snapshot of a hot image starts pooling its children.
+	parent := "default/1/" + chainID
+	_, err = sn.Prepare(ctx, "extract", "")
+	require.NoError(t, err)
+	err = sn.Commit(ctx, parent, "extract")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(pooled()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	pooledKey := pooled()[0]
+
+	// Pooled snapshots are hidden from containerd.
+	err = sn.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		require.False(t, isWarmPoolKey(info.Name))
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Prepare hands out the pooled snapshot, and its directory, under the
+	// requested key.
+	upperdir := func(mounts []mount.Mount) string {
+		for _, option := range mounts[0].Options {
+			if strings.HasPrefix(option, "upperdir=") {
+				return strings.TrimPrefix(option, "upperdir=")
+			}
+		}
+		t.Fatalf("no upperdir in %v", mounts)
+		return ""
+	}
+	pooledMounts, err := sn.Mounts(ctx, pooledKey)
+	require.NoError(t, err)
+	pooledUpperdir := upperdir(pooledMounts)
+	err = os.WriteFile(filepath.Join(pooledUpperdir, "foo"), nil, 0o644)
+	require.NoError(t, err)
+	mounts, err := sn.Prepare(ctx, "container", parent)
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(upperdir(mounts), "foo"))
+	require.NoDirExists(t, filepath.Dir(pooledUpperdir))
+	info, err := sn.Stat(ctx, "container")
+	require.NoError(t, err)
+	require.Equal(t, parent, info.Parent)
+	_, err = sn.Stat(ctx, pooledKey)
+	require.True(t, errdefs.IsNotFound(err))
+
+	// The pool is replenished in the background.
+	require.Eventually(t, func() bool { return len(pooled()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// Pooled children don't keep the parent from being removed.
+	err = sn.Remove(ctx, "container")
+	require.NoError(t, err)
+	err = sn.Remove(ctx, parent)
+	require.NoError(t, err)
+	require.Empty(t, pooled())
+}
+
+func TestNixSnapshotterWarmPoolWritableStore(t *testing.T) {
+	ctx := context.Background()
+	chainID := "sha256:7b8b1f6d5a0f5cda0ac0ae4ad5ddf2b0c87e68ef2c6f7e4e3b95a6f1c2d1d5e9"
+	sn, err := NewSnapshotter(t.TempDir(),
+		WithNixBuilder(func(ctx context.Context, outLink, nixStorePath string) error {
+			return nil
+		}),
+		WithNixDatabaseBuilder(func(ctx context.Context, root string, nixStorePaths []string) error {
+			return os.MkdirAll(filepath.Join(root, "nix", "var", "nix", "db"), 0o755)
+		}),
+		WithWarmPool(WarmPoolPolicy{
+			Size:     1,
+			ChainIDs: []string{chainID},
+		}),
+	)
+	require.NoError(t, err)
+	defer sn.Close()
+	s := sn.(*nixSnapshotter)
+
+	pooled := func() []string {
+		var keys []string
+		err := s.Snapshotter.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+			if isWarmPoolKey(info.Name) {
+				keys = append(keys, info.Name)
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		return keys
+	}
+
+	labels := snapshots.WithLabels(map[string]string{
+		nix2container.NixLayerAnnotation:             "true",
+		nix2container.NixWritableStoreAnnotation:     "true",
+		nix2container.NixStorePrefixAnnotation + "0": "/nix/store/g2m8kfw7kpgpph05v2fxcx4d5an09hl3-hello-2.12.1",
+	})
+	parent := "default/1/" + chainID
+	_, err = sn.Prepare(ctx, "extract", "", labels)
+	require.NoError(t, err)
+	err = sn.Commit(ctx, parent, "extract", labels)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(pooled()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	pooledKey := pooled()[0]
+
+	pooledMounts, err := sn.Mounts(ctx, pooledKey)
+	require.NoError(t, err)
+	require.Len(t, pooledMounts, 3)
+	require.DirExists(t, pooledMounts[2].Source)
+
+	// The nix state of the pooled snapshot moves with it.
+	mounts, err := sn.Prepare(ctx, "container", parent)
+	require.NoError(t, err)
+	require.Len(t, mounts, 3)
+	require.Equal(t, nixStateTarget, mounts[2].Target)
+	require.DirExists(t, mounts[2].Source)
+	require.NotEqual(t, pooledMounts[2].Source, mounts[2].Source)
+	require.NoDirExists(t, pooledMounts[2].Source)
+
+	err = sn.Remove(ctx, "container")
+	require.NoError(t, err)
+	require.NoDirExists(t, mounts[2].Source)
+}
+
+// failingRemoveSnapshotter fails to remove snapshots while failRemove is set.
+type failingRemoveSnapshotter struct {
+	snapshots.Snapshotter
+	failRemove bool
+}
+
+func (s *failingRemoveSnapshotter) Remove(ctx context.Context, key string) error {
+	if s.failRemove {
+		return errors.New("remove failed")
+	}
+	return s.Snapshotter.Remove(ctx, key)
+}
+
+func TestNixSnapshotterUnderlyingRemove(t *testing.T) {
+	ctx := context.Background()
+	var underlying *failingRemoveSnapshotter
+	sn, err := NewSnapshotter(t.TempDir(), WithUnderlyingSnapshotter(func(root string) (snapshots.Snapshotter, error) {
+		native, err := native.NewSnapshotter(root)
+		if err != nil {
+			return nil, err
+		}
+		underlying = &failingRemoveSnapshotter{Snapshotter: native}
+		return underlying, nil
+	}))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	_, err = sn.Prepare(ctx, "parent-active", "")
+	require.NoError(t, err)
+	require.NoError(t, sn.Commit(ctx, "parent", "parent-active"))
+	_, err = sn.Prepare(ctx, "child", "parent")
+	require.NoError(t, err)
+
+	// Snapshots are removed once their metadata is, and left in the
+	// underlying snapshotter for Cleanup if they can't be removed from it.
+	underlying.failRemove = true
+	require.NoError(t, sn.Remove(ctx, "child"))
+	require.NoError(t, sn.Remove(ctx, "parent"))
+
+	var keys []string
+	err = sn.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		keys = append(keys, info.Name)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Empty(t, keys)
+	_, err = underlying.Stat(ctx, "child")
+	require.NoError(t, err)
+
+	underlying.failRemove = false
+	require.NoError(t, sn.(snapshots.Cleaner).Cleanup(ctx))
+	for _, key := range []string{"child", "parent"} {
+		_, err = underlying.Stat(ctx, key)
+		require.True(t, errdefs.IsNotFound(err), key)
+	}
+}
@@ -0,0 +1,136 @@
+package nix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"syscall"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+)
+
+// TmpfsSizeLabel is a snapshot label that backs the upperdir and workdir of an
+// active snapshot with a tmpfs of the given size, e.g. "512m", for containers
+// whose writes don't need to hit the disk. Such snapshots can't be committed,
+// as their contents would be lost with the tmpfs, and the label can't be
+// updated. It is under the "containerd.io/snapshot/" prefix so that containerd
+// passes it through to the snapshotter.
+const TmpfsSizeLabel = "containerd.io/snapshot/nix-tmpfs-size"
+
+// tmpfsSizeRegexp matches the sizes accepted by tmpfs, in bytes, with a k, m
+// or g suffix, or as a percentage of memory.
+var tmpfsSizeRegexp = regexp.MustCompile(`^[1-9][0-9]*[kmgKMG%]?$`)
+
+// validateTmpfsSizeLabel returns an error if the tmpfs size label in labels
+// is invalid or unsupported.
+func (o *nixSnapshotter) validateTmpfsSizeLabel(labels map[string]string) error {
+	size, ok := labels[TmpfsSizeLabel]
+	if !ok {
+		return nil
+	}
+	if !tmpfsSizeRegexp.MatchString(size) {
+		return fmt.Errorf("invalid %s label %q: expected a size such as 512m", TmpfsSizeLabel, size)
+	}
+	if o.mirror {
+		return errors.New("tmpfs-backed snapshots are only supported with the overlay snapshotter")
+	}
+	return nil
+}
+
+// checkCommitTmpfs returns an error if the active snapshot key is backed by a
+// tmpfs. The committed snapshot would be left on the tmpfs, and be empty once
+// it is unmounted, e.g. after a reboot.
+func (o *nixSnapshotter) checkCommitTmpfs(ctx context.Context, key string) error {
+	var info snapshots.Info
+	err := o.ms.WithTransaction(ctx, false, func(ctx context.Context) (err error) {
+		_, info, _, err = storage.GetInfo(ctx, key)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if _, ok := info.Labels[TmpfsSizeLabel]; ok {
+		return fmt.Errorf("tmpfs-backed snapshots can't be committed: %w", errdefs.ErrFailedPrecondition)
+	}
+	return nil
+}
+
+// prepareTmpfs mounts a tmpfs over the directory of the active snapshot key if
+// it is labelled with TmpfsSizeLabel and it isn't mounted already, e.g. after
+// a reboot. The upperdir and workdir are recreated empty on the tmpfs.
+func (o *nixSnapshotter) prepareTmpfs(ctx context.Context, key string) error {
+	var (
+		id   string
+		info snapshots.Info
+	)
+	err := o.ms.WithTransaction(ctx, false, func(ctx context.Context) (err error) {
+		id, info, _, err = storage.GetInfo(ctx, key)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	size, ok := info.Labels[TmpfsSizeLabel]
+	if !ok || info.Kind != snapshots.KindActive || o.mirror {
+		return nil
+	}
+
+	dir := filepath.Join(o.root, "snapshots", id)
+	mounted, err := isMountpoint(dir)
+	if err != nil || mounted {
+		return err
+	}
+
+	// Keep the ownership the overlay snapshotter gave the upperdir.
+	fi, err := os.Stat(filepath.Join(dir, "fs"))
+	if err != nil {
+		return err
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+
+	log.G(ctx).WithField("key", key).Debugf("[nix-snapshotter] Mounting tmpfs of size %s at %s", size, dir)
+	m := mount.Mount{
+		Type:    "tmpfs",
+		Source:  "tmpfs",
+		Options: []string{"size=" + size, "mode=0700"},
+	}
+	err = m.Mount(dir)
+	if err != nil {
+		return fmt.Errorf("failed to mount tmpfs: %w", err)
+	}
+
+	err = os.Mkdir(filepath.Join(dir, "fs"), fi.Mode().Perm())
+	if err == nil {
+		err = os.Lchown(filepath.Join(dir, "fs"), int(st.Uid), int(st.Gid))
+	}
+	if err == nil {
+		err = os.Mkdir(filepath.Join(dir, "work"), 0o711)
+	}
+	if err != nil {
+		if uerr := mount.UnmountAll(dir, 0); uerr != nil {
+			log.G(ctx).WithError(uerr).WithField("path", dir).Warn("failed to unmount tmpfs")
+		}
+		return err
+	}
+	return nil
+}
+
+// isMountpoint returns whether dir is on a different device from its parent.
+func isMountpoint(dir string) (bool, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return false, err
+	}
+	pfi, err := os.Stat(filepath.Dir(dir))
+	if err != nil {
+		return false, err
+	}
+	return fi.Sys().(*syscall.Stat_t).Dev != pfi.Sys().(*syscall.Stat_t).Dev, nil
+}
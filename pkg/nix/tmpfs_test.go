@@ -0,0 +1,138 @@
+package nix
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/pkg/testutil"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/native"
+	"github.com/pdtpartners/nix-snapshotter/pkg/nix2container"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTmpfsSizeLabelValidation(t *testing.T) {
+	ctx := context.Background()
+	sn, err := NewSnapshotter(t.TempDir())
+	require.NoError(t, err)
+	defer sn.Close()
+
+	_, err = sn.Prepare(ctx, "active", "", snapshots.WithLabels(map[string]string{
+		TmpfsSizeLabel: "lots",
+	}))
+	require.Error(t, err)
+
+	sn, err = NewSnapshotter(t.TempDir(), WithUnderlyingSnapshotter(native.NewSnapshotter))
+	require.NoError(t, err)
+	defer sn.Close()
+
+	_, err = sn.Prepare(ctx, "active", "", snapshots.WithLabels(map[string]string{
+		TmpfsSizeLabel: "16m",
+	}))
+	require.Error(t, err)
+}
+
+func TestNixSnapshotterUpdateValidatesLabels(t *testing.T) {
+	ctx := context.Background()
+	sn, err := NewSnapshotter(t.TempDir())
+	require.NoError(t, err)
+	defer sn.Close()
+
+	_, err = sn.Prepare(ctx, "active", "")
+	require.NoError(t, err)
+
+	// An existing upperdir can't move onto a tmpfs.
+	_, err = sn.Update(ctx, snapshots.Info{
+		Name:   "active",
+		Labels: map[string]string{TmpfsSizeLabel: "16m"},
+	}, "labels."+TmpfsSizeLabel)
+	require.ErrorIs(t, err, errdefs.ErrFailedPrecondition)
+
+	_, err = sn.Update(ctx, snapshots.Info{
+		Name:   "active",
+		Labels: map[string]string{nix2container.NixMountOptionsAnnotation: "rw"},
+	}, "labels."+nix2container.NixMountOptionsAnnotation)
+	require.Error(t, err)
+
+	info, err := sn.Stat(ctx, "active")
+	require.NoError(t, err)
+	require.Empty(t, info.Labels)
+}
+
+func TestNixSnapshotterTmpfs(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.Background()
+	root := t.TempDir()
+	sn, err := NewSnapshotter(root)
+	require.NoError(t, err)
+	defer sn.Close()
+
+	mounts, err := sn.Prepare(ctx, "active", "", snapshots.WithLabels(map[string]string{
+		TmpfsSizeLabel: "16m",
+	}))
+	require.NoError(t, err)
+	upperdir := mounts[0].Source
+	snapshotDir := filepath.Dir(upperdir)
+	mounted, err := isMountpoint(snapshotDir)
+	require.NoError(t, err)
+	require.True(t, mounted)
+
+	// Inspecting the mounts of a snapshot whose tmpfs is gone, e.g. after a
+	// reboot, doesn't mount it again, unlike Mounts.
+	testutil.Unmount(t, snapshotDir)
+	inspected, err := sn.(Inspector).InspectMounts(ctx, "active")
+	require.NoError(t, err)
+	require.Equal(t, mounts, inspected)
+	mounted, err = isMountpoint(snapshotDir)
+	require.NoError(t, err)
+	require.False(t, mounted)
+	_, err = sn.Mounts(ctx, "active")
+	require.NoError(t, err)
+	mounted, err = isMountpoint(snapshotDir)
+	require.NoError(t, err)
+	require.True(t, mounted)
+
+	err = os.WriteFile(filepath.Join(upperdir, "foo"), make([]byte, 4096), 0o644)
+	require.NoError(t, err)
+	usage, err := sn.Usage(ctx, "active")
+	require.NoError(t, err)
+	require.NotZero(t, usage.Size)
+
+	// The committed snapshot would be lost with the tmpfs.
+	err = sn.Commit(ctx, "committed", "active")
+	require.ErrorIs(t, err, errdefs.ErrFailedPrecondition)
+	err = sn.Remove(ctx, "active")
+	require.NoError(t, err)
+	_, err = os.Stat(snapshotDir)
+	require.True(t, os.IsNotExist(err))
+
+	// Children of committed snapshots are mounted with overlayfs, which needs
+	// the upperdir and workdir on the same tmpfs.
+	mounts, err = sn.Prepare(ctx, "layer-active", "")
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(mounts[0].Source, "foo"), make([]byte, 4096), 0o644)
+	require.NoError(t, err)
+	err = sn.Commit(ctx, "layer", "layer-active")
+	require.NoError(t, err)
+	mounts, err = sn.Prepare(ctx, "child", "layer", snapshots.WithLabels(map[string]string{
+		TmpfsSizeLabel: "16m",
+	}))
+	require.NoError(t, err)
+	target := t.TempDir()
+	err = mount.All(mounts, target)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(target, "foo"))
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(target, "bar"), nil, 0o644)
+	require.NoError(t, err)
+	testutil.Unmount(t, target)
+
+	err = sn.Remove(ctx, "child")
+	require.NoError(t, err)
+	err = sn.Remove(ctx, "layer")
+	require.NoError(t, err)
+}
@@ -0,0 +1,212 @@
+package nix
+
+import (
+	"context"
+	"errors"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/native"
+	"github.com/containerd/containerd/snapshots/storage"
+)
+
+// UnderlyingSnapshotterFunc creates the snapshotter wrapped by the nix
+// snapshotter, storing its snapshots under root.
+type UnderlyingSnapshotterFunc func(root string) (snapshots.Snapshotter, error)
+
+// UnderlyingSnapshotters are the underlying snapshotters selectable by name,
+// besides the default overlay snapshotter.
+var UnderlyingSnapshotters = map[string]UnderlyingSnapshotterFunc{
+	"native": native.NewSnapshotter,
+}
+
+// WithUnderlyingSnapshotter wraps the snapshotter created by fn instead of an
+// overlay snapshotter, e.g. a btrfs, zfs or lazy-pulling snapshotter. Its
+// snapshots are stored under "underlying" in the root dir, and their metadata
+// is mirrored in the nix snapshotter's own metadata store. Options specific to
+// the overlay snapshotter have no effect.
+func WithUnderlyingSnapshotter(fn UnderlyingSnapshotterFunc) SnapshotterOpt {
+	return snapshotterOptFn(func(sc *SnapshotterConfig) {
+		sc.underlying = fn
+	})
+}
+
+// mirrorSnapshot records a snapshot created by the underlying snapshotter in
+// the metadata store. If it can't be recorded, the snapshot is removed again.
+func (o *nixSnapshotter) mirrorSnapshot(ctx context.Context, kind snapshots.Kind, key, parent string, opts ...snapshots.Opt) error {
+	if !o.mirror {
+		return nil
+	}
+	err := o.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+		_, err := storage.CreateSnapshot(ctx, kind, key, parent, opts...)
+		return err
+	})
+	if err != nil {
+		if rerr := o.Snapshotter.Remove(ctx, key); rerr != nil {
+			log.G(ctx).WithError(rerr).WithField("key", key).Warn("failed to remove unrecorded snapshot")
+		}
+		return err
+	}
+	return nil
+}
+
+// Commit commits the active snapshot key as name.
+func (o *nixSnapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	err := o.checkCommitTmpfs(ctx, key)
+	if err != nil {
+		return err
+	}
+	o.mirrorMu.RLock()
+	err = o.Snapshotter.Commit(ctx, name, key, opts...)
+	if err == nil && o.mirror {
+		err = o.ms.WithTransaction(ctx, true, func(ctx context.Context) error {
+			_, err := storage.CommitActive(ctx, key, name, snapshots.Usage{}, opts...)
+			return err
+		})
+	}
+	o.mirrorMu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// Start pooling children of hot images as soon as they are unpacked.
+	if o.warmPool != nil {
+		o.warmPool.touch(name)
+	}
+
+	// Committed snapshots keep their gc roots until containerd removes them.
+	if o.leaseRoots != nil {
+		var id string
+		err = o.ms.WithTransaction(ctx, false, func(ctx context.Context) (err error) {
+			id, _, _, err = storage.GetInfo(ctx, name)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		o.leaseRoots.detach(ctx, id)
+	}
+	return nil
+}
+
+// removeUnderlying removes the snapshot key from the underlying snapshotter
+// after its mirrored metadata was removed. Failures are only logged, as the
+// snapshot is removed already, and Cleanup removes it from the underlying
+// snapshotter later.
+func (o *nixSnapshotter) removeUnderlying(ctx context.Context, key string) {
+	err := o.Snapshotter.Remove(ctx, key)
+	if err != nil && !errdefs.IsNotFound(err) {
+		log.G(ctx).WithError(err).WithField("key", key).Warn("failed to remove snapshot from underlying snapshotter, leaving it for cleanup")
+	}
+}
+
+// mirroredKeys returns the keys of the snapshots recorded in the metadata
+// store.
+func (o *nixSnapshotter) mirroredKeys(ctx context.Context) (map[string]struct{}, error) {
+	keys := make(map[string]struct{})
+	err := o.ms.WithTransaction(ctx, false, func(ctx context.Context) error {
+		ids, err := storage.IDMap(ctx)
+		if err != nil {
+			return err
+		}
+		for _, key := range ids {
+			keys[key] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil && !errdefs.IsNotFound(err) {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// cleanupUnderlying removes the snapshots of the underlying snapshotter whose
+// mirrored metadata was removed, but which failed to be removed themselves.
+func (o *nixSnapshotter) cleanupUnderlying(ctx context.Context) error {
+	o.mirrorMu.Lock()
+	defer o.mirrorMu.Unlock()
+
+	mirrored, err := o.mirroredKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Removed snapshots map to their parent.
+	removed := make(map[string]string)
+	err = o.Snapshotter.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if _, ok := mirrored[info.Name]; !ok {
+			removed[info.Name] = info.Parent
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Children must be removed before their parents.
+	for len(removed) > 0 {
+		parents := make(map[string]struct{})
+		for _, parent := range removed {
+			parents[parent] = struct{}{}
+		}
+		progress := false
+		for key := range removed {
+			if _, ok := parents[key]; ok {
+				continue
+			}
+			delete(removed, key)
+			err = o.Snapshotter.Remove(ctx, key)
+			if err != nil && !errdefs.IsNotFound(err) {
+				log.G(ctx).WithError(err).WithField("key", key).Warn("failed to remove snapshot from underlying snapshotter")
+				continue
+			}
+			progress = true
+		}
+		if !progress {
+			break
+		}
+	}
+	return nil
+}
+
+// Walk walks the snapshots of the underlying snapshotter, except for those in
+// the warm pool, and those already removed that are left for Cleanup.
+func (o *nixSnapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, filters ...string) error {
+	var mirrored map[string]struct{}
+	if o.mirror {
+		var err error
+		mirrored, err = o.mirroredKeys(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return o.Snapshotter.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if isWarmPoolKey(info.Name) {
+			return nil
+		}
+		if _, ok := mirrored[info.Name]; o.mirror && !ok {
+			return nil
+		}
+		return fn(ctx, info)
+	}, filters...)
+}
+
+// Close closes the underlying snapshotter and, unless it shares it, the
+// metadata store.
+func (o *nixSnapshotter) Close() error {
+	if o.warmPool != nil {
+		o.warmPool.close()
+	}
+	if o.scrubber != nil {
+		o.scrubber.close()
+	}
+	if o.leaseRoots != nil {
+		o.leaseRoots.close()
+	}
+	err := o.Snapshotter.Close()
+	if o.mirror {
+		err = errors.Join(err, o.ms.Close())
+	}
+	return err
+}
@@ -0,0 +1,350 @@
+package nix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+)
+
+// warmPoolKeyPrefix prefixes the keys of snapshots in the warm pool, which are
+// hidden from Walk so that containerd doesn't garbage collect them.
+const warmPoolKeyPrefix = "nix-snapshotter/warm-pool/"
+
+// WarmPoolPolicy configures a pool of active snapshots that are prepared ahead
+// of time on top of the snapshots of hot images, so that Prepare can hand one
+// out instead of preparing a new one.
+type WarmPoolPolicy struct {
+	// Size is the number of active snapshots kept ready per parent.
+	Size int
+
+	// ChainIDs are the chain IDs of the snapshots to pool children of, i.e.
+	// the chain ID of the top layer of each hot image.
+	ChainIDs []string
+
+	// IdleTimeout evicts the pooled snapshots of a parent after no matching
+	// Prepare for this long. Zero means never.
+	IdleTimeout time.Duration
+}
+
+// WithWarmPool keeps a pool of active snapshots as configured by policy. It is
+// only supported with the overlay snapshotter.
+func WithWarmPool(policy WarmPoolPolicy) SnapshotterOpt {
+	return snapshotterOptFn(func(sc *SnapshotterConfig) {
+		sc.warmPoolPolicy = policy
+	})
+}
+
+func isWarmPoolKey(key string) bool {
+	return strings.HasPrefix(key, warmPoolKeyPrefix)
+}
+
+// warmPool keeps active snapshots ready for the parents matching its policy.
+// Parents are pooled once seen by Prepare or Commit, and replenished in the
+// background.
+type warmPool struct {
+	sn       *nixSnapshotter
+	policy   WarmPoolPolicy
+	chainIDs map[string]struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	nextID  uint64
+	parents map[string]*warmPoolParent
+}
+
+type warmPoolParent struct {
+	ready    []string
+	filling  bool
+	lastUsed time.Time
+}
+
+func newWarmPool(sn *nixSnapshotter, policy WarmPoolPolicy) *warmPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &warmPool{
+		sn:       sn,
+		policy:   policy,
+		chainIDs: make(map[string]struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+		nextID:   uint64(time.Now().UnixNano()),
+		parents:  make(map[string]*warmPoolParent),
+	}
+	for _, chainID := range policy.ChainIDs {
+		p.chainIDs[chainID] = struct{}{}
+	}
+	if policy.IdleTimeout > 0 {
+		p.wg.Add(1)
+		go p.evictIdle()
+	}
+	return p
+}
+
+// matches returns whether children of parent are pooled. Parents are named by
+// containerd as "<namespace>/<id>/<chain ID>".
+func (p *warmPool) matches(parent string) bool {
+	if p.policy.Size <= 0 || parent == "" {
+		return false
+	}
+	_, ok := p.chainIDs[parent[strings.LastIndex(parent, "/")+1:]]
+	return ok
+}
+
+// take returns the key of a pooled snapshot of parent if there is one, and
+// starts replenishing the pool of parent. Only snapshots without labels are
+// handed out, as pooled snapshots are prepared without any.
+func (p *warmPool) take(parent string, labels map[string]string) (string, bool) {
+	if !p.matches(parent) {
+		return "", false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pp := p.parent(parent)
+	defer p.fill(parent, pp)
+
+	if len(labels) > 0 || len(pp.ready) == 0 {
+		return "", false
+	}
+	key := pp.ready[0]
+	pp.ready = pp.ready[1:]
+	return key, true
+}
+
+// touch starts filling the pool of parent if it matches.
+func (p *warmPool) touch(parent string) {
+	if !p.matches(parent) {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fill(parent, p.parent(parent))
+}
+
+// parent returns the pool of parent, marked as just used. It must be called
+// with the lock held.
+func (p *warmPool) parent(parent string) *warmPoolParent {
+	pp, ok := p.parents[parent]
+	if !ok {
+		pp = &warmPoolParent{}
+		p.parents[parent] = pp
+	}
+	pp.lastUsed = time.Now()
+	return pp
+}
+
+// fill replenishes the pool of parent in the background unless it is already
+// being replenished. It must be called with the lock held.
+func (p *warmPool) fill(parent string, pp *warmPoolParent) {
+	if pp.filling || p.ctx.Err() != nil {
+		return
+	}
+	pp.filling = true
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ctx := log.WithLogger(p.ctx, log.G(p.ctx).WithField("parent", parent))
+		for {
+			p.mu.Lock()
+			if p.ctx.Err() != nil || p.parents[parent] != pp || len(pp.ready) >= p.policy.Size {
+				pp.filling = false
+				p.mu.Unlock()
+				return
+			}
+			key := fmt.Sprintf("%s%d", warmPoolKeyPrefix, p.nextID)
+			p.nextID++
+			p.mu.Unlock()
+
+			_, err := p.sn.Prepare(ctx, key, parent)
+			if err != nil {
+				log.G(ctx).WithError(err).Warn("[nix-snapshotter] Failed to prepare snapshot for warm pool")
+				p.mu.Lock()
+				pp.filling = false
+				p.mu.Unlock()
+				return
+			}
+
+			p.mu.Lock()
+			evicted := p.parents[parent] != pp
+			if !evicted {
+				pp.ready = append(pp.ready, key)
+			}
+			p.mu.Unlock()
+			if evicted {
+				p.remove(ctx, key)
+			}
+		}
+	}()
+}
+
+// evict removes the pooled snapshots of parent.
+func (p *warmPool) evict(ctx context.Context, parent string) {
+	p.mu.Lock()
+	pp, ok := p.parents[parent]
+	if ok {
+		delete(p.parents, parent)
+	}
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	for _, key := range pp.ready {
+		p.remove(ctx, key)
+	}
+}
+
+func (p *warmPool) remove(ctx context.Context, key string) {
+	err := p.sn.Remove(ctx, key)
+	if err != nil && !errdefs.IsNotFound(err) {
+		log.G(ctx).WithError(err).WithField("key", key).Warn("[nix-snapshotter] Failed to remove snapshot from warm pool")
+	}
+}
+
+// evictIdle periodically evicts the pooled snapshots of parents that haven't
+// been used for the idle timeout.
+func (p *warmPool) evictIdle() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.policy.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var idle []string
+		p.mu.Lock()
+		for parent, pp := range p.parents {
+			if time.Since(pp.lastUsed) >= p.policy.IdleTimeout {
+				idle = append(idle, parent)
+			}
+		}
+		p.mu.Unlock()
+
+		for _, parent := range idle {
+			log.G(p.ctx).WithField("parent", parent).Info("[nix-snapshotter] Evicting idle warm pool")
+			p.evict(p.ctx, parent)
+		}
+	}
+}
+
+// removeStale removes pooled snapshots left behind by a previous run.
+func (p *warmPool) removeStale(ctx context.Context) error {
+	var stale []string
+	err := p.sn.Snapshotter.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if isWarmPoolKey(info.Name) {
+			stale = append(stale, info.Name)
+		}
+		return nil
+	})
+	if err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
+	for _, key := range stale {
+		p.remove(ctx, key)
+	}
+	return nil
+}
+
+// close stops replenishing pools and waits for in-flight Prepare calls. Pooled
+// snapshots are kept until the next run removes them.
+func (p *warmPool) close() {
+	p.cancel()
+	p.wg.Wait()
+}
+
+// adoptWarmPoolSnapshot hands out the pooled snapshot pooledKey as key and
+// returns its mounts. storage.MetaStore can't rename snapshots, so key is
+// created as a new active snapshot of the same parent, and the directories of
+// the pooled snapshot, including its nix state for writable nix stores, are
+// moved to those of key, as the overlay snapshotter does for the snapshots it
+// prepares.
+func (o *nixSnapshotter) adoptWarmPoolSnapshot(ctx context.Context, pooledKey, key string) ([]mount.Mount, error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	done := o.inFlight.trackTransaction(InFlightTransaction{
+		Operation: "prepare",
+		Key:       key,
+		Writable:  true,
+	})
+
+	// moved are the directories moved so far, as pairs of the pooled
+	// snapshot's directory and key's.
+	var moved [][2]string
+	moveBack := func() {
+		for i := len(moved) - 1; i >= 0; i-- {
+			if rerr := os.Rename(moved[i][1], moved[i][0]); rerr != nil {
+				log.G(ctx).WithError(rerr).WithField("path", moved[i][1]).Warn("failed to move back snapshot directory")
+			}
+		}
+	}
+	err = func() error {
+		_, info, _, err := storage.GetInfo(ctx, pooledKey)
+		if err != nil {
+			return err
+		}
+		if info.Kind != snapshots.KindActive {
+			return fmt.Errorf("snapshot %v is not active: %w", pooledKey, errdefs.ErrFailedPrecondition)
+		}
+		s, err := storage.CreateSnapshot(ctx, snapshots.KindActive, key, info.Parent)
+		if err != nil {
+			return err
+		}
+		pooledID, _, err := storage.Remove(ctx, pooledKey)
+		if err != nil {
+			return err
+		}
+
+		dirs := [][2]string{
+			{filepath.Join(o.root, "snapshots", pooledID), filepath.Join(o.root, "snapshots", s.ID)},
+		}
+		// Only snapshots with a writable nix store have nix state.
+		if _, err := os.Stat(o.nixStateRoot(pooledID)); err == nil {
+			dirs = append(dirs, [2]string{o.nixStateRoot(pooledID), o.nixStateRoot(s.ID)})
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		for _, dir := range dirs {
+			err = os.Rename(dir[0], dir[1])
+			if err != nil {
+				return err
+			}
+			moved = append(moved, dir)
+		}
+		return nil
+	}()
+	if err != nil {
+		moveBack()
+		if rerr := t.Rollback(); rerr != nil {
+			log.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
+		}
+	} else if err = t.Commit(); err != nil {
+		// Give the pooled snapshot its directories back.
+		moveBack()
+	}
+	done()
+	if err != nil {
+		return nil, err
+	}
+
+	log.G(ctx).WithField("key", key).Debug("[nix-snapshotter] Handed out snapshot from warm pool")
+	return o.Mounts(ctx, key)
+}
@@ -0,0 +1,177 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pdtpartners/nix-snapshotter/pkg/nix2container"
+)
+
+// nixStateTarget is where the nix state directory, containing the nix
+// database, is mounted in containers with a writable nix store.
+const nixStateTarget = "/nix/var/nix"
+
+// NixDatabaseBuilder creates a nix database in the chroot store at root, i.e.
+// at root/nix/var/nix/db, in which nixStorePaths are registered as valid. The
+// nix store paths themselves are not copied into root.
+type NixDatabaseBuilder func(ctx context.Context, root string, nixStorePaths []string) error
+
+// DefaultNixDatabaseBuilder is the NixDatabaseBuilder used unless overridden,
+// which copies the registration of nix store paths using nix-store.
+func DefaultNixDatabaseBuilder(ctx context.Context, root string, nixStorePaths []string) error {
+	return NewNixDatabaseBuilder()(ctx, root, nixStorePaths)
+}
+
+// NewNixDatabaseBuilder returns a NixDatabaseBuilder that dumps the
+// registration of nix store paths from the nix database with
+// `nix-store --dump-db` and loads it into the new one with
+// `nix-store --load-db`.
+func NewNixDatabaseBuilder(opts ...BuilderOpt) NixDatabaseBuilder {
+	bc := newBuilderConfig(opts)
+	return func(ctx context.Context, root string, nixStorePaths []string) error {
+		var dumpArgs []string
+		if bc.storeRoot != "" {
+			dumpArgs = append(dumpArgs, "--store", bc.storeRoot)
+		}
+		dumpArgs = append(dumpArgs, "--dump-db")
+		dumpArgs = append(dumpArgs, nixStorePaths...)
+
+		dump, cancel := bc.command(ctx, "nix-store", dumpArgs...)
+		defer cancel()
+
+		var registration, stderr bytes.Buffer
+		dump.Stdout = &registration
+		dump.Stderr = &stderr
+		log.G(ctx).Infof("[nix-snapshotter] Calling %s", strings.Join(dump.Args, " "))
+		err := dump.Run()
+		if err != nil {
+			log.G(ctx).
+				WithField("root", root).
+				Errorf("Failed to dump nix database: %s\n%s", err, stderr.String())
+			return err
+		}
+
+		load, cancel := bc.command(ctx, "nix-store", "--store", "local?root="+root, "--load-db")
+		defer cancel()
+
+		load.Stdin = &registration
+		log.G(ctx).Infof("[nix-snapshotter] Calling %s", strings.Join(load.Args, " "))
+		out, err := load.CombinedOutput()
+		if err != nil {
+			log.G(ctx).
+				WithField("root", root).
+				Errorf("Failed to load nix database: %s\n%s", err, string(out))
+		}
+		return err
+	}
+}
+
+// WithNixDatabaseBuilder is an option to override the default
+// NixDatabaseBuilder.
+func WithNixDatabaseBuilder(nixDatabaseBuilder NixDatabaseBuilder) SnapshotterOpt {
+	return snapshotterOptFn(func(sc *SnapshotterConfig) {
+		sc.nixDatabaseBuilder = nixDatabaseBuilder
+	})
+}
+
+// writableStore returns whether the snapshot key or any of its parents opted
+// into a writable nix store. It must be called within a transaction.
+func (o *nixSnapshotter) writableStore(ctx context.Context, key string) (bool, error) {
+	for currentKey := key; currentKey != ""; {
+		_, info, _, err := storage.GetInfo(ctx, currentKey)
+		if err != nil {
+			return false, err
+		}
+		if info.Labels[nix2container.NixWritableStoreAnnotation] == "true" {
+			return true, nil
+		}
+		currentKey = info.Parent
+	}
+	return false, nil
+}
+
+// nixStateRoot returns the chroot store holding the nix database of the
+// snapshot with id.
+func (o *nixSnapshotter) nixStateRoot(id string) string {
+	return filepath.Join(o.root, "nixstate", id)
+}
+
+// prepareNixDatabase registers the nix store paths of the active snapshot key
+// and all its parents in a nix database for the snapshot, if it opted into a
+// writable nix store.
+//
+// Nix store paths are bind mounted read only as usual, but /nix/store itself
+// is part of the container's writable rootfs, so nix inside the container can
+// add nix store paths on top of them and record them in its own database.
+func (o *nixSnapshotter) prepareNixDatabase(ctx context.Context, key string) (err error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer o.inFlight.trackTransaction(InFlightTransaction{
+		Operation: "prepare",
+		Key:       key,
+		Writable:  false,
+	})()
+	defer func() {
+		if rerr := t.Rollback(); err == nil {
+			err = rerr
+		}
+	}()
+
+	id, info, _, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		return err
+	}
+	writable, err := o.writableStore(ctx, key)
+	if err != nil || !writable {
+		return err
+	}
+	if info.Kind != snapshots.KindActive {
+		return nil
+	}
+
+	nixStorePaths, err := o.nixStorePaths(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	root := o.nixStateRoot(id)
+	log.G(ctx).Infof("[nix-snapshotter] Registering %d nix store paths in the nix database at %s", len(nixStorePaths), root)
+	done := o.inFlight.trackBuild(InFlightBuild{
+		Key:     key,
+		OutLink: root,
+	})
+	err = o.nixDatabaseBuilder(ctx, root, nixStorePaths)
+	done()
+	if err != nil {
+		return fmt.Errorf("failed to create nix database: %w", err)
+	}
+	return nil
+}
+
+// nixStateMount returns the mount of the nix state directory of the snapshot
+// with id and info, or nil if it doesn't have one. It must be called within a
+// transaction.
+func (o *nixSnapshotter) nixStateMount(ctx context.Context, id string, info snapshots.Info) (*mount.Mount, error) {
+	if info.Kind != snapshots.KindActive {
+		return nil, nil
+	}
+	writable, err := o.writableStore(ctx, info.Name)
+	if err != nil || !writable {
+		return nil, err
+	}
+	return &mount.Mount{
+		Type:    "bind",
+		Source:  filepath.Join(o.nixStateRoot(id), nixStateTarget),
+		Target:  nixStateTarget,
+		Options: []string{"rw", "rbind"},
+	}, nil
+}
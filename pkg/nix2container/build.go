@@ -16,7 +16,9 @@ type BuildOpt func(*BuildOpts)
 
 // BuildOpts contains options concerning how nix images are built.
 type BuildOpts struct {
-	FromImage string
+	FromImage        string
+	MountTargetsPath string
+	WritableStore    bool
 }
 
 // WithFromImage specifies a base image to build the image from.
@@ -26,6 +28,23 @@ func WithFromImage(fromImage string) BuildOpt {
 	}
 }
 
+// WithMountTargets specifies a JSON file mapping targets in the container to
+// the nix store paths, or paths under them, to mount there.
+func WithMountTargets(mountTargetsPath string) BuildOpt {
+	return func(o *BuildOpts) {
+		o.MountTargetsPath = mountTargetsPath
+	}
+}
+
+// WithWritableStore specifies that containers of the image need a nix
+// database with the image's closure registered, so that nix can be used
+// inside them.
+func WithWritableStore() BuildOpt {
+	return func(o *BuildOpts) {
+		o.WritableStore = true
+	}
+}
+
 // Build builds an image specification.
 func Build(ctx context.Context, configPath, closurePath, copyToRootPath string, opts ...BuildOpt) (*types.Image, error) {
 	var bOpts BuildOpts
@@ -34,9 +53,10 @@ func Build(ctx context.Context, configPath, closurePath, copyToRootPath string,
 	}
 
 	image := &types.Image{
-		Architecture: runtime.GOARCH,
-		OS:           runtime.GOOS,
-		BaseImage:    bOpts.FromImage,
+		Architecture:  runtime.GOARCH,
+		OS:            runtime.GOOS,
+		BaseImage:     bOpts.FromImage,
+		WritableStore: bOpts.WritableStore,
 	}
 	log.G(ctx).
 		WithField("arch", image.Architecture).
@@ -54,7 +74,9 @@ func Build(ctx context.Context, configPath, closurePath, copyToRootPath string,
 		return nil, err
 	}
 
-	image.NixStorePaths, err = readClosure(configPath, closurePath)
+	// The mount targets file references the store paths it maps, so it may be
+	// in the closure too.
+	image.NixStorePaths, err = readClosure(closurePath, configPath, bOpts.MountTargetsPath)
 	if err != nil {
 		return nil, err
 	}
@@ -72,10 +94,24 @@ func Build(ctx context.Context, configPath, closurePath, copyToRootPath string,
 		return nil, err
 	}
 
+	if bOpts.MountTargetsPath != "" {
+		dt, err = os.ReadFile(bOpts.MountTargetsPath)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(dt, &image.MountTargets)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return image, nil
 }
 
-func readClosure(configPath, closurePath string) ([]string, error) {
+// readClosure returns the nix store paths in the closure file, except for the
+// excluded ones.
+func readClosure(closurePath string, excluded ...string) ([]string, error) {
 	f, err := os.Open(closurePath)
 	if err != nil {
 		return nil, err
@@ -86,7 +122,7 @@ func readClosure(configPath, closurePath string) ([]string, error) {
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		nixStorePath := scanner.Text()
-		if nixStorePath == configPath {
+		if contains(excluded, nixStorePath) {
 			continue
 		}
 		nixStorePaths = append(nixStorePaths, nixStorePath)
@@ -97,3 +133,12 @@ func readClosure(configPath, closurePath string) ([]string, error) {
 
 	return nixStorePaths, nil
 }
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
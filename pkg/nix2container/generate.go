@@ -11,6 +11,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -36,8 +37,27 @@ const (
 	// NixStorePrefixAnnotation is a prefix for remote snapshot OCI annotations
 	// for each nix store path that the layer will need.
 	NixStorePrefixAnnotation = "containerd.io/snapshot/nix-store-path."
+
+	// NixMountOptionsAnnotation is a remote snapshot OCI annotation with comma
+	// separated options such as "nosuid,nodev" to add to the bind mounts of
+	// nix store paths. It may only tighten the snapshotter's mount policy.
+	NixMountOptionsAnnotation = "containerd.io/snapshot/nix-mount-options"
+
+	// NixMountTargetPrefixAnnotation is a prefix for remote snapshot OCI
+	// annotations for each nix store path, or path under one, to also mount
+	// at another target. Values are of the form "<source>:<target>".
+	NixMountTargetPrefixAnnotation = "containerd.io/snapshot/nix-mount-target."
+
+	// NixWritableStoreAnnotation is a remote snapshot OCI annotation to
+	// indicate that containers need a nix database with the image's nix store
+	// paths registered, so that nix can be used inside them.
+	NixWritableStoreAnnotation = "containerd.io/snapshot/nix-writable-store"
 )
 
+// nixStateDir is the nix state directory in containers, which holds the nix
+// database of images with a writable nix store.
+const nixStateDir = "/nix/var/nix"
+
 // TempDir returns the location of a temporary dir or XDG_RUNTIME_DIR if it is
 // defined.
 func TempDir() string {
@@ -62,7 +82,7 @@ func Generate(ctx context.Context, image *types.Image, store content.Store) (des
 
 	// Generate and add layer to store.
 	buf := new(bytes.Buffer)
-	diffID, err := writeNixClosureLayer(ctx, buf, image.NixStorePaths, image.CopyToRoots)
+	diffID, err := writeNixClosureLayer(ctx, buf, image.NixStorePaths, image.CopyToRoots, image.MountTargets, image.WritableStore)
 	if err != nil {
 		return
 	}
@@ -81,6 +101,13 @@ func Generate(ctx context.Context, image *types.Image, store content.Store) (des
 		key := NixStorePrefixAnnotation + strconv.Itoa(i)
 		layerDesc.Annotations[key] = nixStorePath
 	}
+	for i, target := range sortedMountTargets(image.MountTargets) {
+		key := NixMountTargetPrefixAnnotation + strconv.Itoa(i)
+		layerDesc.Annotations[key] = image.MountTargets[target] + ":" + target
+	}
+	if image.WritableStore {
+		layerDesc.Annotations[NixWritableStoreAnnotation] = "true"
+	}
 	mfst.Layers = append(mfst.Layers, layerDesc)
 
 	// Add manifest config to store.
@@ -238,7 +265,11 @@ func parseOCITarball(ctx context.Context, store content.Store, tarballPath strin
 // Each store path in copyToRoots will also be walked to generate symlinks
 // relative to root. Note that these symlinks will be broken until the
 // containerd-shim finally mounts what nix-snapshotter has generated.
-func writeNixClosureLayer(ctx context.Context, w io.Writer, nixStorePaths, copyToRoots []string) (digest.Digest, error) {
+//
+// A mountpoint is also created for every target in mountTargets, which maps
+// targets to the store paths to mount there, and for the nix state directory
+// if writableStore is set.
+func writeNixClosureLayer(ctx context.Context, w io.Writer, nixStorePaths, copyToRoots []string, mountTargets map[string]string, writableStore bool) (digest.Digest, error) {
 	root, err := os.MkdirTemp(TempDir(), "nix2container-closure")
 	if err != nil {
 		return "", fmt.Errorf("failed to create temp dir: %w", err)
@@ -268,6 +299,13 @@ func writeNixClosureLayer(ctx context.Context, w io.Writer, nixStorePaths, copyT
 
 	}
 
+	if writableStore {
+		err = os.MkdirAll(filepath.Join(root, nixStateDir), 0o755)
+		if err != nil {
+			return "", err
+		}
+	}
+
 	// For each copyToRoot, walk the store path locally and create a symlink for
 	// each file from the store path to a path relative to the rootfs' root.
 	//
@@ -296,9 +334,57 @@ func writeNixClosureLayer(ctx context.Context, w io.Writer, nixStorePaths, copyT
 			return "", err
 		}
 	}
+
+	// Create mountpoints for mount targets. Sorting puts a target before any
+	// targets nested under it, though not necessarily right before, e.g.
+	// "/etc/ssl-foo" sorts between "/etc/ssl" and "/etc/ssl/certs".
+	targets := sortedMountTargets(mountTargets)
+	for i, target := range targets {
+		source := mountTargets[target]
+		if !filepath.IsAbs(target) || filepath.Clean(target) == "/" {
+			return "", fmt.Errorf("mount target %q must be an absolute path other than /", target)
+		}
+		for _, earlier := range targets[:i] {
+			if strings.HasPrefix(target, earlier+"/") {
+				return "", fmt.Errorf("mount target %q is nested under mount target %q", target, earlier)
+			}
+		}
+
+		fi, err := os.Stat(source)
+		if err != nil {
+			return "", err
+		}
+
+		rootPath := filepath.Join(root, target)
+		if _, err := os.Lstat(rootPath); err == nil {
+			return "", fmt.Errorf("mount target %q conflicts with an existing path in the layer", target)
+		}
+		if fi.IsDir() {
+			err = os.MkdirAll(rootPath, 0o755)
+		} else {
+			err = os.MkdirAll(filepath.Dir(rootPath), 0o755)
+			if err != nil {
+				return "", err
+			}
+			err = os.WriteFile(rootPath, nil, 0o555)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
 	return tarDir(ctx, w, root, true)
 }
 
+// sortedMountTargets returns the targets of mountTargets in lexical order.
+func sortedMountTargets(mountTargets map[string]string) []string {
+	targets := make([]string, 0, len(mountTargets))
+	for target := range mountTargets {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
 func tarDir(ctx context.Context, w io.Writer, root string, gzip bool) (digest.Digest, error) {
 	if gzip {
 		compressed, err := compression.CompressStream(w, compression.Gzip)
@@ -246,7 +246,7 @@ func TestWriteNixClosureLayer(t *testing.T) {
 			}
 
 			buf := new(bytes.Buffer)
-			_, err := writeNixClosureLayer(ctx, buf, tc.storePaths, tc.copyToRoots)
+			_, err := writeNixClosureLayer(ctx, buf, tc.storePaths, tc.copyToRoots, nil, false)
 			require.NoError(t, err)
 
 			// Convert Tar to file system
@@ -313,3 +313,51 @@ func newMapFSFromTar(tarBytes []byte) (fstest.MapFS, error) {
 
 	return files, nil
 }
+
+func TestWriteNixClosureLayerMountTargets(t *testing.T) {
+	ctx := context.Background()
+	testDir := t.TempDir()
+	storePath := filepath.Join(testDir, "nss-cacert")
+	require.NoError(t, os.MkdirAll(filepath.Join(storePath, "etc", "ssl"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(storePath, "ca-bundle.crt"), nil, 0o444))
+
+	buf := new(bytes.Buffer)
+	_, err := writeNixClosureLayer(ctx, buf, []string{storePath}, nil, map[string]string{
+		"/etc/ssl":                         filepath.Join(storePath, "etc", "ssl"),
+		"/etc/pki/tls/certs/ca-bundle.crt": filepath.Join(storePath, "ca-bundle.crt"),
+	}, false)
+	require.NoError(t, err)
+
+	tempFs, err := newMapFSFromTar(buf.Bytes())
+	require.NoError(t, err)
+	require.Contains(t, tempFs, "etc/ssl/")
+	require.Contains(t, tempFs, "etc/pki/tls/certs/ca-bundle.crt")
+
+	_, err = writeNixClosureLayer(ctx, new(bytes.Buffer), []string{storePath}, nil, map[string]string{
+		"/etc/ssl":       filepath.Join(storePath, "etc", "ssl"),
+		"/etc/ssl/certs": filepath.Join(storePath, "etc", "ssl"),
+	}, false)
+	require.Error(t, err)
+
+	// Sibling targets that sort in between don't hide nesting.
+	_, err = writeNixClosureLayer(ctx, new(bytes.Buffer), []string{storePath}, nil, map[string]string{
+		"/etc/ssl":       filepath.Join(storePath, "etc", "ssl"),
+		"/etc/ssl-foo":   filepath.Join(storePath, "etc", "ssl"),
+		"/etc/ssl/certs": filepath.Join(storePath, "etc", "ssl"),
+	}, false)
+	require.Error(t, err)
+}
+
+func TestWriteNixClosureLayerWritableStore(t *testing.T) {
+	ctx := context.Background()
+	storePath := filepath.Join(t.TempDir(), "hello")
+	require.NoError(t, os.MkdirAll(storePath, 0o755))
+
+	buf := new(bytes.Buffer)
+	_, err := writeNixClosureLayer(ctx, buf, []string{storePath}, nil, nil, true)
+	require.NoError(t, err)
+
+	tempFs, err := newMapFSFromTar(buf.Bytes())
+	require.NoError(t, err)
+	require.Contains(t, tempFs, "nix/var/nix/")
+}
@@ -2,15 +2,14 @@ package plugin
 
 import (
 	"errors"
-	"net"
-	"os"
-	"path/filepath"
 
+	"github.com/containerd/containerd/events"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/plugin"
 	"github.com/pdtpartners/nix-snapshotter/pkg/config"
 	"github.com/pdtpartners/nix-snapshotter/pkg/nix"
+	"github.com/pdtpartners/nix-snapshotter/pkg/socket"
 	"google.golang.org/grpc"
 	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
 )
@@ -20,6 +19,9 @@ func init() {
 		Type:   plugin.SnapshotPlugin,
 		ID:     "nix",
 		Config: &config.Config{},
+		Requires: []plugin.Type{
+			plugin.EventPlugin,
+		},
 		InitFn: func(ic *plugin.InitContext) (interface{}, error) {
 			ic.Meta.Platforms = append(ic.Meta.Platforms, platforms.DefaultSpec())
 
@@ -33,6 +35,24 @@ func init() {
 				root = cfg.Root
 			}
 
+			imageServiceOpts := nix.ImageServiceOptsFromConfig(cfg)
+			snapshotterOpts := nix.SnapshotterOptsFromConfig(cfg)
+			if cfg.Events.Enable {
+				// Running in-process, so events can be published to containerd's
+				// exchange directly.
+				ep, err := ic.GetByID(plugin.EventPlugin, "exchange")
+				if err != nil {
+					return nil, err
+				}
+				publisher, ok := ep.(events.Publisher)
+				if !ok {
+					return nil, errors.New("invalid event exchange")
+				}
+				opt := nix.WithEventPublisher(publisher)
+				imageServiceOpts = append(imageServiceOpts, opt)
+				snapshotterOpts = append(snapshotterOpts, opt)
+			}
+
 			if cfg.ImageService.Enable {
 				criAddr := ic.Address
 				if containerdAddr := cfg.ImageService.ContainerdAddress; containerdAddr != "" {
@@ -43,7 +63,7 @@ func init() {
 				}
 
 				ctx := ic.Context
-				imageService, err := nix.NewImageService(ctx, criAddr)
+				imageService, err := nix.NewImageService(ctx, criAddr, imageServiceOpts...)
 				if err != nil {
 					return nil, err
 				}
@@ -51,19 +71,7 @@ func init() {
 				rpc := grpc.NewServer()
 				runtime.RegisterImageServiceServer(rpc, imageService)
 
-				// Prepare the directory for the socket.
-				err = os.MkdirAll(filepath.Dir(cfg.Address), 0o700)
-				if err != nil {
-					return nil, err
-				}
-
-				// Try to remove the socket file to avoid EADDRINUSE.
-				err = os.RemoveAll(cfg.Address)
-				if err != nil {
-					return nil, err
-				}
-
-				l, err := net.Listen("unix", cfg.Address)
+				l, err := socket.Listen(cfg.Address, cfg.Socket)
 				if err != nil {
 					return nil, err
 				}
@@ -78,11 +86,6 @@ func init() {
 
 			ic.Meta.Exports["root"] = root
 
-			var snapshotterOpts []nix.SnapshotterOpt
-			if cfg.ExternalBuilder != "" {
-				snapshotterOpts = append(snapshotterOpts, nix.WithNixBuilder(nix.NewExternalBuilder(cfg.ExternalBuilder)))
-			}
-
 			return nix.NewSnapshotter(root, snapshotterOpts...)
 		},
 	})
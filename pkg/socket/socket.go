@@ -0,0 +1,108 @@
+// Package socket provides the unix socket listeners nix-snapshotter serves
+// gRPC on.
+package socket
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/pdtpartners/nix-snapshotter/pkg/config"
+)
+
+var (
+	activationOnce      sync.Once
+	activationListeners map[string]net.Listener
+	activationErr       error
+)
+
+// ActivationListener returns the listener for address passed by systemd
+// socket activation, or nil if there isn't one.
+func ActivationListener(address string) (net.Listener, error) {
+	activationOnce.Do(func() {
+		// Listeners unsets LISTEN_FDS, so it can only be called once.
+		var listeners []net.Listener
+		listeners, activationErr = activation.Listeners()
+		activationListeners = make(map[string]net.Listener)
+		for _, l := range listeners {
+			if l != nil {
+				activationListeners[l.Addr().String()] = l
+			}
+		}
+	})
+	if activationErr != nil {
+		return nil, fmt.Errorf("failed to get socket activation listeners: %w", activationErr)
+	}
+	return activationListeners[address], nil
+}
+
+// Listen creates a unix socket at address, owned as configured by cfg.
+func Listen(address string, cfg config.SocketConfig) (net.Listener, error) {
+	mode, err := cfg.FileMode()
+	if err != nil {
+		return nil, err
+	}
+
+	gid := -1
+	if cfg.Group != "" {
+		gid, err = lookupGroup(cfg.Group)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Prepare the directory for the socket. If the socket is accessible by
+	// others, they also need to be able to traverse its directory.
+	dirMode := os.FileMode(0o700)
+	if mode&0o077 != 0 {
+		dirMode = 0o711
+	}
+	err = os.MkdirAll(filepath.Dir(address), dirMode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory %q: %w", filepath.Dir(address), err)
+	}
+
+	// Try to remove the socket file to avoid EADDRINUSE.
+	err = os.RemoveAll(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove %q: %w", address, err)
+	}
+
+	l, err := net.Listen("unix", address)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode != 0 {
+		err = os.Chmod(address, mode)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to change mode of %q: %w", address, err)
+		}
+	}
+	if gid != -1 {
+		err = os.Chown(address, -1, gid)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to change group of %q: %w", address, err)
+		}
+	}
+	return l, nil
+}
+
+// lookupGroup returns the ID of a group given its name or ID.
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
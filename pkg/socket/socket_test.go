@@ -0,0 +1,40 @@
+package socket
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/pdtpartners/nix-snapshotter/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListen(t *testing.T) {
+	address := filepath.Join(t.TempDir(), "run", "nix-snapshotter.sock")
+	gid := os.Getgid()
+
+	l, err := Listen(address, config.SocketConfig{
+		Mode:  "0660",
+		Group: strconv.Itoa(gid),
+	})
+	require.NoError(t, err)
+	defer l.Close()
+
+	fi, err := os.Stat(address)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o660), fi.Mode().Perm())
+	require.Equal(t, uint32(gid), fi.Sys().(*syscall.Stat_t).Gid)
+
+	// Others need to traverse the directory to reach the socket.
+	fi, err = os.Stat(filepath.Dir(address))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o711), fi.Mode().Perm())
+}
+
+func TestListenInvalidMode(t *testing.T) {
+	address := filepath.Join(t.TempDir(), "nix-snapshotter.sock")
+	_, err := Listen(address, config.SocketConfig{Mode: "rw-rw----"})
+	require.Error(t, err)
+}
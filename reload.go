@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pdtpartners/nix-snapshotter/pkg/config"
+	"github.com/pdtpartners/nix-snapshotter/pkg/nix"
+	"github.com/sirupsen/logrus"
+)
+
+// liveState holds the settings of a running daemon that can be reloaded.
+type liveState struct {
+	cfg *config.Config
+
+	// builders are those of each snapshotter, keyed by instance name, or
+	// empty for the daemon's own snapshotter, as instances may override
+	// builder and store settings.
+	builders map[string]*liveBuilders
+}
+
+// liveBuilders are the functions a snapshotter runs nix commands with, which
+// are configured by the reloadable builder settings.
+type liveBuilders struct {
+	nixBuilder         nix.NixBuilder
+	nixDatabaseBuilder nix.NixDatabaseBuilder
+	nixVerifier        nix.NixVerifier
+}
+
+func newLiveBuilders(cfg *config.Config) *liveBuilders {
+	opts := nix.BuilderOptsFromConfig(cfg)
+	return &liveBuilders{
+		nixBuilder:         nix.NewNixBuilderFromConfig(cfg),
+		nixDatabaseBuilder: nix.NewNixDatabaseBuilder(opts...),
+		nixVerifier:        nix.NewNixStoreVerifier(opts...),
+	}
+}
+
+// liveConfig provides the current settings of a running daemon, swapping
+// them atomically on reload so that an operation never sees a mix of old and
+// new settings.
+type liveConfig struct {
+	state atomic.Pointer[liveState]
+
+	// policyReloaders are the snapshotters whose policies are reloaded, keyed
+	// by instance name, or empty for the daemon's own snapshotter. They are
+	// only added before the daemon serves requests.
+	policyReloaders map[string]nix.PolicyReloader
+}
+
+func newLiveConfig(cfg *config.Config) (*liveConfig, error) {
+	state, err := newLiveState(cfg)
+	if err != nil {
+		return nil, err
+	}
+	l := &liveConfig{policyReloaders: make(map[string]nix.PolicyReloader)}
+	l.state.Store(state)
+	return l, nil
+}
+
+func newLiveState(cfg *config.Config) (*liveState, error) {
+	state := &liveState{
+		cfg:      cfg,
+		builders: map[string]*liveBuilders{"": newLiveBuilders(cfg)},
+	}
+	for _, name := range instanceNames(cfg) {
+		instanceCfg, err := cfg.Instance(name)
+		if err != nil {
+			return nil, err
+		}
+		state.builders[name] = newLiveBuilders(instanceCfg)
+	}
+	return state, nil
+}
+
+// config returns the current config. Only hot reloadable settings may differ
+// from the config the daemon was started with.
+func (l *liveConfig) config() *config.Config {
+	return l.state.Load().cfg
+}
+
+// nixBuilder returns a nix.NixBuilder that delegates to the current builder
+// of instance name, or of the daemon's own snapshotter for an empty name.
+func (l *liveConfig) nixBuilder(name string) nix.NixBuilder {
+	return func(ctx context.Context, outLink, nixStorePath string) error {
+		return l.state.Load().builders[name].nixBuilder(ctx, outLink, nixStorePath)
+	}
+}
+
+// nixDatabaseBuilder returns a nix.NixDatabaseBuilder that delegates to the
+// current one of instance name, or of the daemon's own snapshotter for an
+// empty name.
+func (l *liveConfig) nixDatabaseBuilder(name string) nix.NixDatabaseBuilder {
+	return func(ctx context.Context, root string, nixStorePaths []string) error {
+		return l.state.Load().builders[name].nixDatabaseBuilder(ctx, root, nixStorePaths)
+	}
+}
+
+// nixVerifier returns a nix.NixVerifier that delegates to the current one of
+// instance name, or of the daemon's own snapshotter for an empty name.
+func (l *liveConfig) nixVerifier(name string) nix.NixVerifier {
+	return func(ctx context.Context, nixStorePath string, repair bool) (bool, error) {
+		return l.state.Load().builders[name].nixVerifier(ctx, nixStorePath, repair)
+	}
+}
+
+// addPolicyReloader reloads the bind mount and namespace policies of the
+// snapshotter of instance name, or of the daemon's own for an empty name, on
+// every reload.
+func (l *liveConfig) addPolicyReloader(name string, reloader nix.PolicyReloader) {
+	l.policyReloaders[name] = reloader
+}
+
+// reload applies the hot reloadable settings of cfg. Settings that require a
+// restart are logged and otherwise ignored.
+func (l *liveConfig) reload(ctx context.Context, cfg *config.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	// Settings that require a restart keep their startup values, so that the
+	// live config reflects what the daemon is actually doing.
+	reloaded, restartRequired := l.config().Reload(cfg)
+	for _, key := range restartRequired {
+		log.G(ctx).WithField("key", key).Warn("Ignoring changed setting that requires a restart")
+	}
+
+	lvl, err := logrus.ParseLevel(reloaded.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	// Resolve every instance's config before applying any, so that a reload
+	// either applies to every snapshotter or to none.
+	policies := make(map[nix.PolicyReloader]*config.Config)
+	for name, reloader := range l.policyReloaders {
+		instanceCfg := reloaded
+		if name != "" {
+			instanceCfg, err = reloaded.Instance(name)
+			if err != nil {
+				return err
+			}
+		}
+		policies[reloader] = instanceCfg
+	}
+
+	state, err := newLiveState(reloaded)
+	if err != nil {
+		return err
+	}
+	l.state.Store(state)
+	for reloader, instanceCfg := range policies {
+		reloader.ReloadPolicies(nix.PoliciesFromConfig(instanceCfg))
+	}
+	logrus.SetLevel(lvl)
+	log.G(ctx).Info("Reloaded config")
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pdtpartners/nix-snapshotter/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLiveConfigBuilders(t *testing.T) {
+	testDir := t.TempDir()
+	argsPath := filepath.Join(testDir, "args")
+	err := os.WriteFile(filepath.Join(testDir, "nix-store"), []byte("#!/bin/sh\necho \"$@\" >> "+argsPath+"\n"), 0o755)
+	require.NoError(t, err)
+	t.Setenv("PATH", testDir+":"+os.Getenv("PATH"))
+
+	cfg := config.New()
+	cfg.Root = filepath.Join(testDir, "root")
+	cfg.Snapshotter.StoreRoot = "/data/nix"
+	cfg.Instances = map[string]config.InstanceConfig{
+		"other": {
+			Root:        filepath.Join(testDir, "other"),
+			Address:     filepath.Join(testDir, "other.sock"),
+			Snapshotter: config.SnapshotterConfig{StoreRoot: "/data/other"},
+		},
+	}
+	live, err := newLiveConfig(cfg)
+	require.NoError(t, err)
+
+	build := func(name string) {
+		err := live.nixBuilder(name)(context.Background(), "", "/nix/store/abc-hello")
+		require.NoError(t, err)
+	}
+	build("")
+	build("other")
+
+	// Builder settings are reloaded for every snapshotter, and every nix
+	// command it runs.
+	reloaded := *cfg
+	reloaded.Snapshotter.Builder.ExtraArgs = []string{"--quiet"}
+	require.NoError(t, live.reload(context.Background(), &reloaded))
+	build("")
+	build("other")
+	err = live.nixDatabaseBuilder("other")(context.Background(), "/state", []string{"/nix/store/abc-hello"})
+	require.NoError(t, err)
+	_, err = live.nixVerifier("other")(context.Background(), "/nix/store/abc-hello", false)
+	require.NoError(t, err)
+
+	args, err := os.ReadFile(argsPath)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"--store /data/nix --realise /nix/store/abc-hello",
+		"--store /data/other --realise /nix/store/abc-hello",
+		"--quiet --store /data/nix --realise /nix/store/abc-hello",
+		"--quiet --store /data/other --realise /nix/store/abc-hello",
+		"--quiet --store /data/other --dump-db /nix/store/abc-hello",
+		"--quiet --store local?root=/state --load-db",
+		"--quiet --store /data/other --verify-path /nix/store/abc-hello",
+	}, strings.Split(strings.TrimSpace(string(args)), "\n"))
+}
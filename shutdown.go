@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"google.golang.org/grpc"
+)
+
+// inflightTracker tracks the gRPC calls being handled, so that shutdown can
+// wait for their handlers to return even after their contexts are cancelled.
+type inflightTracker struct {
+	wg sync.WaitGroup
+}
+
+func (t *inflightTracker) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	t.wg.Add(1)
+	defer t.wg.Done()
+	return handler(ctx, req)
+}
+
+func (t *inflightTracker) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	t.wg.Add(1)
+	defer t.wg.Done()
+	return handler(srv, ss)
+}
+
+// gracefulStop stops rpcs from accepting new calls and waits up to timeout for
+// in-flight calls to finish. Calls still running after the timeout have their
+// contexts cancelled, which kills any nix builders they are waiting on.
+func gracefulStop(ctx context.Context, rpcs []*grpc.Server, tracker *inflightTracker, timeout time.Duration) {
+	log.G(ctx).WithField("timeout", timeout).Info("Draining in-flight calls")
+
+	var wg sync.WaitGroup
+	for _, rpc := range rpcs {
+		wg.Add(1)
+		go func(rpc *grpc.Server) {
+			defer wg.Done()
+			rpc.GracefulStop()
+		}(rpc)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		log.G(ctx).Warn("Timed out draining in-flight calls, cancelling them")
+		for _, rpc := range rpcs {
+			rpc.Stop()
+		}
+	}
+
+	// Stop doesn't wait for handlers to observe their cancellation.
+	tracker.wg.Wait()
+	log.G(ctx).Info("Drained in-flight calls")
+}
@@ -11,6 +11,8 @@ type Image struct {
 	OS            string              `json:"os"`
 	NixStorePaths []string            `json:"nix-store-paths,omitempty"`
 	CopyToRoots   []string            `json:"copy-to-roots,omitempty"`
+	MountTargets  map[string]string   `json:"mount-targets,omitempty"`
+	WritableStore bool                `json:"writable-store,omitempty"`
 }
 
 type OCIManifest struct {